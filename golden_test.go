@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "regenerate golden files instead of comparing")
+
+type goldenSeparators struct {
+	Terminator string
+	Element    string
+	Component  string
+	Decimal    string
+	Release    string
+}
+
+type goldenCase struct {
+	Separators *goldenSeparators
+	Encoding   string
+	Order      EDIOrder
+}
+
+func (c goldenCase) generator() (*EDIFACTOrderGenerator, error) {
+	gen, err := NewEDIFACTOrderGenerator()
+	if err != nil {
+		return nil, err
+	}
+	
+	orderDate := c.Order.OrderDate
+	gen.WithClockFunc(func() time.Time { return orderDate })
+	
+	if sep := c.Separators; sep != nil {
+		if _, err := gen.WithCustomSeparators(sep.Terminator, sep.Element, sep.Component, sep.Decimal, sep.Release); err != nil {
+			return nil, err
+		}
+	}
+	
+	if c.Encoding != "" {
+		found := false
+		for _, enc := range []Encoding{EncodingUTF8, EncodingASCII, EncodingISO88591, EncodingWindows1252} {
+			if enc.Name() == c.Encoding {
+				gen.WithCharacterEncoding(enc)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown encoding %q", c.Encoding)
+		}
+	}
+	
+	return gen, nil
+}
+
+func TestGoldenCorpus(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "golden", "*.json"))
+	if err != nil {
+		t.Fatalf("failed to list golden corpus: %v", err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("golden corpus is empty")
+	}
+	
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".json")
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", input, err)
+			}
+			
+			var c goldenCase
+			if err := json.Unmarshal(data, &c); err != nil {
+				t.Fatalf("failed to parse %s: %v", input, err)
+			}
+			
+			gen, err := c.generator()
+			if err != nil {
+				t.Fatalf("failed to configure generator: %v", err)
+			}
+			
+			var buffer strings.Builder
+			if err := gen.Generate(context.Background(), c.Order, &buffer); err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			
+			size, err := gen.EstimateSize(c.Order)
+			if err != nil {
+				t.Fatalf("EstimateSize() error = %v", err)
+			}
+			if size < buffer.Len() {
+				t.Errorf("EstimateSize() = %d, below the %d bytes generated", size, buffer.Len())
+			}
+			
+			golden := strings.TrimSuffix(input, ".json") + ".edi"
+			if *update {
+				if err := os.WriteFile(golden, []byte(buffer.String()), FilePerms); err != nil {
+					t.Fatalf("failed to write %s: %v", golden, err)
+				}
+				return
+			}
+			
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", golden, err)
+			}
+			if diff := firstDifference(string(expected), buffer.String()); diff != "" {
+				t.Errorf("%s: %s", filepath.Base(golden), diff)
+			}
+		})
+	}
+}
+
+func firstDifference(expected, actual string) string {
+	if expected == actual {
+		return ""
+	}
+	
+	expectedLines := strings.Split(expected, "\n")
+	actualLines := strings.Split(actual, "\n")
+	for i := 0; i < len(expectedLines) || i < len(actualLines); i++ {
+		var want, got string
+		if i < len(expectedLines) {
+			want = expectedLines[i]
+		}
+		if i < len(actualLines) {
+			got = actualLines[i]
+		}
+		if want != got {
+			return fmt.Sprintf("line %d: expected %q, got %q", i+1, want, got)
+		}
+	}
+	
+	return "output differs"
+}
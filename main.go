@@ -1,19 +1,38 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"container/heap"
+	"container/list"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"iter"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 const (
+	SegmentTagUNA = "UNA"
 	SegmentTagUNB = "UNB"
 	SegmentTagUNH = "UNH"
 	SegmentTagBGM = "BGM"
@@ -32,6 +51,21 @@ const (
 	SegmentTagCNT = "CNT"
 	SegmentTagUNT = "UNT"
 	SegmentTagUNZ = "UNZ"
+	SegmentTagSCC = "SCC"
+	SegmentTagMTQ = "MTQ"
+	SegmentTagRFF = "RFF"
+	SegmentTagAPR = "APR"
+	SegmentTagRNG = "RNG"
+	SegmentTagALC = "ALC"
+	SegmentTagBUS = "BUS"
+	SegmentTagPCD = "PCD"
+	SegmentTagLOC = "LOC"
+	SegmentTagRCS = "RCS"
+	SegmentTagUCI = "UCI"
+	SegmentTagUCM = "UCM"
+	SegmentTagSPS = "SPS"
+	SegmentTagPAI = "PAI"
+	SegmentTagProprietaryHMC = "HMC"
 	
 	DateFormatYYMMDD = "060102"
 	DateFormatHHMM   = "1504"
@@ -40,31 +74,108 @@ const (
 	QualifierDocumentDate = "137"
 	QualifierDeliveryDate = "2"
 	QualifierLineDeliveryDate = "64"
+	QualifierLatestDeliveryDate = "63"
+	QualifierReferenceDate = "171"
+	QualifierTermsDueDate = "13"
+	
+	FormatCodeTimeWindow = "704"
+	
+	ScheduleFirm = "1"
+	FrequencyWeekly = "701"
 	
 	CodeOrder = "220"
 	CodeOriginal = "9"
 	
+	BusinessFunctionUnderlying = "1"
+	
+	MessageTypeCONTRL = "CONTRL"
+	ActionAcknowledged = "7"
+	ActionRejected = "4"
+	
 	PartyBuyer = "BY"
 	PartySeller = "SE"
 	PartyDelivery = "DP"
 	PartyInvoice = "IV"
 	
 	IDTypeBuyer = "9"
+	IDTypeLocode = "5"
+	IDTypeBIC = "BIC"
+	
+	InterchangeQualifierGLN = "14"
+	
+	IndicatorProduction = 0
+	IndicatorTest = 1
 	
 	CurrencyReference = "2"
 	
+	ReferenceContract = "CT"
+	ReferenceDeliverySchedule = "DS"
+	ReferenceOrder = "ON"
+	ReferencePromotionDeal = "PD"
+	
+	ItemNumberEAN = "EN"
+	ItemNumberSupplier = "SA"
+	
 	QuantityOrdered = "21"
+	QuantityReturned = "83"
+	
+	ItemFormatFreeText = "F"
+	ItemFormatCoded = "C"
+	ItemFormatBoth = "B"
+	ItemFormatFreeLong = "A"
+	ItemFormatFreeFull = "E"
 	
 	PriceNet = "AAA"
+	PriceFreeGoods = "FRE"
+	
+	TradeClassWholesale = "WS"
+	
+	AllowanceIndicator = "A"
+	ChargeIndicator = "C"
+	AllowanceSequence = "1"
+	AllowanceServiceDiscount = "DI"
+	PercentageAllowance = "1"
+	PercentageCharge = "2"
+	
+	DiscountTypePercentage = "percentage"
+	DiscountTypeAmount = "amount"
+	RangeQuantity = "4"
 	
 	AmountLine = "203"
 	AmountTotal = "128"
+	AmountInstalment = "9"
+	AmountAllowance = "204"
+	AmountCharge = "23"
+	
+	PaymentTermsBasic = "1"
+	PaymentMeansCash = "10"
+	PaymentMeansCheque = "20"
+	PaymentMeansCreditTransfer = "30"
+	PaymentMeansDebitTransfer = "31"
+	PaymentMeansBankAccount = "42"
+	PaymentMeansDocumentaryCredit = "70"
+	PercentageInstalment = "12"
 	
 	ControlTotalLines = "2"
+	ControlTotalQuantity = "1"
+	ControlTotalPackages = "11"
+	
+	ControlSelectLines = "lines"
+	ControlSelectQuantity = "quantity"
+	ControlSelectPackages = "packages"
+	
+	DefaultRepetitionSeparator = "*"
+	DefaultMessageType = "ORDERS"
 	
 	FilePerms = 0644
 	DirPerms = 0755
 	MaxSegmentLength = 1000
+	MaxAmountDigits = 18
+	MaxQuantityDigits = 15
+	MaxPriceDigits = 15
+	FastPathMaxItems = 4
+	MaxAbandonedSegmentBuilds = 8
+	DefaultQuantityPrecision = 2
 )
 
 var (
@@ -74,38 +185,517 @@ var (
 	ErrInvalidSeparator = errors.New("invalid separator character")
 	ErrSegmentTooLong = errors.New("segment exceeds maximum length")
 	ErrContextCancelled = errors.New("context cancelled")
+	ErrUnexpectedLine = errors.New("unexpected line number")
+	ErrIncompleteOutput = errors.New("not all lines were written")
+	ErrUnencodableCharacter = errors.New("character cannot be represented in output encoding")
+	ErrCacheMiss = errors.New("no cached order for key")
+	ErrMalformedUNA = errors.New("malformed UNA service string advice")
+	ErrMalformedSegment = errors.New("malformed segment")
+	ErrUnexpectedSegment = errors.New("unexpected segment")
+	ErrControlCountMismatch = errors.New("control count mismatch")
+	ErrDuplicateControlRef = errors.New("duplicate interchange control reference")
+	ErrNoMessages = errors.New("no messages")
+	ErrSegmentBuildTimeout = errors.New("segment build timed out")
+	ErrTemplateNotReusable = errors.New("template output cannot be reused")
+)
+
+type Anchor int
+
+const (
+	AnchorAfterBGM Anchor = iota
+	AnchorAfterHeaderNAD
+	AnchorPerLineAfterMOA
+	AnchorInSummary
+)
+
+func (a Anchor) String() string {
+	switch a {
+	case AnchorAfterBGM:
+		return "AfterBGM"
+	case AnchorAfterHeaderNAD:
+		return "AfterHeaderNAD"
+	case AnchorPerLineAfterMOA:
+		return "PerLineAfterMOA"
+	case AnchorInSummary:
+		return "InSummary"
+	default:
+		return fmt.Sprintf("Anchor(%d)", int(a))
+	}
+}
+
+type SignStyle int
+
+const (
+	SignLeading SignStyle = iota
+	SignTrailing
+	SignParenthesized
+)
+
+func (s SignStyle) String() string {
+	switch s {
+	case SignLeading:
+		return "Leading"
+	case SignTrailing:
+		return "Trailing"
+	case SignParenthesized:
+		return "Parenthesized"
+	default:
+		return fmt.Sprintf("SignStyle(%d)", int(s))
+	}
+}
+
+type ZeroPriceMode int
+
+const (
+	ZeroPriceEmit ZeroPriceMode = iota
+	ZeroPriceOmit
+	ZeroPriceFreeGoods
+)
+
+func (m ZeroPriceMode) String() string {
+	switch m {
+	case ZeroPriceEmit:
+		return "Emit"
+	case ZeroPriceOmit:
+		return "Omit"
+	case ZeroPriceFreeGoods:
+		return "FreeGoods"
+	default:
+		return fmt.Sprintf("ZeroPriceMode(%d)", int(m))
+	}
+}
+
+type Encoding int
+
+const (
+	EncodingUTF8 Encoding = iota
+	EncodingASCII
+	EncodingISO88591
+	EncodingWindows1252
 )
 
+type OutputEncoding interface {
+	Name() string
+	Encode(s string) ([]byte, error)
+}
+
+type CustomEncoding struct {
+	Charset    string
+	EncodeFunc func(s string) ([]byte, error)
+}
+
+func (f CustomEncoding) Name() string {
+	return f.Charset
+}
+
+func (f CustomEncoding) Encode(s string) ([]byte, error) {
+	return f.EncodeFunc(s)
+}
+
+var windows1252Extended = map[rune]byte{
+	0x20AC: 0x80, 0x201A: 0x82, 0x0192: 0x83, 0x201E: 0x84,
+	0x2026: 0x85, 0x2020: 0x86, 0x2021: 0x87, 0x02C6: 0x88,
+	0x2030: 0x89, 0x0160: 0x8A, 0x2039: 0x8B, 0x0152: 0x8C,
+	0x017D: 0x8E, 0x2018: 0x91, 0x2019: 0x92, 0x201C: 0x93,
+	0x201D: 0x94, 0x2022: 0x95, 0x2013: 0x96, 0x2014: 0x97,
+	0x02DC: 0x98, 0x2122: 0x99, 0x0161: 0x9A, 0x203A: 0x9B,
+	0x0153: 0x9C, 0x017E: 0x9E, 0x0178: 0x9F,
+}
+
+var syntaxCharsets = map[string]string{
+	"UNOA": "ASCII",
+	"UNOB": "ASCII",
+	"UNOC": "ISO-8859-1",
+	"UNOW": "UTF-8",
+	"UNOY": "UTF-8",
+}
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingUTF8:
+		return "UTF-8"
+	case EncodingASCII:
+		return "ASCII"
+	case EncodingISO88591:
+		return "ISO-8859-1"
+	case EncodingWindows1252:
+		return "windows-1252"
+	default:
+		return fmt.Sprintf("Encoding(%d)", int(e))
+	}
+}
+
+func (e Encoding) Name() string {
+	return e.String()
+}
+
+func (e Encoding) Encode(s string) ([]byte, error) {
+	switch e {
+	case EncodingASCII, EncodingISO88591:
+		limit := rune(0x7F)
+		if e == EncodingISO88591 {
+			limit = 0xFF
+		}
+		out := make([]byte, 0, len(s))
+		for _, r := range s {
+			if r > limit {
+				return nil, fmt.Errorf("%w: %q in %s", ErrUnencodableCharacter, r, e)
+			}
+			out = append(out, byte(r))
+		}
+		return out, nil
+	case EncodingWindows1252:
+		out := make([]byte, 0, len(s))
+		for _, r := range s {
+			switch {
+			case r < 0x80 || (r >= 0xA0 && r <= 0xFF):
+				out = append(out, byte(r))
+			case windows1252Extended[r] != 0:
+				out = append(out, windows1252Extended[r])
+			default:
+				return nil, fmt.Errorf("%w: %q in %s", ErrUnencodableCharacter, r, e)
+			}
+		}
+		return out, nil
+	default:
+		return []byte(s), nil
+	}
+}
+
+var incoterms2020 = map[string]bool{
+	"EXW": true,
+	"FCA": true,
+	"CPT": true,
+	"CIP": true,
+	"DAP": true,
+	"DPU": true,
+	"DDP": true,
+	"FAS": true,
+	"FOB": true,
+	"CFR": true,
+	"CIF": true,
+}
+
+var partyIDTypes = map[string]bool{
+	"3":   true,
+	"5":   true,
+	"6":   true,
+	"9":   true,
+	"10":  true,
+	"16":  true,
+	"86":  true,
+	"87":  true,
+	"89":  true,
+	"90":  true,
+	"91":  true,
+	"92":  true,
+	"ZZZ": true,
+	"BIC": true,
+}
+
+var responsibleAgencies = map[string]bool{
+	"UN":  true,
+	"EAN": true,
+	"EN":  true,
+	"ISO": true,
+	"ZZZ": true,
+}
+
+var imdFormatCodes = map[string]bool{
+	ItemFormatFreeLong: true,
+	ItemFormatBoth:     true,
+	ItemFormatCoded:    true,
+	ItemFormatFreeFull: true,
+	ItemFormatFreeText: true,
+}
+
+var dtmQualifiers = map[string]bool{
+	"2":   true,
+	"10":  true,
+	"35":  true,
+	"63":  true,
+	"64":  true,
+	"69":  true,
+	"137": true,
+	"171": true,
+	"177": true,
+	"200": true,
+}
+
+var requirementSectorCodes = map[string]bool{
+	"1":  true,
+	"2":  true,
+	"3":  true,
+	"4":  true,
+	"5":  true,
+	"6":  true,
+	"7":  true,
+	"8":  true,
+	"9":  true,
+	"10": true,
+	"11": true,
+	"12": true,
+}
+
+var controlTotalQualifiers = map[string]bool{
+	"1":  true,
+	"2":  true,
+	"3":  true,
+	"7":  true,
+	"8":  true,
+	"11": true,
+	"16": true,
+}
+
+var paymentMeansCodes = map[string]bool{
+	"1":                           true,
+	"2":                           true,
+	"3":                           true,
+	PaymentMeansCash:              true,
+	PaymentMeansCheque:            true,
+	PaymentMeansCreditTransfer:    true,
+	PaymentMeansDebitTransfer:     true,
+	PaymentMeansBankAccount:       true,
+	"60":                          true,
+	PaymentMeansDocumentaryCredit: true,
+	"ZZZ":                         true,
+}
+
+var controlTotalSelectors = map[string]bool{
+	ControlSelectLines:    true,
+	ControlSelectQuantity: true,
+	ControlSelectPackages: true,
+}
+
+type MessageTypeKey struct {
+	Type    string
+	Version string
+	Release string
+	Agency  string
+}
+
+type MessageTypeRegistry map[MessageTypeKey]bool
+
+func NewMessageTypeRegistry() MessageTypeRegistry {
+	registry := make(MessageTypeRegistry)
+	for _, messageType := range []string{DefaultMessageType, "ORDCHG", "INVOIC", "DESADV", "RECADV", "ORDRSP", "PRICAT"} {
+		for _, release := range []string{"93A", "96A", "01B"} {
+			registry.Register(messageType, "D", release, "UN")
+		}
+	}
+	return registry
+}
+
+func (r MessageTypeRegistry) Register(messageType, version, release, agency string) {
+	r[MessageTypeKey{Type: messageType, Version: version, Release: release, Agency: agency}] = true
+}
+
+func (r MessageTypeRegistry) IsKnown(messageType, version, release, agency string) bool {
+	return r[MessageTypeKey{Type: messageType, Version: version, Release: release, Agency: agency}]
+}
+
+func (o EDIOrder) messageTypeKey() MessageTypeKey {
+	key := MessageTypeKey{Type: DefaultMessageType, Version: "D", Release: "96A", Agency: "UN"}
+	if o.MessageType != "" {
+		key.Type = o.MessageType
+	}
+	if o.MessageVersion != "" {
+		key.Version = o.MessageVersion
+	}
+	if o.MessageRelease != "" {
+		key.Release = o.MessageRelease
+	}
+	if o.ResponsibleAgency != "" {
+		key.Agency = o.ResponsibleAgency
+	}
+	return key
+}
+
 type ValidationError struct {
 	Field string
 	Message string
+	format *template.Template
 }
 
 func (e ValidationError) Error() string {
+	if e.format != nil {
+		var b strings.Builder
+		if err := e.format.Execute(&b, validationErrorFields{Field: e.Field, Message: e.Message}); err == nil {
+			return b.String()
+		}
+	}
 	return fmt.Sprintf("validation error on field %s: %s", e.Field, e.Message)
 }
 
+type validationErrorFields struct {
+	Field string
+	Message string
+}
+
+func withValidationErrorFormat(err error, format *template.Template) error {
+	switch e := err.(type) {
+	case *ValidationError:
+		formatted := *e
+		formatted.format = format
+		return &formatted
+	case *ValidationErrors:
+		formatted := make([]error, len(e.Errors))
+		for i, inner := range e.Errors {
+			formatted[i] = withValidationErrorFormat(inner, format)
+		}
+		return &ValidationErrors{Errors: formatted}
+	default:
+		return err
+	}
+}
+
+type SegmentErrors struct {
+	Errors []error
+}
+
+func (e *SegmentErrors) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d segment build errors: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+func (e *SegmentErrors) Unwrap() []error {
+	return e.Errors
+}
+
+type ValidationErrors struct {
+	Errors []error
+}
+
+func (e *ValidationErrors) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d validation errors: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+func (e *ValidationErrors) Unwrap() []error {
+	return e.Errors
+}
+
+type Validator interface {
+	Validate(order EDIOrder) []error
+}
+
+type ValidatorFunc func(order EDIOrder) []error
+
+func (f ValidatorFunc) Validate(order EDIOrder) []error {
+	return f(order)
+}
+
+type LintErrors struct {
+	Findings []LintFinding
+}
+
+func (e *LintErrors) Error() string {
+	messages := make([]string, len(e.Findings))
+	for i, finding := range e.Findings {
+		messages[i] = finding.String()
+	}
+	return fmt.Sprintf("%d lint findings treated as errors: %s", len(e.Findings), strings.Join(messages, "; "))
+}
+
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+type LintFinding struct {
+	Severity Severity
+	Field    string
+	Message  string
+}
+
+func (f LintFinding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Severity, f.Field, f.Message)
+}
+
 type EDISegment struct {
 	Tag      string
 	Elements []string
 }
 
 func (s EDISegment) String(separator string, terminator string, releaseChar string) (string, error) {
+	result := s.render(separator, string(DefaultDelimiters.Component), "", terminator, releaseChar)
+	
+	if len(result) > MaxSegmentLength {
+		return "", ErrSegmentTooLong
+	}
+	
+	return result, nil
+}
+
+func (s EDISegment) render(separator string, component string, repetition string, terminator string, releaseChar string) string {
 	var escapedElements []string
 	for _, elem := range s.Elements {
-		escaped := strings.ReplaceAll(elem, separator, releaseChar+separator)
-		escaped = strings.ReplaceAll(escaped, terminator, releaseChar+terminator)
-		escaped = strings.ReplaceAll(escaped, releaseChar, releaseChar+releaseChar)
-		escapedElements = append(escapedElements, escaped)
+		components := strings.Split(elem, string(DefaultDelimiters.Component))
+		for i, value := range components {
+			escaped := strings.ReplaceAll(value, releaseChar, releaseChar+releaseChar)
+			for _, special := range []string{separator, component, repetition, terminator} {
+				if special != "" {
+					escaped = strings.ReplaceAll(escaped, special, releaseChar+special)
+				}
+			}
+			components[i] = escaped
+		}
+		escapedElements = append(escapedElements, strings.Join(components, component))
 	}
 	
-	result := s.Tag + separator + strings.Join(escapedElements, separator) + terminator
+	return s.Tag + separator + strings.Join(escapedElements, separator) + terminator
+}
+
+func joinComponents(components ...string) string {
+	return strings.Join(components, string(DefaultDelimiters.Component))
+}
+
+func appendSegment(dst []byte, s EDISegment, separator, terminator, releaseChar byte) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, s.Tag...)
+	dst = append(dst, separator)
+	for i, elem := range s.Elements {
+		if i > 0 {
+			dst = append(dst, separator)
+		}
+		for j := 0; j < len(elem); j++ {
+			switch c := elem[j]; c {
+			case separator, terminator, releaseChar:
+				dst = append(dst, releaseChar, c)
+			default:
+				dst = append(dst, c)
+			}
+		}
+	}
+	dst = append(dst, terminator)
 	
-	if len(result) > MaxSegmentLength {
-		return "", ErrSegmentTooLong
+	if len(dst)-start > MaxSegmentLength {
+		return dst[:start], ErrSegmentTooLong
 	}
 	
-	return result, nil
+	return append(dst, '\n'), nil
 }
 
 type Address struct {
@@ -113,13 +703,31 @@ type Address struct {
 	Lines   []string
 	ID      string
 	IDType  string
+	LocationCode string
+	BICCode     string
+	StreetLines []string
+	City        string
+	Region      string
+	PostalCode  string
+	CountryCode string
+	DeliveryWindows []DockWindow
+}
+
+type DockWindow struct {
+	DockCode string
+	TimeFrom string
+	TimeTo   string
+}
+
+func (a Address) isStructured() bool {
+	return len(a.StreetLines) > 0 || a.City != "" || a.Region != "" || a.PostalCode != "" || a.CountryCode != ""
 }
 
 func (a Address) Validate() error {
 	if a.Name == "" {
 		return &ValidationError{Field: "Address.Name", Message: "name is required"}
 	}
-	if len(a.Lines) == 0 {
+	if len(a.Lines) == 0 && !a.isStructured() {
 		return &ValidationError{Field: "Address.Lines", Message: "at least one address line is required"}
 	}
 	for i, line := range a.Lines {
@@ -127,20 +735,224 @@ func (a Address) Validate() error {
 			return &ValidationError{Field: fmt.Sprintf("Address.Lines[%d]", i), Message: "address line exceeds 35 characters"}
 		}
 	}
+	if a.isStructured() {
+		if len(a.Name) > 35 {
+			return &ValidationError{Field: "Address.Name", Message: "party name exceeds 35 characters"}
+		}
+		if len(a.StreetLines) > 4 {
+			return &ValidationError{Field: "Address.StreetLines", Message: "at most 4 street lines are allowed"}
+		}
+		for i, line := range a.StreetLines {
+			if len(line) > 35 {
+				return &ValidationError{Field: fmt.Sprintf("Address.StreetLines[%d]", i), Message: "street line exceeds 35 characters"}
+			}
+		}
+		if len(a.City) > 35 {
+			return &ValidationError{Field: "Address.City", Message: "city name exceeds 35 characters"}
+		}
+		if len(a.Region) > 9 {
+			return &ValidationError{Field: "Address.Region", Message: "country sub-entity exceeds 9 characters"}
+		}
+		if len(a.PostalCode) > 17 {
+			return &ValidationError{Field: "Address.PostalCode", Message: "postal code exceeds 17 characters"}
+		}
+		if len(a.CountryCode) > 3 {
+			return &ValidationError{Field: "Address.CountryCode", Message: "country code exceeds 3 characters"}
+		}
+	}
+	for i, window := range a.DeliveryWindows {
+		field := fmt.Sprintf("Address.DeliveryWindows[%d]", i)
+		if window.DockCode == "" || len(window.DockCode) > 25 {
+			return &ValidationError{Field: field + ".DockCode", Message: "dock code must be 1 to 25 characters"}
+		}
+		if !isDigits(window.TimeFrom) || !isDigits(window.TimeTo) {
+			return &ValidationError{Field: field, Message: "delivery window times must be numeric"}
+		}
+		if len(window.TimeFrom) != len(window.TimeTo) || window.TimeTo < window.TimeFrom {
+			return &ValidationError{Field: field + ".TimeTo", Message: "delivery window ends before it starts"}
+		}
+	}
+	if a.LocationCode != "" && !isValidLocode(a.LocationCode) {
+		return &ValidationError{Field: "Address.LocationCode", Message: fmt.Sprintf("location code %q is not a valid UN/LOCODE", a.LocationCode)}
+	}
+	if a.LocationCode != "" && (a.ID != "" || a.BICCode != "") {
+		return &ValidationError{Field: "Address.LocationCode", Message: "location code cannot be combined with a party ID or BIC code"}
+	}
 	return nil
 }
 
+func isValidLocode(code string) bool {
+	if len(code) != 5 {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		switch {
+		case c >= 'A' && c <= 'Z':
+		case i >= 2 && c >= '2' && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type Party struct {
+	Qualifier string
+	Address   Address
+}
+
+var partySequence = map[string]int{
+	PartyBuyer:    0,
+	PartySeller:   1,
+	PartyDelivery: 2,
+	PartyInvoice:  3,
+}
+
+func partyRank(qualifier string) int {
+	if rank, ok := partySequence[qualifier]; ok {
+		return rank
+	}
+	return len(partySequence)
+}
+
+type orderParty struct {
+	qualifier string
+	field     string
+	address   Address
+}
+
 type EDIOrderItem struct {
 	LineNumber      int
 	BuyerItemCode   string
 	SupplierItemCode string
+	EANCode         string
 	Quantity        float64
+	ReturnedQuantity float64
 	UnitPrice       float64
+	PriceBasisQuantity float64
+	PriceBasisUOM   string
 	UnitOfMeasure   string
 	Description     string
+	ItemDescriptionCode string
+	ItemDescriptionCodeList string
+	ItemDescriptionAgency string
+	IMDFormatCode   string
+	IMDs            []ItemDescription
 	TaxRate         float64
 	Amount          float64
 	DeliveryDate    time.Time
+	DeliverySchedule []ScheduleEntry
+	ScheduleRef     string
+	MeteredQuantities []MeteredQty
+	PriceBreaks     []PriceBreak
+	PackageCount    int
+	Discount        float64
+	DiscountType    string
+	Dates           []LineDate
+	LineTransportMode string
+	LineCarrierCode string
+	References      []Reference
+	LineRefs        []Reference
+}
+
+type ItemDescription struct {
+	Characteristic string
+	Code           string
+	CodeList       string
+	Agency         string
+	Text           string
+	Language       string
+}
+
+type LineDate struct {
+	Qualifier string
+	Date      time.Time
+}
+
+type Reference struct {
+	Qualifier string
+	Number    string
+	Date      time.Time
+}
+
+type PriceBreak struct {
+	MinQuantity float64
+	MaxQuantity float64
+	Price       float64
+	TradeClass  string
+}
+
+type MeteredQty struct {
+	Qualifier string
+	Quantity  string
+	UOM       string
+}
+
+type ScheduleEntry struct {
+	Quantity  float64
+	From      time.Time
+	To        time.Time
+	Frequency string
+}
+
+func NormalizeSchedule(entries []ScheduleEntry) ([]ScheduleEntry, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	
+	normalized := make([]ScheduleEntry, len(entries))
+	copy(normalized, entries)
+	sort.SliceStable(normalized, func(a, b int) bool {
+		return normalized[a].From.Before(normalized[b].From)
+	})
+	
+	for i, entry := range normalized {
+		if entry.Quantity <= 0 {
+			return nil, &ValidationError{Field: fmt.Sprintf("ScheduleEntry[%d].Quantity", i), Message: "scheduled quantity must be positive"}
+		}
+		if entry.From.IsZero() {
+			return nil, &ValidationError{Field: fmt.Sprintf("ScheduleEntry[%d].From", i), Message: "schedule start date is required"}
+		}
+		if !entry.To.IsZero() && entry.To.Before(entry.From) {
+			return nil, &ValidationError{Field: fmt.Sprintf("ScheduleEntry[%d].To", i), Message: "schedule end date is before start date"}
+		}
+		if len(entry.Frequency) > 3 {
+			return nil, &ValidationError{Field: fmt.Sprintf("ScheduleEntry[%d].Frequency", i), Message: "frequency code exceeds 3 characters"}
+		}
+		if i > 0 {
+			prev := normalized[i-1]
+			prevEnd := prev.To
+			if prevEnd.IsZero() {
+				prevEnd = prev.From
+			}
+			if !entry.From.After(prevEnd) {
+				return nil, &ValidationError{Field: fmt.Sprintf("ScheduleEntry[%d].From", i), Message: "schedule date range overlaps the previous entry"}
+			}
+		}
+	}
+	
+	return normalized, nil
+}
+
+func validateReferences(field string, refs []Reference) error {
+	for j, ref := range refs {
+		if ref.Qualifier == "" || len(ref.Qualifier) > 3 {
+			return &ValidationError{Field: fmt.Sprintf("%s[%d].Qualifier", field, j), Message: "reference qualifier must be 1 to 3 characters"}
+		}
+		if ref.Number == "" {
+			return &ValidationError{Field: fmt.Sprintf("%s[%d].Number", field, j), Message: "reference number is required"}
+		}
+		if len(ref.Number) > 35 {
+			return &ValidationError{Field: fmt.Sprintf("%s[%d].Number", field, j), Message: "reference number exceeds 35 characters"}
+		}
+	}
+	return nil
+}
+
+func (i *EDIOrderItem) ComputeAmount() float64 {
+	i.Amount = math.Round(i.Quantity*i.UnitPrice*100) / 100
+	return i.Amount
 }
 
 func (i EDIOrderItem) Validate() error {
@@ -153,34 +965,157 @@ func (i EDIOrderItem) Validate() error {
 	if len(i.BuyerItemCode) > 35 {
 		return &ValidationError{Field: "EDIOrderItem.BuyerItemCode", Message: "buyer item code exceeds 35 characters"}
 	}
-	if i.Quantity <= 0 {
-		return &ValidationError{Field: "EDIOrderItem.Quantity", Message: "quantity must be positive"}
+	if len(i.SupplierItemCode) > 35 {
+		return &ValidationError{Field: "EDIOrderItem.SupplierItemCode", Message: "supplier item code exceeds 35 characters"}
 	}
-	if i.UnitPrice < 0 {
-		return &ValidationError{Field: "EDIOrderItem.UnitPrice", Message: "unit price cannot be negative"}
+	if !isPrintableASCII(i.SupplierItemCode) {
+		return &ValidationError{Field: "EDIOrderItem.SupplierItemCode", Message: "supplier item code contains non-printable or non-ASCII characters"}
 	}
-	return nil
-}
-
-type EDIOrder struct {
-	InterchangeSenderID     string
-	InterchangeReceiverID   string
-	InterchangeControlRef   string
-	MessageRefNumber        string
-	OrderNumber             string
+	if len(i.ItemDescriptionCode) > 17 {
+		return &ValidationError{Field: "EDIOrderItem.ItemDescriptionCode", Message: "item description code exceeds 17 characters"}
+	}
+	if i.ItemDescriptionCode == "" && (i.ItemDescriptionCodeList != "" || i.ItemDescriptionAgency != "") {
+		return &ValidationError{Field: "EDIOrderItem.ItemDescriptionCode", Message: "item description code is required when a code list or agency is given"}
+	}
+	if i.IMDFormatCode != "" && !imdFormatCodes[i.IMDFormatCode] {
+		return &ValidationError{Field: "EDIOrderItem.IMDFormatCode", Message: fmt.Sprintf("IMD format code %q must be one of A, B, C, E or F", i.IMDFormatCode)}
+	}
+	if (i.IMDFormatCode == ItemFormatCoded || i.IMDFormatCode == ItemFormatBoth) && i.ItemDescriptionCode == "" {
+		return &ValidationError{Field: "EDIOrderItem.ItemDescriptionCode", Message: fmt.Sprintf("item description code is required for IMD format %s", i.IMDFormatCode)}
+	}
+	if len(i.ItemDescriptionCodeList) > 3 {
+		return &ValidationError{Field: "EDIOrderItem.ItemDescriptionCodeList", Message: "code list qualifier exceeds 3 characters"}
+	}
+	if len(i.ItemDescriptionAgency) > 3 {
+		return &ValidationError{Field: "EDIOrderItem.ItemDescriptionAgency", Message: "code list responsible agency exceeds 3 characters"}
+	}
+	for j, desc := range i.IMDs {
+		field := fmt.Sprintf("EDIOrderItem.IMDs[%d]", j)
+		if desc.Code == "" && desc.Text == "" {
+			return &ValidationError{Field: field, Message: "item description requires a code or free text"}
+		}
+		if len(desc.Characteristic) > 3 {
+			return &ValidationError{Field: field + ".Characteristic", Message: "item characteristic code exceeds 3 characters"}
+		}
+		if len(desc.Code) > 17 {
+			return &ValidationError{Field: field + ".Code", Message: "item description code exceeds 17 characters"}
+		}
+		if len(desc.CodeList) > 3 || len(desc.Agency) > 3 || len(desc.Language) > 3 {
+			return &ValidationError{Field: field, Message: "code list qualifier, agency and language must not exceed 3 characters"}
+		}
+		if len(desc.Text) > 35 {
+			return &ValidationError{Field: field + ".Text", Message: "item description text exceeds 35 characters"}
+		}
+	}
+	if len(i.LineTransportMode) > 17 {
+		return &ValidationError{Field: "EDIOrderItem.LineTransportMode", Message: "line transport mode exceeds 17 characters"}
+	}
+	if len(i.LineCarrierCode) > 17 {
+		return &ValidationError{Field: "EDIOrderItem.LineCarrierCode", Message: "line carrier code exceeds 17 characters"}
+	}
+	if i.EANCode != "" && !isValidGTIN(i.EANCode) {
+		return &ValidationError{Field: "EDIOrderItem.EANCode", Message: "EAN code is not a valid GTIN"}
+	}
+	if i.Quantity <= 0 {
+		return &ValidationError{Field: "EDIOrderItem.Quantity", Message: "quantity must be positive"}
+	}
+	if i.ReturnedQuantity < 0 {
+		return &ValidationError{Field: "EDIOrderItem.ReturnedQuantity", Message: "returned quantity cannot be negative"}
+	}
+	if i.UnitPrice < 0 {
+		return &ValidationError{Field: "EDIOrderItem.UnitPrice", Message: "unit price cannot be negative"}
+	}
+	if len(i.ScheduleRef) > 35 {
+		return &ValidationError{Field: "EDIOrderItem.ScheduleRef", Message: "schedule reference exceeds 35 characters"}
+	}
+	if i.PriceBasisQuantity < 0 {
+		return &ValidationError{Field: "EDIOrderItem.PriceBasisQuantity", Message: "price basis quantity cannot be negative"}
+	}
+	if len(i.PriceBasisUOM) > 3 {
+		return &ValidationError{Field: "EDIOrderItem.PriceBasisUOM", Message: "price basis unit of measure exceeds 3 characters"}
+	}
+	for j, mtq := range i.MeteredQuantities {
+		if mtq.Qualifier == "" || len(mtq.Qualifier) > 3 {
+			return &ValidationError{Field: fmt.Sprintf("EDIOrderItem.MeteredQuantities[%d].Qualifier", j), Message: "metered quantity qualifier must be 1 to 3 characters"}
+		}
+		if _, err := strconv.ParseFloat(mtq.Quantity, 64); err != nil {
+			return &ValidationError{Field: fmt.Sprintf("EDIOrderItem.MeteredQuantities[%d].Quantity", j), Message: "metered quantity must be numeric"}
+		}
+	}
+	for j, pb := range i.PriceBreaks {
+		field := fmt.Sprintf("EDIOrderItem.PriceBreaks[%d]", j)
+		if pb.MinQuantity <= 0 {
+			return &ValidationError{Field: field + ".MinQuantity", Message: "price break minimum quantity must be positive"}
+		}
+		if pb.MaxQuantity != 0 && pb.MaxQuantity < pb.MinQuantity {
+			return &ValidationError{Field: field + ".MaxQuantity", Message: "price break maximum quantity is below the minimum"}
+		}
+		if pb.Price < 0 {
+			return &ValidationError{Field: field + ".Price", Message: "price break price cannot be negative"}
+		}
+		if j > 0 {
+			prev := i.PriceBreaks[j-1]
+			if prev.MaxQuantity == 0 {
+				return &ValidationError{Field: field, Message: "only the last price break may be open-ended"}
+			}
+			if pb.MinQuantity <= prev.MaxQuantity {
+				return &ValidationError{Field: field + ".MinQuantity", Message: "price breaks must be ascending and non-overlapping"}
+			}
+		}
+	}
+	if i.Discount != 0 && i.DiscountType != DiscountTypePercentage && i.DiscountType != DiscountTypeAmount {
+		return &ValidationError{Field: "EDIOrderItem.DiscountType", Message: fmt.Sprintf("discount type must be %s or %s", DiscountTypePercentage, DiscountTypeAmount)}
+	}
+	for j, d := range i.Dates {
+		if !dtmQualifiers[d.Qualifier] {
+			return &ValidationError{Field: fmt.Sprintf("EDIOrderItem.Dates[%d].Qualifier", j), Message: fmt.Sprintf("unknown date/time qualifier %q", d.Qualifier)}
+		}
+		if d.Date.IsZero() {
+			return &ValidationError{Field: fmt.Sprintf("EDIOrderItem.Dates[%d].Date", j), Message: "date is required"}
+		}
+	}
+	if err := validateReferences("EDIOrderItem.References", i.References); err != nil {
+		return err
+	}
+	if err := validateReferences("EDIOrderItem.LineRefs", i.LineRefs); err != nil {
+		return err
+	}
+	if _, err := NormalizeSchedule(i.DeliverySchedule); err != nil {
+		return fmt.Errorf("delivery schedule validation failed: %w", err)
+	}
+	return nil
+}
+
+type EDIOrder struct {
+	InterchangeSenderID     string
+	InterchangeSenderQualifier string
+	InterchangeReceiverID   string
+	InterchangeReceiverQualifier string
+	InterchangeControlRef   string
+	MessageRefNumber        string
+	OrderNumber             string
+	OrderVersion            string
+	OrderRevision           string
 	OrderDate               time.Time
+	ContractNumber          string
+	ScheduleID              string
+	BusinessFunction        string
 	Currency                string
 	CurrencyQualifier       string
 	Buyer                   Address
 	Seller                  Address
 	Delivery                Address
 	Invoice                 Address
+	AdditionalParties       []Party
 	DeliveryDate            time.Time
 	DeliveryDateQualifier   string
 	DeliveryTerms           string
 	DeliveryTermsCode       string
+	DeliveryTermsLocation   string
 	PaymentTerms            string
 	PaymentTermsCode        string
+	PaymentInstalments      []Instalment
+	RequirementConditions   []string
 	TransportMode           string
 	TransportModeCode       string
 	Items                   []EDIOrderItem
@@ -188,12 +1123,363 @@ type EDIOrder struct {
 	TotalLines              int
 	TotalQuantity           float64
 	TestIndicator           int
+	MessageType             string
 	MessageVersion          string
 	MessageRelease          string
 	ResponsibleAgency       string
 	AssociationCode         string
 	SyntaxIdentifier        string
 	SyntaxVersion           string
+	ApplicationReference    string
+	ExtraSegments           map[Anchor][]EDISegment
+	ControlTotals           []ControlTotal
+	SamplingParams          *SamplingParams
+	PaymentInstructions     *PaymentInstructions
+}
+
+type SamplingParams struct {
+	Qualifier string
+	Frequency string
+	Size      string
+}
+
+type PaymentInstructions struct {
+	Conditions     string
+	Guarantee      string
+	MeansOfPayment string
+}
+
+type Instalment struct {
+	Percentage float64
+	DueDate    time.Time
+	Amount     float64
+	TermsCode  string
+}
+
+type ControlTotal struct {
+	Qualifier string
+	Selector  string
+}
+
+func (o EDIOrder) Hash() (string, error) {
+	data, err := json.Marshal(o.inUTC())
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal order for hashing: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (o EDIOrder) inUTC() EDIOrder {
+	o.OrderDate = o.OrderDate.UTC()
+	o.DeliveryDate = o.DeliveryDate.UTC()
+	
+	instalments := make([]Instalment, len(o.PaymentInstalments))
+	for i, inst := range o.PaymentInstalments {
+		inst.DueDate = inst.DueDate.UTC()
+		instalments[i] = inst
+	}
+	o.PaymentInstalments = instalments
+	
+	items := make([]EDIOrderItem, len(o.Items))
+	for i, item := range o.Items {
+		item.DeliveryDate = item.DeliveryDate.UTC()
+		
+		schedule := make([]ScheduleEntry, len(item.DeliverySchedule))
+		for j, entry := range item.DeliverySchedule {
+			entry.From = entry.From.UTC()
+			entry.To = entry.To.UTC()
+			schedule[j] = entry
+		}
+		item.DeliverySchedule = schedule
+		
+		dates := make([]LineDate, len(item.Dates))
+		for j, date := range item.Dates {
+			date.Date = date.Date.UTC()
+			dates[j] = date
+		}
+		item.Dates = dates
+		
+		item.References = referencesInUTC(item.References)
+		item.LineRefs = referencesInUTC(item.LineRefs)
+		items[i] = item
+	}
+	o.Items = items
+	
+	return o
+}
+
+func NormalizeOrder(o EDIOrder) EDIOrder {
+	o = o.inUTC()
+	
+	for _, field := range []*string{
+		&o.InterchangeSenderID, &o.InterchangeSenderQualifier,
+		&o.InterchangeReceiverID, &o.InterchangeReceiverQualifier,
+		&o.InterchangeControlRef, &o.MessageRefNumber,
+		&o.OrderNumber, &o.OrderVersion, &o.OrderRevision,
+		&o.ContractNumber, &o.ScheduleID, &o.BusinessFunction,
+		&o.Currency, &o.CurrencyQualifier,
+		&o.DeliveryDateQualifier, &o.DeliveryTerms, &o.DeliveryTermsCode, &o.DeliveryTermsLocation,
+		&o.PaymentTerms, &o.PaymentTermsCode,
+		&o.TransportMode, &o.TransportModeCode,
+		&o.MessageType, &o.MessageVersion, &o.MessageRelease, &o.ResponsibleAgency, &o.AssociationCode,
+		&o.SyntaxIdentifier, &o.SyntaxVersion, &o.ApplicationReference,
+	} {
+		*field = strings.TrimSpace(*field)
+	}
+	
+	o.Buyer = o.Buyer.normalized()
+	o.Seller = o.Seller.normalized()
+	o.Delivery = o.Delivery.normalized()
+	o.Invoice = o.Invoice.normalized()
+	
+	parties := make([]Party, len(o.AdditionalParties))
+	for i, party := range o.AdditionalParties {
+		parties[i] = Party{
+			Qualifier: strings.ToUpper(strings.TrimSpace(party.Qualifier)),
+			Address:   party.Address.normalized(),
+		}
+	}
+	o.AdditionalParties = parties
+	
+	instalments := make([]Instalment, len(o.PaymentInstalments))
+	for i, inst := range o.PaymentInstalments {
+		inst.TermsCode = strings.TrimSpace(inst.TermsCode)
+		instalments[i] = inst
+	}
+	o.PaymentInstalments = instalments
+	o.RequirementConditions = trimAll(o.RequirementConditions)
+	
+	totals := make([]ControlTotal, len(o.ControlTotals))
+	for i, total := range o.ControlTotals {
+		totals[i] = ControlTotal{Qualifier: strings.TrimSpace(total.Qualifier), Selector: strings.TrimSpace(total.Selector)}
+	}
+	o.ControlTotals = totals
+	
+	if o.SamplingParams != nil {
+		o.SamplingParams = &SamplingParams{
+			Qualifier: strings.TrimSpace(o.SamplingParams.Qualifier),
+			Frequency: strings.TrimSpace(o.SamplingParams.Frequency),
+			Size:      strings.TrimSpace(o.SamplingParams.Size),
+		}
+	}
+	
+	if o.PaymentInstructions != nil {
+		o.PaymentInstructions = &PaymentInstructions{
+			Conditions:     strings.TrimSpace(o.PaymentInstructions.Conditions),
+			Guarantee:      strings.TrimSpace(o.PaymentInstructions.Guarantee),
+			MeansOfPayment: strings.TrimSpace(o.PaymentInstructions.MeansOfPayment),
+		}
+	}
+	
+	for i := range o.Items {
+		o.Items[i] = o.Items[i].normalized()
+	}
+	
+	return o
+}
+
+func (a Address) normalized() Address {
+	for _, field := range []*string{
+		&a.Name, &a.ID, &a.IDType, &a.LocationCode, &a.BICCode,
+		&a.City, &a.Region, &a.PostalCode, &a.CountryCode,
+	} {
+		*field = strings.TrimSpace(*field)
+	}
+	a.Lines = trimAll(a.Lines)
+	a.StreetLines = trimAll(a.StreetLines)
+	
+	windows := make([]DockWindow, len(a.DeliveryWindows))
+	for i, window := range a.DeliveryWindows {
+		windows[i] = DockWindow{
+			DockCode: strings.TrimSpace(window.DockCode),
+			TimeFrom: strings.TrimSpace(window.TimeFrom),
+			TimeTo:   strings.TrimSpace(window.TimeTo),
+		}
+	}
+	a.DeliveryWindows = windows
+	return a
+}
+
+func (i EDIOrderItem) normalized() EDIOrderItem {
+	for _, field := range []*string{
+		&i.BuyerItemCode, &i.SupplierItemCode, &i.EANCode,
+		&i.PriceBasisUOM, &i.UnitOfMeasure, &i.Description,
+		&i.ItemDescriptionCode, &i.ItemDescriptionCodeList, &i.ItemDescriptionAgency, &i.IMDFormatCode,
+		&i.ScheduleRef, &i.DiscountType, &i.LineTransportMode, &i.LineCarrierCode,
+	} {
+		*field = strings.TrimSpace(*field)
+	}
+	
+	descriptions := make([]ItemDescription, len(i.IMDs))
+	for j, desc := range i.IMDs {
+		descriptions[j] = ItemDescription{
+			Characteristic: strings.TrimSpace(desc.Characteristic),
+			Code:           strings.TrimSpace(desc.Code),
+			CodeList:       strings.TrimSpace(desc.CodeList),
+			Agency:         strings.TrimSpace(desc.Agency),
+			Text:           strings.TrimSpace(desc.Text),
+			Language:       strings.TrimSpace(desc.Language),
+		}
+	}
+	i.IMDs = descriptions
+	
+	metered := make([]MeteredQty, len(i.MeteredQuantities))
+	for j, qty := range i.MeteredQuantities {
+		metered[j] = MeteredQty{
+			Qualifier: strings.TrimSpace(qty.Qualifier),
+			Quantity:  strings.TrimSpace(qty.Quantity),
+			UOM:       strings.TrimSpace(qty.UOM),
+		}
+	}
+	i.MeteredQuantities = metered
+	
+	breaks := make([]PriceBreak, len(i.PriceBreaks))
+	for j, pb := range i.PriceBreaks {
+		pb.TradeClass = strings.TrimSpace(pb.TradeClass)
+		breaks[j] = pb
+	}
+	i.PriceBreaks = breaks
+	
+	for j := range i.DeliverySchedule {
+		i.DeliverySchedule[j].Frequency = strings.TrimSpace(i.DeliverySchedule[j].Frequency)
+	}
+	for j := range i.Dates {
+		i.Dates[j].Qualifier = strings.TrimSpace(i.Dates[j].Qualifier)
+	}
+	i.References = trimReferences(i.References)
+	i.LineRefs = trimReferences(i.LineRefs)
+	return i
+}
+
+func trimAll(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.TrimSpace(value)
+	}
+	return trimmed
+}
+
+func trimReferences(refs []Reference) []Reference {
+	for i := range refs {
+		refs[i].Qualifier = strings.TrimSpace(refs[i].Qualifier)
+		refs[i].Number = strings.TrimSpace(refs[i].Number)
+	}
+	return refs
+}
+
+func referencesInUTC(refs []Reference) []Reference {
+	normalized := make([]Reference, len(refs))
+	for i, ref := range refs {
+		ref.Date = ref.Date.UTC()
+		normalized[i] = ref
+	}
+	return normalized
+}
+
+func (o EDIOrder) withComputedAmounts() EDIOrder {
+	items := make([]EDIOrderItem, len(o.Items))
+	copy(items, o.Items)
+	for i := range items {
+		items[i].ComputeAmount()
+	}
+	o.Items = items
+	return o
+}
+
+func (o EDIOrder) withAbsoluteQuantities() EDIOrder {
+	items := make([]EDIOrderItem, len(o.Items))
+	copy(items, o.Items)
+	for i := range items {
+		items[i].Quantity = math.Abs(items[i].Quantity)
+		items[i].ReturnedQuantity = math.Abs(items[i].ReturnedQuantity)
+	}
+	o.Items = items
+	return o
+}
+
+func (o EDIOrder) isSelfAddressed() bool {
+	return o.InterchangeSenderID == o.InterchangeReceiverID && o.InterchangeSenderQualifier == o.InterchangeReceiverQualifier
+}
+
+func (o EDIOrder) computedTotalQuantity() float64 {
+	sum := 0.0
+	for _, item := range o.Items {
+		sum += item.Quantity
+	}
+	return sum
+}
+
+func (o EDIOrder) ReversedEnvelope() EDIOrder {
+	return o.reversedEnvelope(time.Now().UTC())
+}
+
+func (g *EDIFACTOrderGenerator) ReversedEnvelope(order EDIOrder) EDIOrder {
+	return order.reversedEnvelope(g.now().UTC())
+}
+
+func (o EDIOrder) reversedEnvelope(now time.Time) EDIOrder {
+	return EDIOrder{
+		InterchangeSenderID:          o.InterchangeReceiverID,
+		InterchangeSenderQualifier:   o.InterchangeReceiverQualifier,
+		InterchangeReceiverID:        o.InterchangeSenderID,
+		InterchangeReceiverQualifier: o.InterchangeSenderQualifier,
+		InterchangeControlRef:        newControlRef(o.InterchangeControlRef, now),
+		OrderDate:                    now,
+		SyntaxIdentifier:             o.SyntaxIdentifier,
+		SyntaxVersion:                o.SyntaxVersion,
+		TestIndicator:                o.TestIndicator,
+	}
+}
+
+func newControlRef(previous string, now time.Time) string {
+	ref := now.UnixNano() % 1e14
+	if strconv.FormatInt(ref, 10) == previous {
+		ref = (ref + 1) % 1e14
+	}
+	return strconv.FormatInt(ref, 10)
+}
+
+func MinimalOrder(sender, receiver, ref string) EDIOrder {
+	return minimalOrder(sender, receiver, ref, time.Now().UTC())
+}
+
+func (g *EDIFACTOrderGenerator) MinimalOrder(sender, receiver, ref string) EDIOrder {
+	return minimalOrder(sender, receiver, ref, g.now().UTC())
+}
+
+func minimalOrder(sender, receiver, ref string, now time.Time) EDIOrder {
+	return EDIOrder{
+		InterchangeSenderID:   sender,
+		InterchangeReceiverID: receiver,
+		InterchangeControlRef: ref,
+		MessageRefNumber:      ref,
+		OrderNumber:           ref,
+		OrderDate:             now,
+		Buyer: Address{
+			Name:  sender,
+			Lines: []string{sender},
+		},
+		Seller: Address{
+			Name:  receiver,
+			Lines: []string{receiver},
+		},
+		Items: []EDIOrderItem{
+			{
+				LineNumber:    1,
+				BuyerItemCode: "HEARTBEAT",
+				Quantity:      1,
+				UnitOfMeasure: "PCE",
+				Description:   "Connectivity check",
+			},
+		},
+		TotalLines:    1,
+		TotalQuantity: 1,
+		TestIndicator: IndicatorTest,
+	}
 }
 
 func (o EDIOrder) Validate() error {
@@ -209,6 +1495,15 @@ func (o EDIOrder) Validate() error {
 	if len(o.InterchangeReceiverID) > 35 {
 		return &ValidationError{Field: "EDIOrder.InterchangeReceiverID", Message: "interchange receiver ID exceeds 35 characters"}
 	}
+	if o.InterchangeSenderQualifier == InterchangeQualifierGLN && !isValidGLN(o.InterchangeSenderID) {
+		return &ValidationError{Field: "EDIOrder.InterchangeSenderID", Message: "interchange sender ID is not a valid 13-digit GLN"}
+	}
+	if o.InterchangeReceiverQualifier == InterchangeQualifierGLN && !isValidGLN(o.InterchangeReceiverID) {
+		return &ValidationError{Field: "EDIOrder.InterchangeReceiverID", Message: "interchange receiver ID is not a valid 13-digit GLN"}
+	}
+	if o.TestIndicator != IndicatorProduction && o.TestIndicator != IndicatorTest {
+		return &ValidationError{Field: "EDIOrder.TestIndicator", Message: fmt.Sprintf("test indicator must be %d or %d, got %d", IndicatorProduction, IndicatorTest, o.TestIndicator)}
+	}
 	if o.InterchangeControlRef == "" {
 		return &ValidationError{Field: "EDIOrder.InterchangeControlRef", Message: "interchange control reference is required"}
 	}
@@ -224,6 +1519,44 @@ func (o EDIOrder) Validate() error {
 	if o.OrderDate.IsZero() {
 		return &ValidationError{Field: "EDIOrder.OrderDate", Message: "order date is required"}
 	}
+	if len(o.ContractNumber) > 35 {
+		return &ValidationError{Field: "EDIOrder.ContractNumber", Message: "contract number exceeds 35 characters"}
+	}
+	if len(o.ScheduleID) > 35 {
+		return &ValidationError{Field: "EDIOrder.ScheduleID", Message: "schedule ID exceeds 35 characters"}
+	}
+	if len(o.PaymentInstalments) > 0 {
+		total := 0.0
+		for i, inst := range o.PaymentInstalments {
+			if inst.Percentage <= 0 {
+				return &ValidationError{Field: fmt.Sprintf("EDIOrder.PaymentInstalments[%d].Percentage", i), Message: "instalment percentage must be positive"}
+			}
+			if inst.Amount < 0 {
+				return &ValidationError{Field: fmt.Sprintf("EDIOrder.PaymentInstalments[%d].Amount", i), Message: "instalment amount cannot be negative"}
+			}
+			total += inst.Percentage
+		}
+		if diff := total - 100; diff > 0.001 || diff < -0.001 {
+			return &ValidationError{Field: "EDIOrder.PaymentInstalments", Message: fmt.Sprintf("instalment percentages sum to %s, expected 100", strconv.FormatFloat(total, 'f', -1, 64))}
+		}
+	}
+	for i, code := range o.RequirementConditions {
+		if !requirementSectorCodes[code] {
+			return &ValidationError{Field: fmt.Sprintf("EDIOrder.RequirementConditions[%d]", i), Message: fmt.Sprintf("requirement code %q is not in the supported 7293 code list", code)}
+		}
+	}
+	if len(o.OrderVersion) > 9 {
+		return &ValidationError{Field: "EDIOrder.OrderVersion", Message: "order version exceeds 9 characters"}
+	}
+	if len(o.OrderRevision) > 6 {
+		return &ValidationError{Field: "EDIOrder.OrderRevision", Message: "order revision exceeds 6 characters"}
+	}
+	if len(o.BusinessFunction) > 3 {
+		return &ValidationError{Field: "EDIOrder.BusinessFunction", Message: "business function code exceeds 3 characters"}
+	}
+	if len(o.ApplicationReference) > 14 || !isPrintableASCII(o.ApplicationReference) {
+		return &ValidationError{Field: "EDIOrder.ApplicationReference", Message: "application reference must be printable ASCII of at most 14 characters"}
+	}
 	if err := o.Buyer.Validate(); err != nil {
 		return fmt.Errorf("buyer validation failed: %w", err)
 	}
@@ -235,6 +1568,12 @@ func (o EDIOrder) Validate() error {
 			return fmt.Errorf("delivery validation failed: %w", err)
 		}
 	}
+	if incoterms2020[o.DeliveryTermsCode] && o.DeliveryTermsLocation == "" {
+		return &ValidationError{Field: "EDIOrder.DeliveryTermsLocation", Message: fmt.Sprintf("delivery terms %s require a named location", o.DeliveryTermsCode)}
+	}
+	if len(o.DeliveryTermsLocation) > 35 {
+		return &ValidationError{Field: "EDIOrder.DeliveryTermsLocation", Message: "delivery terms location exceeds 35 characters"}
+	}
 	if len(o.Items) == 0 {
 		return &ValidationError{Field: "EDIOrder.Items", Message: "at least one item is required"}
 	}
@@ -249,66 +1588,648 @@ func (o EDIOrder) Validate() error {
 	if o.TotalLines != len(o.Items) {
 		return &ValidationError{Field: "EDIOrder.TotalLines", Message: "total lines does not match number of items"}
 	}
+	for _, party := range o.parties() {
+		if party.qualifier != PartyDelivery && len(party.address.DeliveryWindows) > 0 {
+			return &ValidationError{Field: "EDIOrder." + party.field + ".DeliveryWindows", Message: "delivery windows are only allowed on the delivery party"}
+		}
+	}
+	for i, party := range o.AdditionalParties {
+		if party.Qualifier == "" || len(party.Qualifier) > 3 {
+			return &ValidationError{Field: fmt.Sprintf("EDIOrder.AdditionalParties[%d].Qualifier", i), Message: "party qualifier must be 1 to 3 characters"}
+		}
+		if err := party.Address.Validate(); err != nil {
+			return fmt.Errorf("additional party at index %d validation failed: %w", i, err)
+		}
+	}
+	controlQualifiers := make(map[string]bool, len(o.ControlTotals))
+	for i, total := range o.ControlTotals {
+		field := fmt.Sprintf("EDIOrder.ControlTotals[%d]", i)
+		if !controlTotalQualifiers[total.Qualifier] {
+			return &ValidationError{Field: field + ".Qualifier", Message: fmt.Sprintf("unknown control total qualifier %q", total.Qualifier)}
+		}
+		if controlQualifiers[total.Qualifier] {
+			return &ValidationError{Field: field + ".Qualifier", Message: fmt.Sprintf("control total qualifier %s appears more than once", total.Qualifier)}
+		}
+		controlQualifiers[total.Qualifier] = true
+		if !controlTotalSelectors[total.Selector] {
+			return &ValidationError{Field: field + ".Selector", Message: fmt.Sprintf("unknown control total selector %q", total.Selector)}
+		}
+	}
+	if p := o.SamplingParams; p != nil {
+		if p.Qualifier == "" || len(p.Qualifier) > 3 {
+			return &ValidationError{Field: "EDIOrder.SamplingParams.Qualifier", Message: "sampling qualifier is required and must not exceed 3 characters"}
+		}
+		if p.Frequency != "" && (!isDigits(p.Frequency) || len(p.Frequency) > 9) {
+			return &ValidationError{Field: "EDIOrder.SamplingParams.Frequency", Message: "sampling frequency must be numeric and not exceed 9 digits"}
+		}
+		if p.Size != "" && (!isDigits(p.Size) || len(p.Size) > 9) {
+			return &ValidationError{Field: "EDIOrder.SamplingParams.Size", Message: "sample size must be numeric and not exceed 9 digits"}
+		}
+	}
+	if p := o.PaymentInstructions; p != nil {
+		if len(p.Conditions) > 3 {
+			return &ValidationError{Field: "EDIOrder.PaymentInstructions.Conditions", Message: "payment conditions code exceeds 3 characters"}
+		}
+		if len(p.Guarantee) > 3 {
+			return &ValidationError{Field: "EDIOrder.PaymentInstructions.Guarantee", Message: "payment guarantee code exceeds 3 characters"}
+		}
+		if !paymentMeansCodes[p.MeansOfPayment] {
+			return &ValidationError{Field: "EDIOrder.PaymentInstructions.MeansOfPayment", Message: fmt.Sprintf("unknown means of payment code %q", p.MeansOfPayment)}
+		}
+	}
+	for anchor, segments := range o.ExtraSegments {
+		if anchor < AnchorAfterBGM || anchor > AnchorInSummary {
+			return &ValidationError{Field: "EDIOrder.ExtraSegments", Message: fmt.Sprintf("unknown anchor %s", anchor)}
+		}
+		for i, segment := range segments {
+			if !isValidExtraSegmentTag(segment.Tag) {
+				return &ValidationError{
+					Field:   fmt.Sprintf("EDIOrder.ExtraSegments[%s][%d].Tag", anchor, i),
+					Message: fmt.Sprintf("segment tag %q must be 3 uppercase letters and not a service segment", segment.Tag),
+				}
+			}
+		}
+	}
 	return nil
 }
 
-type SegmentBuilder interface {
-	BuildUNB(ctx context.Context, order EDIOrder) (EDISegment, error)
-	BuildUNH(ctx context.Context, order EDIOrder) (EDISegment, error)
-	BuildBGM(ctx context.Context, order EDIOrder) (EDISegment, error)
-	BuildDTM(ctx context.Context, date time.Time, qualifier string) (EDISegment, error)
-	BuildCUX(ctx context.Context, order EDIOrder) (EDISegment, error)
-	BuildNAD(ctx context.Context, partyQualifier string, address Address) (EDISegment, error)
-	BuildTOD(ctx context.Context, order EDIOrder) (EDISegment, error)
-	BuildPAT(ctx context.Context, order EDIOrder) (EDISegment, error)
-	BuildTDT(ctx context.Context, order EDIOrder) (EDISegment, error)
-	BuildLIN(ctx context.Context, item EDIOrderItem) (EDISegment, error)
-	BuildIMD(ctx context.Context, item EDIOrderItem) (EDISegment, error)
-	BuildQTY(ctx context.Context, item EDIOrderItem) (EDISegment, error)
-	BuildPRI(ctx context.Context, item EDIOrderItem) (EDISegment, error)
-	BuildMOA(ctx context.Context, item EDIOrderItem) (EDISegment, error)
-	BuildCNT(ctx context.Context, order EDIOrder) (EDISegment, error)
-	BuildMOATotal(ctx context.Context, order EDIOrder) (EDISegment, error)
-	BuildUNT(ctx context.Context, order EDIOrder, segmentCount int) (EDISegment, error)
-	BuildUNZ(ctx context.Context, order EDIOrder, messageCount int) (EDISegment, error)
+func hasValidCheckDigit(code string) bool {
+	if len(code) < 2 {
+		return false
+	}
+	
+	sum := 0
+	for i := len(code) - 1; i >= 0; i-- {
+		c := code[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		digit := int(c - '0')
+		if i == len(code)-1 {
+			continue
+		}
+		if (len(code)-1-i)%2 == 1 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	
+	check := (10 - sum%10) % 10
+	return check == int(code[len(code)-1]-'0')
 }
 
-type EDIFACTOrderGenerator struct {
-	segmentTerminator  string
-	elementSeparator   string
-	componentSeparator string
-	decimalMark        string
-	releaseCharacter   string
-	segmentBuilder     SegmentBuilder
-	pool               sync.Pool
+func isValidGTIN(code string) bool {
+	switch len(code) {
+	case 8, 12, 13, 14:
+		return hasValidCheckDigit(code)
+	default:
+		return false
+	}
 }
 
-type DefaultSegmentBuilder struct {
-	generator *EDIFACTOrderGenerator
+func isValidAssociationCode(code string) bool {
+	return len(code) == 6 && strings.HasPrefix(code, "EAN") && isDigits(code[3:])
 }
 
-func NewEDIFACTOrderGenerator() (*EDIFACTOrderGenerator, error) {
-	g := &EDIFACTOrderGenerator{
-		segmentTerminator:  "'",
-		elementSeparator:   "+",
-		componentSeparator: ":",
-		decimalMark:        ".",
-		releaseCharacter:   "?",
-		pool: sync.Pool{
-			New: func() interface{} {
-				return &strings.Builder{}
-			},
-		},
+func checkNumericLength(field, value string, maxDigits int) error {
+	digits := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] >= '0' && value[i] <= '9' {
+			digits++
+		}
 	}
-	
-	if err := g.validateSeparators(); err != nil {
-		return nil, err
+	if digits > maxDigits {
+		return &ValidationError{Field: field, Message: fmt.Sprintf("formatted value %s has %d digits, exceeding the %d digit limit", value, digits, maxDigits)}
 	}
-	
-	g.segmentBuilder = &DefaultSegmentBuilder{generator: g}
+	return nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func isValidBIC(code string) bool {
+	if len(code) != 8 && len(code) != 11 {
+		return false
+	}
+	return isUpperAlphanumeric(code)
+}
+
+func isUpperAlphanumeric(code string) bool {
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isValidGLN(code string) bool {
+	return len(code) == 13 && hasValidCheckDigit(code)
+}
+
+var envelopeSegmentTags = map[string]bool{
+	SegmentTagUNA: true,
+	SegmentTagUNB: true,
+	"UNG":         true,
+	SegmentTagUNH: true,
+	SegmentTagUNT: true,
+	"UNE":         true,
+	SegmentTagUNZ: true,
+}
+
+func isValidExtraSegmentTag(tag string) bool {
+	if len(tag) != 3 || envelopeSegmentTags[tag] {
+		return false
+	}
+	for i := 0; i < len(tag); i++ {
+		if tag[i] < 'A' || tag[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func (o EDIOrder) parties() []orderParty {
+	var parties []orderParty
+	if o.Buyer.Name != "" {
+		parties = append(parties, orderParty{qualifier: PartyBuyer, field: "Buyer", address: o.Buyer})
+	}
+	if o.Seller.Name != "" {
+		parties = append(parties, orderParty{qualifier: PartySeller, field: "Seller", address: o.Seller})
+	}
+	if o.Delivery.Name != "" {
+		parties = append(parties, orderParty{qualifier: PartyDelivery, field: "Delivery", address: o.Delivery})
+	}
+	if o.Invoice.Name != "" {
+		parties = append(parties, orderParty{qualifier: PartyInvoice, field: "Invoice", address: o.Invoice})
+	}
+	for i, party := range o.AdditionalParties {
+		parties = append(parties, orderParty{
+			qualifier: party.Qualifier,
+			field:     fmt.Sprintf("AdditionalParties[%d]", i),
+			address:   party.Address,
+		})
+	}
+	return parties
+}
+
+func (o EDIOrder) deliveryDateIssues() []*ValidationError {
+	var issues []*ValidationError
+	orderDay := o.OrderDate.Format(DateFormatCCYYMMDD)
+	
+	if !o.DeliveryDate.IsZero() && o.DeliveryDate.Format(DateFormatCCYYMMDD) < orderDay {
+		issues = append(issues, &ValidationError{Field: "EDIOrder.DeliveryDate", Message: "delivery date is before order date"})
+	}
+	for i, item := range o.Items {
+		if !item.DeliveryDate.IsZero() && item.DeliveryDate.Format(DateFormatCCYYMMDD) < orderDay {
+			issues = append(issues, &ValidationError{
+				Field:   fmt.Sprintf("EDIOrder.Items[%d].DeliveryDate", i),
+				Message: "line delivery date is before order date",
+			})
+		}
+	}
+	
+	return issues
+}
+
+type SegmentBuilder interface {
+	BuildUNB(ctx context.Context, order EDIOrder) (EDISegment, error)
+	BuildUNH(ctx context.Context, order EDIOrder) (EDISegment, error)
+	BuildBGM(ctx context.Context, order EDIOrder) (EDISegment, error)
+	BuildDTM(ctx context.Context, date time.Time, qualifier string) (EDISegment, error)
+	BuildCUX(ctx context.Context, order EDIOrder) (EDISegment, error)
+	BuildNAD(ctx context.Context, partyQualifier string, address Address) (EDISegment, error)
+	BuildTOD(ctx context.Context, order EDIOrder) (EDISegment, error)
+	BuildPAT(ctx context.Context, order EDIOrder) (EDISegment, error)
+	BuildTDT(ctx context.Context, order EDIOrder) (EDISegment, error)
+	BuildLIN(ctx context.Context, item EDIOrderItem) (EDISegment, error)
+	BuildIMD(ctx context.Context, item EDIOrderItem) (EDISegment, error)
+	BuildQTY(ctx context.Context, item EDIOrderItem) (EDISegment, error)
+	BuildPRI(ctx context.Context, item EDIOrderItem) (EDISegment, error)
+	BuildMOA(ctx context.Context, item EDIOrderItem) (EDISegment, error)
+	BuildCNT(ctx context.Context, order EDIOrder) (EDISegment, error)
+	BuildMOATotal(ctx context.Context, order EDIOrder) (EDISegment, error)
+	BuildUNT(ctx context.Context, order EDIOrder, segmentCount int) (EDISegment, error)
+	BuildUNZ(ctx context.Context, order EDIOrder, messageCount int) (EDISegment, error)
+}
+
+type NADLocationBuilder interface {
+	BuildNADLocation(ctx context.Context, partyQualifier, locode string) (EDISegment, error)
+}
+
+type DockWindowBuilder interface {
+	BuildLOC(ctx context.Context, location string) (EDISegment, error)
+	BuildDockWindowDTM(ctx context.Context, window DockWindow) (EDISegment, error)
+}
+
+type SCCBuilder interface {
+	BuildSCC(ctx context.Context, entry ScheduleEntry) (EDISegment, error)
+}
+
+type MTQBuilder interface {
+	BuildMTQ(ctx context.Context, mtq MeteredQty) (EDISegment, error)
+}
+
+type RFFBuilder interface {
+	BuildRFF(ctx context.Context, qualifier, reference string) (EDISegment, error)
+}
+
+type PriceBreakBuilder interface {
+	BuildAPR(ctx context.Context, pb PriceBreak) (EDISegment, error)
+	BuildRNG(ctx context.Context, pb PriceBreak, uom string) (EDISegment, error)
+}
+
+type ControlTotalBuilder interface {
+	BuildControlTotal(ctx context.Context, order EDIOrder, total ControlTotal) (EDISegment, error)
+}
+
+type ALCBuilder interface {
+	BuildALC(ctx context.Context, item EDIOrderItem) (EDISegment, error)
+}
+
+type BUSBuilder interface {
+	BuildBUS(ctx context.Context, order EDIOrder) (EDISegment, error)
+}
+
+type InstalmentPATBuilder interface {
+	BuildInstalmentPAT(ctx context.Context, inst Instalment) (EDISegment, error)
+}
+
+type PCDBuilder interface {
+	BuildPCD(ctx context.Context, qualifier string, percentage float64) (EDISegment, error)
+}
+
+type MOAAmountBuilder interface {
+	BuildMOAAmount(ctx context.Context, qualifier string, amount float64) (EDISegment, error)
+}
+
+type ItemDescriptionBuilder interface {
+	BuildItemDescription(ctx context.Context, desc ItemDescription) (EDISegment, error)
+}
+
+type LineTDTBuilder interface {
+	BuildLineTDT(ctx context.Context, item EDIOrderItem) (EDISegment, error)
+}
+
+type RCSBuilder interface {
+	BuildRCS(ctx context.Context, code string) (EDISegment, error)
+}
+
+type AcknowledgementBuilder interface {
+	BuildAcknowledgementUNH(ctx context.Context, ack Acknowledgement) (EDISegment, error)
+	BuildUCI(ctx context.Context, ack Acknowledgement) (EDISegment, error)
+	BuildUCM(ctx context.Context, msg MessageAcknowledgement) (EDISegment, error)
+}
+
+type SPSBuilder interface {
+	BuildSPS(ctx context.Context, p SamplingParams) (EDISegment, error)
+}
+
+type HMCBuilder interface {
+	BuildProprietaryHMC(ctx context.Context, order EDIOrder, mac []byte) (EDISegment, error)
+}
+
+type ReturnedQTYBuilder interface {
+	BuildReturnedQTY(ctx context.Context, item EDIOrderItem) (EDISegment, error)
+}
+
+type PAIBuilder interface {
+	BuildPAI(ctx context.Context, p PaymentInstructions) (EDISegment, error)
+}
+
+func buildOptional[T any](ctx context.Context, g *EDIFACTOrderGenerator, tag string, build func(context.Context, T) (EDISegment, error)) (EDISegment, error) {
+	if b, ok := g.segmentBuilder.(T); ok {
+		return g.runBuild(ctx, tag, func(ctx context.Context) (EDISegment, error) {
+			return build(ctx, b)
+		})
+	}
+	return build(ctx, any(&DefaultSegmentBuilder{generator: g}).(T))
+}
+
+type timeoutSegmentBuilder struct {
+	next      SegmentBuilder
+	generator *EDIFACTOrderGenerator
+}
+
+func (b timeoutSegmentBuilder) run(ctx context.Context, tag string, build func(context.Context) (EDISegment, error)) (EDISegment, error) {
+	return b.generator.runBuild(ctx, tag, build)
+}
+
+func (g *EDIFACTOrderGenerator) runBuild(ctx context.Context, tag string, build func(context.Context) (EDISegment, error)) (EDISegment, error) {
+	if g.segmentBuildTimeout <= 0 {
+		return build(ctx)
+	}
+	if n := g.abandonedBuilds.Load(); n >= MaxAbandonedSegmentBuilds {
+		return EDISegment{}, fmt.Errorf("%w: %s not started while %d timed-out builds are still running", ErrSegmentBuildTimeout, tag, n)
+	}
+	
+	buildCtx, cancel := context.WithTimeout(ctx, g.segmentBuildTimeout)
+	defer cancel()
+	
+	type result struct {
+		segment EDISegment
+		err     error
+	}
+	done := make(chan result, 1)
+	var settled atomic.Bool
+	go func() {
+		segment, err := build(buildCtx)
+		if !settled.CompareAndSwap(false, true) {
+			g.abandonedBuilds.Add(-1)
+			return
+		}
+		done <- result{segment: segment, err: err}
+	}()
+	
+	select {
+	case r := <-done:
+		return r.segment, r.err
+	case <-buildCtx.Done():
+	}
+	
+	g.abandonedBuilds.Add(1)
+	if !settled.CompareAndSwap(false, true) {
+		g.abandonedBuilds.Add(-1)
+		r := <-done
+		return r.segment, r.err
+	}
+	if ctx.Err() != nil {
+		return EDISegment{}, ErrContextCancelled
+	}
+	return EDISegment{}, fmt.Errorf("%w: %s after %s", ErrSegmentBuildTimeout, tag, g.segmentBuildTimeout)
+}
+
+func (b timeoutSegmentBuilder) BuildUNB(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	return b.run(ctx, "UNB", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildUNB(ctx, order)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildUNH(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	return b.run(ctx, "UNH", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildUNH(ctx, order)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildBGM(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	return b.run(ctx, "BGM", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildBGM(ctx, order)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildDTM(ctx context.Context, date time.Time, qualifier string) (EDISegment, error) {
+	return b.run(ctx, "DTM", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildDTM(ctx, date, qualifier)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildCUX(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	return b.run(ctx, "CUX", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildCUX(ctx, order)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildNAD(ctx context.Context, partyQualifier string, address Address) (EDISegment, error) {
+	return b.run(ctx, "NAD", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildNAD(ctx, partyQualifier, address)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildTOD(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	return b.run(ctx, "TOD", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildTOD(ctx, order)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildPAT(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	return b.run(ctx, "PAT", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildPAT(ctx, order)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildTDT(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	return b.run(ctx, "TDT", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildTDT(ctx, order)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildLIN(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	return b.run(ctx, "LIN", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildLIN(ctx, item)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildIMD(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	return b.run(ctx, "IMD", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildIMD(ctx, item)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildQTY(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	return b.run(ctx, "QTY", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildQTY(ctx, item)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildPRI(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	return b.run(ctx, "PRI", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildPRI(ctx, item)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildMOA(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	return b.run(ctx, "MOA", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildMOA(ctx, item)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildCNT(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	return b.run(ctx, "CNT", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildCNT(ctx, order)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildMOATotal(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	return b.run(ctx, "MOATotal", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildMOATotal(ctx, order)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildUNT(ctx context.Context, order EDIOrder, segmentCount int) (EDISegment, error) {
+	return b.run(ctx, "UNT", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildUNT(ctx, order, segmentCount)
+	})
+}
+
+func (b timeoutSegmentBuilder) BuildUNZ(ctx context.Context, order EDIOrder, messageCount int) (EDISegment, error) {
+	return b.run(ctx, "UNZ", func(ctx context.Context) (EDISegment, error) {
+		return b.next.BuildUNZ(ctx, order, messageCount)
+	})
+}
+
+type correlationIDKey struct{}
+
+func ContextWithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+func CorrelationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+type SegmentEvent struct {
+	CorrelationID string
+	Tag           string
+	Index         int
+}
+
+type SegmentObserver func(event SegmentEvent)
+
+type GenStats struct {
+	CorrelationID string
+	Segments      int
+	Duration      time.Duration
+}
+
+type EDIFACTOrderGenerator struct {
+	segmentTerminator  string
+	elementSeparator   string
+	componentSeparator string
+	decimalMark        string
+	releaseCharacter   string
+	repetitionSeparator string
+	encoding           OutputEncoding
+	permissiveIDTypes  bool
+	permissiveMessageIdentifiers bool
+	quantityPrecision  int
+	uomPrecision       map[string]int
+	repeatableParties  map[string]bool
+	accumulateSegmentErrors bool
+	lenientDeliveryDates bool
+	clock              func() time.Time
+	legacyUNTCount     bool
+	quantityControlTotal bool
+	zeroPriceMode      ZeroPriceMode
+	signStyle          SignStyle
+	negativeQuantities bool
+	syntaxVersion4     bool
+	rejectSelfAddressed bool
+	autoComputeAmounts bool
+	observer           SegmentObserver
+	validationCache    *ValidationCache
+	truncateLongSegments bool
+	hmacKey            []byte
+	applicationRouting bool
+	treatWarningsAsErrors bool
+	enforcePartyOrder  bool
+	allowEmptyInterchange bool
+	validators         []Validator
+	validationErrorFormat *template.Template
+	lineSegmentOrder   []string
+	messageTypes       MessageTypeRegistry
+	strictMessageTypes bool
+	segmentBuilder     SegmentBuilder
+	segmentBuildTimeout time.Duration
+	abandonedBuilds    *atomic.Int32
+	pool               *sync.Pool
+}
+
+type DefaultSegmentBuilder struct {
+	generator *EDIFACTOrderGenerator
+}
+
+func NewEDIFACTOrderGenerator() (*EDIFACTOrderGenerator, error) {
+	g := &EDIFACTOrderGenerator{
+		segmentTerminator:  "'",
+		elementSeparator:   "+",
+		componentSeparator: ":",
+		decimalMark:        ".",
+		releaseCharacter:   "?",
+		repetitionSeparator: DefaultRepetitionSeparator,
+		messageTypes:       NewMessageTypeRegistry(),
+		quantityPrecision:  DefaultQuantityPrecision,
+		encoding:           EncodingUTF8,
+		clock:              time.Now,
+		applicationRouting: true,
+		abandonedBuilds:    &atomic.Int32{},
+		pool:               newBuilderPool(),
+	}
+	
+	if err := g.validateSeparators(); err != nil {
+		return nil, err
+	}
+	
+	g.segmentBuilder = &DefaultSegmentBuilder{generator: g}
 	return g, nil
 }
 
+func newBuilderPool() *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return &strings.Builder{}
+		},
+	}
+}
+
+func (g *EDIFACTOrderGenerator) Reset() {}
+
+func (g *EDIFACTOrderGenerator) Clone() *EDIFACTOrderGenerator {
+	clone := *g
+	clone.pool = newBuilderPool()
+	clone.abandonedBuilds = &atomic.Int32{}
+	clone.hmacKey = append([]byte(nil), g.hmacKey...)
+	clone.validators = append([]Validator(nil), g.validators...)
+	clone.lineSegmentOrder = append([]string(nil), g.lineSegmentOrder...)
+	if g.validationCache != nil {
+		clone.validationCache = NewValidationCache(g.validationCache.maxSize)
+	}
+	
+	if g.uomPrecision != nil {
+		clone.uomPrecision = make(map[string]int, len(g.uomPrecision))
+		for uom, decimals := range g.uomPrecision {
+			clone.uomPrecision[uom] = decimals
+		}
+	}
+	if g.repeatableParties != nil {
+		clone.repeatableParties = make(map[string]bool, len(g.repeatableParties))
+		for qualifier, repeatable := range g.repeatableParties {
+			clone.repeatableParties[qualifier] = repeatable
+		}
+	}
+	if g.messageTypes != nil {
+		clone.messageTypes = make(MessageTypeRegistry, len(g.messageTypes))
+		for key, known := range g.messageTypes {
+			clone.messageTypes[key] = known
+		}
+	}
+	
+	if builder, ok := g.segmentBuilder.(*DefaultSegmentBuilder); ok && builder.generator == g {
+		clone.segmentBuilder = &DefaultSegmentBuilder{generator: &clone}
+	}
+	
+	return &clone
+}
+
 func (g *EDIFACTOrderGenerator) validateSeparators() error {
 	chars := map[rune]bool{
 		rune(g.segmentTerminator[0]): true,
@@ -316,796 +2237,4947 @@ func (g *EDIFACTOrderGenerator) validateSeparators() error {
 		rune(g.componentSeparator[0]): true,
 		rune(g.releaseCharacter[0]): true,
 	}
+	expected := 4
+	
+	if g.syntaxVersion4 {
+		if len(g.repetitionSeparator) != 1 {
+			return ErrInvalidSeparator
+		}
+		chars[rune(g.repetitionSeparator[0])] = true
+		expected++
+	}
+	
+	if len(chars) != expected {
+		return ErrInvalidSeparator
+	}
+	
+	return nil
+}
+
+func (g *EDIFACTOrderGenerator) WithCustomSeparators(terminator, element, component, decimal, release string) (*EDIFACTOrderGenerator, error) {
+	g.segmentTerminator = terminator
+	g.elementSeparator = element
+	g.componentSeparator = component
+	g.decimalMark = decimal
+	g.releaseCharacter = release
+	
+	if err := g.validateSeparators(); err != nil {
+		return nil, err
+	}
+	
+	return g, nil
+}
+
+func (g *EDIFACTOrderGenerator) WithSegmentBuilder(builder SegmentBuilder) *EDIFACTOrderGenerator {
+	g.segmentBuilder = builder
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithSegmentBuildTimeout(timeout time.Duration) (*EDIFACTOrderGenerator, error) {
+	if timeout < 0 {
+		return nil, fmt.Errorf("segment build timeout cannot be negative: %s", timeout)
+	}
+	g.segmentBuildTimeout = timeout
+	return g, nil
+}
+
+func (g *EDIFACTOrderGenerator) builder() SegmentBuilder {
+	if g.segmentBuildTimeout <= 0 {
+		return g.segmentBuilder
+	}
+	return timeoutSegmentBuilder{next: g.segmentBuilder, generator: g}
+}
+
+func (g *EDIFACTOrderGenerator) WithCharacterEncoding(enc Encoding) *EDIFACTOrderGenerator {
+	g.encoding = enc
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithOutputEncoding(enc OutputEncoding) *EDIFACTOrderGenerator {
+	g.encoding = enc
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithQuantityPrecision(decimals int) *EDIFACTOrderGenerator {
+	g.quantityPrecision = decimals
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithUOMPrecision(decimals map[string]int) *EDIFACTOrderGenerator {
+	g.uomPrecision = make(map[string]int, len(decimals))
+	for uom, n := range decimals {
+		g.uomPrecision[uom] = n
+	}
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) quantityPrecisionFor(uom string) int {
+	if n, ok := g.uomPrecision[uom]; ok {
+		return n
+	}
+	return g.quantityPrecision
+}
+
+func (g *EDIFACTOrderGenerator) WithAccumulateSegmentErrors(enabled bool) *EDIFACTOrderGenerator {
+	g.accumulateSegmentErrors = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithLegacyUNTCount(enabled bool) *EDIFACTOrderGenerator {
+	g.legacyUNTCount = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithQuantityControlTotal(enabled bool) *EDIFACTOrderGenerator {
+	g.quantityControlTotal = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithSignStyle(style SignStyle) *EDIFACTOrderGenerator {
+	g.signStyle = style
+	g.negativeQuantities = true
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) formatSigned(value float64, decimals int) string {
+	formatted := strconv.FormatFloat(math.Abs(value), 'f', decimals, 64)
+	if value >= 0 {
+		return formatted
+	}
+	
+	switch g.signStyle {
+	case SignTrailing:
+		return formatted + "-"
+	case SignParenthesized:
+		return "(" + formatted + ")"
+	default:
+		return "-" + formatted
+	}
+}
+
+func (g *EDIFACTOrderGenerator) WithZeroPriceMode(mode ZeroPriceMode) *EDIFACTOrderGenerator {
+	g.zeroPriceMode = mode
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithSyntaxVersion4(enabled bool) *EDIFACTOrderGenerator {
+	g.syntaxVersion4 = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithRepetitionSeparator(separator string) (*EDIFACTOrderGenerator, error) {
+	if len(separator) != 1 {
+		return nil, ErrInvalidSeparator
+	}
+	g.repetitionSeparator = separator
+	
+	if err := g.validateSeparators(); err != nil {
+		return nil, err
+	}
+	
+	return g, nil
+}
+
+func (g *EDIFACTOrderGenerator) WithMessageTypeRegistry(registry MessageTypeRegistry) *EDIFACTOrderGenerator {
+	g.messageTypes = registry
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithStrictMessageTypes(enabled bool) *EDIFACTOrderGenerator {
+	g.strictMessageTypes = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithRejectSelfAddressed(enabled bool) *EDIFACTOrderGenerator {
+	g.rejectSelfAddressed = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithAutoComputeAmounts(enabled bool) *EDIFACTOrderGenerator {
+	g.autoComputeAmounts = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithValidators(validators ...Validator) *EDIFACTOrderGenerator {
+	g.validators = append(g.validators, validators...)
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithValidationErrorFormat(tmpl string) (*EDIFACTOrderGenerator, error) {
+	parsed, err := template.New("validation-error").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid validation error template: %w", err)
+	}
+	
+	var probe strings.Builder
+	if err := parsed.Execute(&probe, validationErrorFields{Field: "EDIOrder.OrderNumber", Message: "is required"}); err != nil {
+		return nil, fmt.Errorf("invalid validation error template: %w", err)
+	}
+	
+	g.validationErrorFormat = parsed
+	return g, nil
+}
+
+func (g *EDIFACTOrderGenerator) WithLineSegmentOrder(tags []string) (*EDIFACTOrderGenerator, error) {
+	seen := make(map[string]bool, len(defaultLineSegmentOrder))
+	order := make([]string, 0, len(defaultLineSegmentOrder))
+	for _, tag := range tags {
+		tag = strings.ToUpper(strings.TrimSpace(tag))
+		if !slices.Contains(defaultLineSegmentOrder, tag) {
+			return nil, fmt.Errorf("line segment %q cannot be reordered", tag)
+		}
+		if seen[tag] {
+			return nil, fmt.Errorf("line segment %s listed more than once", tag)
+		}
+		seen[tag] = true
+		order = append(order, tag)
+	}
+	for _, tag := range defaultLineSegmentOrder {
+		if !seen[tag] {
+			order = append(order, tag)
+		}
+	}
+	
+	g.lineSegmentOrder = order
+	return g, nil
+}
+
+func (g *EDIFACTOrderGenerator) WithEnforcePartyOrder(enabled bool) *EDIFACTOrderGenerator {
+	g.enforcePartyOrder = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithAllowEmptyInterchange(enabled bool) *EDIFACTOrderGenerator {
+	g.allowEmptyInterchange = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithTreatWarningsAsErrors(enabled bool) *EDIFACTOrderGenerator {
+	g.treatWarningsAsErrors = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithApplicationReferenceRouting(enabled bool) *EDIFACTOrderGenerator {
+	g.applicationRouting = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) applicationReference(order EDIOrder) string {
+	if order.ApplicationReference != "" || !g.applicationRouting {
+		return order.ApplicationReference
+	}
+	if order.MessageType != "" {
+		return order.MessageType
+	}
+	return DefaultMessageType
+}
+
+func (g *EDIFACTOrderGenerator) WithHMACKey(key []byte) *EDIFACTOrderGenerator {
+	g.hmacKey = append([]byte(nil), key...)
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithTruncateLongSegments(enabled bool) *EDIFACTOrderGenerator {
+	g.truncateLongSegments = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithValidationCache(cache *ValidationCache) *EDIFACTOrderGenerator {
+	g.validationCache = cache
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithSegmentObserver(observer SegmentObserver) *EDIFACTOrderGenerator {
+	g.observer = observer
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithClockFunc(fn func() time.Time) *EDIFACTOrderGenerator {
+	g.clock = fn
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) now() time.Time {
+	if g.clock == nil {
+		return time.Now()
+	}
+	return g.clock()
+}
+
+func (g *EDIFACTOrderGenerator) WithLenientDeliveryDates(enabled bool) *EDIFACTOrderGenerator {
+	g.lenientDeliveryDates = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithRepeatableParties(qualifiers ...string) *EDIFACTOrderGenerator {
+	g.repeatableParties = make(map[string]bool, len(qualifiers))
+	for _, qualifier := range qualifiers {
+		g.repeatableParties[qualifier] = true
+	}
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithPermissiveIDTypes(enabled bool) *EDIFACTOrderGenerator {
+	g.permissiveIDTypes = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) WithPermissiveMessageIdentifiers(enabled bool) *EDIFACTOrderGenerator {
+	g.permissiveMessageIdentifiers = enabled
+	return g
+}
+
+func (g *EDIFACTOrderGenerator) validate(order EDIOrder) error {
+	err := g.validateAll(order)
+	if g.validationErrorFormat != nil {
+		err = withValidationErrorFormat(err, g.validationErrorFormat)
+	}
+	return err
+}
+
+func (g *EDIFACTOrderGenerator) validateAll(order EDIOrder) error {
+	err := g.validateBuiltin(order)
+	if len(g.validators) == 0 {
+		return err
+	}
+	
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, validator := range g.validators {
+		for _, ruleErr := range validator.Validate(order) {
+			if ruleErr != nil {
+				errs = append(errs, ruleErr)
+			}
+		}
+	}
+	
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationErrors{Errors: errs}
+}
+
+func (g *EDIFACTOrderGenerator) validateOptions() error {
+	if g.signStyle < SignLeading || g.signStyle > SignParenthesized {
+		return &ValidationError{Field: "EDIFACTOrderGenerator.SignStyle", Message: fmt.Sprintf("unknown sign style %s", g.signStyle)}
+	}
+	if g.zeroPriceMode < ZeroPriceEmit || g.zeroPriceMode > ZeroPriceFreeGoods {
+		return &ValidationError{Field: "EDIFACTOrderGenerator.ZeroPriceMode", Message: fmt.Sprintf("unknown zero price mode %s", g.zeroPriceMode)}
+	}
+	if g.syntaxVersion4 {
+		if err := g.validateSeparators(); err != nil {
+			return fmt.Errorf("syntax version 4 repetition separator %q: %w", g.repetitionSeparator, err)
+		}
+	}
+	return nil
+}
+
+func (g *EDIFACTOrderGenerator) validateBuiltin(order EDIOrder) error {
+	if err := g.validateOptions(); err != nil {
+		return err
+	}
+	
+	checked := order
+	if g.negativeQuantities {
+		checked = order.withAbsoluteQuantities()
+	}
+	if g.validationCache != nil {
+		if err := g.validationCache.Validate(checked); err != nil {
+			return err
+		}
+	} else if err := checked.Validate(); err != nil {
+		return err
+	}
+	
+	if g.rejectSelfAddressed && order.isSelfAddressed() {
+		return &ValidationError{Field: "EDIOrder.InterchangeReceiverID", Message: "interchange sender and receiver are the same"}
+	}
+	
+	if order.TotalQuantity != 0 {
+		provided := strconv.FormatFloat(order.TotalQuantity, 'f', g.quantityPrecision, 64)
+		computed := strconv.FormatFloat(order.computedTotalQuantity(), 'f', g.quantityPrecision, 64)
+		if provided != computed {
+			return &ValidationError{
+				Field:   "EDIOrder.TotalQuantity",
+				Message: fmt.Sprintf("total quantity %s does not match the sum of item quantities %s", provided, computed),
+			}
+		}
+	}
+	
+	if !g.permissiveMessageIdentifiers {
+		if order.ResponsibleAgency != "" && !responsibleAgencies[order.ResponsibleAgency] {
+			return &ValidationError{
+				Field:   "EDIOrder.ResponsibleAgency",
+				Message: fmt.Sprintf("unrecognized controlling agency %q", order.ResponsibleAgency),
+			}
+		}
+		if order.AssociationCode != "" && !isValidAssociationCode(order.AssociationCode) {
+			return &ValidationError{
+				Field:   "EDIOrder.AssociationCode",
+				Message: fmt.Sprintf("association assigned code %q must be EAN followed by three digits", order.AssociationCode),
+			}
+		}
+	}
+	
+	if g.strictMessageTypes {
+		key := order.messageTypeKey()
+		if !g.messageTypes.IsKnown(key.Type, key.Version, key.Release, key.Agency) {
+			return &ValidationError{
+				Field:   "EDIOrder.MessageVersion",
+				Message: fmt.Sprintf("unknown message type %s:%s:%s:%s", key.Type, key.Version, key.Release, key.Agency),
+			}
+		}
+	}
+	
+	parties := order.parties()
+	
+	if !g.permissiveIDTypes {
+		for _, party := range parties {
+			if party.address.ID == "" || party.address.IDType == "" {
+				continue
+			}
+			if !partyIDTypes[party.address.IDType] {
+				return &ValidationError{
+					Field:   fmt.Sprintf("EDIOrder.%s.IDType", party.field),
+					Message: fmt.Sprintf("unrecognized ID type qualifier %q for %s party", party.address.IDType, party.qualifier),
+				}
+			}
+		}
+	}
+	
+	if !g.lenientDeliveryDates {
+		if issues := order.deliveryDateIssues(); len(issues) > 0 {
+			return issues[0]
+		}
+	}
+	
+	seen := make(map[string]bool, len(parties))
+	for _, party := range parties {
+		if seen[party.qualifier] && !g.repeatableParties[party.qualifier] {
+			return &ValidationError{
+				Field:   fmt.Sprintf("EDIOrder.%s", party.field),
+				Message: fmt.Sprintf("party role %s appears more than once", party.qualifier),
+			}
+		}
+		seen[party.qualifier] = true
+	}
+	
+	if g.treatWarningsAsErrors {
+		var blocking []LintFinding
+		for _, finding := range g.Lint(order) {
+			if finding.Severity >= SeverityWarning {
+				blocking = append(blocking, finding)
+			}
+		}
+		if len(blocking) > 0 {
+			return &LintErrors{Findings: blocking}
+		}
+	}
+	
+	return nil
+}
+
+func (g *EDIFACTOrderGenerator) Lint(order EDIOrder) []LintFinding {
+	var findings []LintFinding
+	
+	syntaxID := order.SyntaxIdentifier
+	if syntaxID == "" {
+		syntaxID = "UNOA"
+	}
+	if expected, ok := syntaxCharsets[syntaxID]; ok && g.encoding != EncodingUTF8 && g.encoding.Name() != expected {
+		findings = append(findings, LintFinding{
+			Severity: SeverityWarning,
+			Field:    "EDIOrder.SyntaxIdentifier",
+			Message:  fmt.Sprintf("output encoding %s does not match %s declared by syntax identifier %s", g.encoding.Name(), expected, syntaxID),
+		})
+	}
+	
+	for _, issue := range order.deliveryDateIssues() {
+		findings = append(findings, LintFinding{Severity: SeverityWarning, Field: issue.Field, Message: issue.Message})
+	}
+	
+	if order.isSelfAddressed() {
+		findings = append(findings, LintFinding{
+			Severity: SeverityWarning,
+			Field:    "EDIOrder.InterchangeReceiverID",
+			Message:  fmt.Sprintf("interchange sender and receiver are both %s; partners usually drop self-addressed interchanges", order.InterchangeSenderID),
+		})
+	}
+	
+	for _, terms := range []struct {
+		field, code, text string
+	}{
+		{"DeliveryTerms", order.DeliveryTermsCode, order.DeliveryTerms},
+		{"PaymentTerms", order.PaymentTermsCode, order.PaymentTerms},
+		{"TransportMode", order.TransportModeCode, order.TransportMode},
+	} {
+		if terms.code == "" || terms.text == "" {
+			continue
+		}
+		if !strings.Contains(strings.ToUpper(terms.text), strings.ToUpper(terms.code)) {
+			findings = append(findings, LintFinding{
+				Severity: SeverityWarning,
+				Field:    "EDIOrder." + terms.field,
+				Message:  fmt.Sprintf("%sCode %q and %s %q appear inconsistent; the code takes precedence and the text is not emitted", terms.field, terms.code, terms.field, terms.text),
+			})
+		}
+	}
+	
+	return findings
+}
+
+func (g *EDIFACTOrderGenerator) Generate(ctx context.Context, order EDIOrder, writer io.Writer) error {
+	_, err := g.GenerateWithStats(ctx, order, writer)
+	return err
+}
+
+func (g *EDIFACTOrderGenerator) GenerateWithStats(ctx context.Context, order EDIOrder, writer io.Writer) (GenStats, error) {
+	start := time.Now()
+	stats := GenStats{CorrelationID: CorrelationIDFromContext(ctx)}
+	
+	select {
+	case <-ctx.Done():
+		return stats, ErrContextCancelled
+	default:
+	}
+	
+	if err := g.validate(order); err != nil {
+		return stats, fmt.Errorf("order validation failed: %w", err)
+	}
+	
+	e := g.newSegmentEmitter(ctx, writer)
+	err := g.writeInterchange(ctx, order, e)
+	if err == nil {
+		err = e.result()
+	}
+	
+	stats.Segments = e.count
+	stats.Duration = time.Since(start)
+	return stats, err
+}
+
+func (g *EDIFACTOrderGenerator) GenerateFast(ctx context.Context, order EDIOrder, writer io.Writer) error {
+	if !g.fastPathEligible(order) {
+		return g.Generate(ctx, order, writer)
+	}
+	
+	select {
+	case <-ctx.Done():
+		return ErrContextCancelled
+	default:
+	}
+	
+	if err := g.validate(order); err != nil {
+		return fmt.Errorf("order validation failed: %w", err)
+	}
+	
+	e := g.newSegmentEmitter(ctx, writer)
+	e.buffered = true
+	e.buf = make([]byte, 0, fastPathBufferSize)
+	err := g.writeInterchange(ctx, order, e)
+	if err == nil {
+		err = e.result()
+	}
+	
+	if writeErr := writeFull(writer, e.buf); writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+const fastPathBufferSize = 2048
+
+func (g *EDIFACTOrderGenerator) fastPathEligible(order EDIOrder) bool {
+	if len(order.Items) > FastPathMaxItems {
+		return false
+	}
+	if _, ok := g.segmentBuilder.(*DefaultSegmentBuilder); !ok {
+		return false
+	}
+	return g.segmentBuildTimeout <= 0 &&
+		len(g.hmacKey) == 0 &&
+		g.encoding == EncodingUTF8 &&
+		!g.needsServiceStringAdvice()
+}
+
+func (g *EDIFACTOrderGenerator) GenerateSegmentReport(ctx context.Context, order EDIOrder) ([]SegmentReport, error) {
+	result, err := g.inspect(ctx, order)
+	return result.report, err
+}
+
+func WriteSegmentReportCSV(writer io.Writer, report []SegmentReport) error {
+	w := csv.NewWriter(writer)
+	if err := w.Write([]string{"index", "tag", "offset", "content"}); err != nil {
+		return err
+	}
+	for _, r := range report {
+		if err := w.Write([]string{strconv.Itoa(r.SegmentIndex), r.Tag, strconv.Itoa(r.CharOffset), r.RawContent}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func (g *EDIFACTOrderGenerator) DryRun(ctx context.Context, order EDIOrder) ([]SegmentMeta, error) {
+	result, err := g.inspect(ctx, order)
+	return result.segments, err
+}
+
+func (g *EDIFACTOrderGenerator) SegmentPlan(order EDIOrder) ([]string, error) {
+	result, err := g.inspect(context.Background(), order)
+	plan := make([]string, len(result.segments))
+	for i, meta := range result.segments {
+		plan[i] = meta.Tag
+	}
+	return plan, err
+}
+
+func (g *EDIFACTOrderGenerator) EstimateSize(order EDIOrder) (int, error) {
+	result, err := g.inspect(context.Background(), order)
+	if err != nil {
+		return 0, err
+	}
+	return result.size, nil
+}
+
+type inspection struct {
+	segments []SegmentMeta
+	report   []SegmentReport
+	size     int
+	offset   int
+}
+
+func (r *inspection) add(meta SegmentMeta, line string) {
+	r.segments = append(r.segments, meta)
+	r.report = append(r.report, SegmentReport{
+		Tag:          meta.Tag,
+		RawContent:   line,
+		SegmentIndex: len(r.report),
+		CharOffset:   r.offset,
+	})
+	r.size += meta.EstimatedBytes
+	r.offset += utf8.RuneCountInString(line) + 1
+}
+
+func (g *EDIFACTOrderGenerator) inspect(ctx context.Context, order EDIOrder) (inspection, error) {
+	select {
+	case <-ctx.Done():
+		return inspection{}, ErrContextCancelled
+	default:
+	}
+	
+	if err := g.validate(order); err != nil {
+		return inspection{}, fmt.Errorf("order validation failed: %w", err)
+	}
+	
+	e := g.newSegmentEmitter(ctx, io.Discard)
+	e.inspection = &inspection{}
+	err := g.writeInterchange(ctx, order, e)
+	if err == nil {
+		err = e.result()
+	}
+	return *e.inspection, err
+}
+
+func (g *EDIFACTOrderGenerator) writeInterchange(ctx context.Context, order EDIOrder, e *segmentEmitter) error {
+	mac := g.startSignature(e)
+	
+	if g.needsServiceStringAdvice() {
+		if err := e.writeServiceStringAdvice(); err != nil {
+			return err
+		}
+	}
+	
+	unb, err := g.builder().BuildUNB(ctx, order)
+	if err := e.emit(unb, err, "UNB"); err != nil {
+		return err
+	}
+	
+	if err := g.writeMessage(ctx, order, e); err != nil {
+		return err
+	}
+	
+	messageCount := 1
+	unz, err := g.builder().BuildUNZ(ctx, order, messageCount)
+	if err := e.emit(unz, err, "UNZ"); err != nil {
+		return err
+	}
+	
+	return g.writeSignature(ctx, order, mac, e)
+}
+
+func (g *EDIFACTOrderGenerator) startSignature(e *segmentEmitter) hash.Hash {
+	if len(g.hmacKey) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, g.hmacKey)
+	e.writer = io.MultiWriter(e.writer, mac)
+	return mac
+}
+
+func (g *EDIFACTOrderGenerator) writeSignature(ctx context.Context, envelope EDIOrder, mac hash.Hash, e *segmentEmitter) error {
+	if mac == nil {
+		return nil
+	}
+	hmc, err := buildOptional(ctx, g, "ProprietaryHMC", func(ctx context.Context, b HMCBuilder) (EDISegment, error) {
+		return b.BuildProprietaryHMC(ctx, envelope, mac.Sum(nil))
+	})
+	return e.emit(hmc, err, "HMC")
+}
+
+func VerifyInterchangeHMAC(content, key []byte) (bool, error) {
+	d, _, err := ParseServiceStringAdvice(content)
+	if err != nil {
+		return false, err
+	}
+	
+	idx := bytes.LastIndex(content, []byte(SegmentTagProprietaryHMC+string(d.Element)))
+	if idx < 0 || !bytes.HasSuffix(bytes.TrimRight(content[:idx], "\r\n"), []byte{d.Terminator}) {
+		return false, fmt.Errorf("%w: no %s segment", ErrUnexpectedSegment, SegmentTagProprietaryHMC)
+	}
+	
+	end := bytes.IndexByte(content[idx:], d.Terminator)
+	if end < 0 {
+		return false, fmt.Errorf("%w: unterminated %s segment", ErrMalformedSegment, SegmentTagProprietaryHMC)
+	}
+	parts := d.split(string(content[idx:idx+end]), d.Element)
+	expected, err := hex.DecodeString(segmentElement(EDISegment{Elements: parts[1:]}, 1))
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid %s digest", ErrMalformedSegment, SegmentTagProprietaryHMC)
+	}
+	
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content[:idx])
+	return hmac.Equal(mac.Sum(nil), expected), nil
+}
+
+func (g *EDIFACTOrderGenerator) GenerateMessage(ctx context.Context, order EDIOrder, writer io.Writer) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ErrContextCancelled
+	default:
+	}
+	
+	if err := g.validate(order); err != nil {
+		return 0, fmt.Errorf("order validation failed: %w", err)
+	}
+	
+	e := g.newSegmentEmitter(ctx, writer)
+	if err := g.writeMessage(ctx, order, e); err != nil {
+		return e.count, err
+	}
+	
+	return e.count, e.result()
+}
+
+func (g *EDIFACTOrderGenerator) GenerateToPipe(ctx context.Context, order EDIOrder) (io.ReadCloser, <-chan error) {
+	reader, writer := io.Pipe()
+	errCh := make(chan error, 1)
+	done := make(chan struct{})
+	var mu sync.Mutex
+	finished, cancelled := false, false
+	
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !finished {
+				cancelled = true
+				writer.CloseWithError(ErrContextCancelled)
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+	
+	go func() {
+		defer close(errCh)
+		err := g.Generate(ctx, order, writer)
+		
+		mu.Lock()
+		finished = true
+		if cancelled || (err != nil && ctx.Err() != nil) {
+			err = ErrContextCancelled
+		}
+		mu.Unlock()
+		close(done)
+		
+		writer.CloseWithError(err)
+		errCh <- err
+	}()
+	
+	return reader, errCh
+}
+
+type SyncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func NewSyncBuffer() *SyncBuffer {
+	return &SyncBuffer{}
+}
+
+func (b *SyncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *SyncBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Read(p)
+}
+
+func (b *SyncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Len()
+}
+
+func (b *SyncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+const ContinuationCharacter = '~'
+
+type fixedWidthWriter struct {
+	writer io.Writer
+	width  int
+	column int
+	held   bool
+	last   byte
+	line   []byte
+}
+
+func FixedWidthWriter(w io.Writer, lineWidth int) io.WriteCloser {
+	if lineWidth < 2 {
+		return nopWriteCloser{w}
+	}
+	return &fixedWidthWriter{writer: w, width: lineWidth}
+}
+
+func (f *fixedWidthWriter) Write(p []byte) (int, error) {
+	if i := bytes.IndexByte(p, ContinuationCharacter); i >= 0 {
+		return 0, fmt.Errorf("%w: continuation character %q at offset %d", ErrInvalidSeparator, ContinuationCharacter, i)
+	}
+	
+	out := f.line[:0]
+	for _, c := range p {
+		if c == '\n' {
+			if f.held {
+				out = append(out, f.last)
+				f.held = false
+			}
+			out = append(out, c)
+			f.column = 0
+			continue
+		}
+		if f.held {
+			out = append(out, ContinuationCharacter, '\n', f.last)
+			f.held = false
+			f.column = 1
+		}
+		if f.column == f.width-1 {
+			f.last = c
+			f.held = true
+			continue
+		}
+		out = append(out, c)
+		f.column++
+	}
+	f.line = out
+	
+	if err := writeFull(f.writer, out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *fixedWidthWriter) Close() error {
+	if !f.held {
+		return nil
+	}
+	f.held = false
+	return writeFull(f.writer, []byte{f.last})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+const DefaultValidationCacheSize = 1024
+
+type ValidationCache struct {
+	mu      sync.Mutex
+	maxSize int
+	order   *list.List
+	results map[string]*list.Element
+}
+
+type validationResult struct {
+	key string
+	err error
+}
+
+func NewValidationCache(maxSize int) *ValidationCache {
+	if maxSize <= 0 {
+		maxSize = DefaultValidationCacheSize
+	}
+	return &ValidationCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		results: make(map[string]*list.Element),
+	}
+}
+
+func (c *ValidationCache) Validate(order EDIOrder) error {
+	key, err := order.Hash()
+	if err != nil {
+		return order.Validate()
+	}
+	
+	c.mu.Lock()
+	if elem, ok := c.results[key]; ok {
+		c.order.MoveToFront(elem)
+		result := elem.Value.(validationResult).err
+		c.mu.Unlock()
+		return result
+	}
+	c.mu.Unlock()
+	
+	result := order.Validate()
+	
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.results[key]; ok {
+		c.order.MoveToFront(elem)
+		return result
+	}
+	c.results[key] = c.order.PushFront(validationResult{key: key, err: result})
+	for c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.results, oldest.Value.(validationResult).key)
+	}
+	return result
+}
+
+func (c *ValidationCache) Reset() {
+	c.mu.Lock()
+	c.order.Init()
+	c.results = make(map[string]*list.Element)
+	c.mu.Unlock()
+}
+
+func (c *ValidationCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+const DefaultPreGenerationTimeout = 30 * time.Second
+
+type PreGenerationCache struct {
+	generator *EDIFACTOrderGenerator
+	timeout   time.Duration
+	mu        sync.Mutex
+	entries   map[string]*cachedOrder
+}
+
+type cachedOrder struct {
+	template EDIOrder
+	ready    chan struct{}
+	lines    [][]byte
+	dynamic  map[int]string
+	err      error
+}
+
+func NewPreGenerationCache(g *EDIFACTOrderGenerator) *PreGenerationCache {
+	return &PreGenerationCache{
+		generator: g,
+		timeout:   DefaultPreGenerationTimeout,
+		entries:   make(map[string]*cachedOrder),
+	}
+}
+
+func (c *PreGenerationCache) WithTimeout(timeout time.Duration) *PreGenerationCache {
+	c.timeout = timeout
+	return c
+}
+
+func (c *PreGenerationCache) Prepare(ctx context.Context, cacheKey string, template EDIOrder) {
+	c.mu.Lock()
+	if _, ok := c.entries[cacheKey]; ok {
+		c.mu.Unlock()
+		return
+	}
+	entry := &cachedOrder{template: template, ready: make(chan struct{})}
+	c.entries[cacheKey] = entry
+	c.mu.Unlock()
+	
+	go func() {
+		defer close(entry.ready)
+		
+		prepareCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.timeout)
+		defer cancel()
+		entry.lines, entry.dynamic, entry.err = c.generator.pregenerate(prepareCtx, template)
+		
+		if isInterruption(entry.err) {
+			c.mu.Lock()
+			if c.entries[cacheKey] == entry {
+				delete(c.entries, cacheKey)
+			}
+			c.mu.Unlock()
+		}
+	}()
+}
+
+func isInterruption(err error) bool {
+	return errors.Is(err, ErrContextCancelled) ||
+		errors.Is(err, ErrSegmentBuildTimeout) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+func (c *PreGenerationCache) Generate(ctx context.Context, cacheKey, orderNumber, controlRef string, date time.Time, writer io.Writer) error {
+	c.mu.Lock()
+	entry, ok := c.entries[cacheKey]
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrCacheMiss, cacheKey)
+	}
+	
+	select {
+	case <-ctx.Done():
+		return ErrContextCancelled
+	case <-entry.ready:
+	}
+	if entry.err != nil {
+		return fmt.Errorf("pre-generation for %s failed: %w", cacheKey, entry.err)
+	}
+	
+	order := entry.template
+	order.OrderNumber = orderNumber
+	order.InterchangeControlRef = controlRef
+	order.OrderDate = date
+	
+	g := c.generator
+	if err := g.validate(order); err != nil {
+		return fmt.Errorf("order validation failed: %w", err)
+	}
+	
+	var mac hash.Hash
+	if len(g.hmacKey) > 0 {
+		mac = hmac.New(sha256.New, g.hmacKey)
+	}
+	
+	correlationID := CorrelationIDFromContext(ctx)
+	index := 0
+	for i, line := range entry.lines {
+		tag, ok := entry.dynamic[i]
+		if ok {
+			segment, err := g.buildDynamicSegment(ctx, tag, order, mac)
+			if err != nil {
+				return fmt.Errorf("failed to build %s: %w", tag, err)
+			}
+			if line, err = g.renderSegment(segment); err != nil {
+				return fmt.Errorf("failed to build %s: %w", tag, err)
+			}
+		}
+		if mac != nil && tag != SegmentTagProprietaryHMC {
+			mac.Write(line)
+		}
+		if err := writeFull(writer, line); err != nil {
+			return err
+		}
+		
+		if bytes.HasPrefix(line, []byte(SegmentTagUNA)) {
+			continue
+		}
+		index++
+		if g.observer != nil {
+			g.observer(SegmentEvent{CorrelationID: correlationID, Tag: string(line[:3]), Index: index})
+		}
+	}
+	
+	return nil
+}
+
+type segmentRecorder struct {
+	segments [][]byte
+}
+
+func (r *segmentRecorder) Write(p []byte) (int, error) {
+	r.segments = append(r.segments, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (g *EDIFACTOrderGenerator) pregenerate(ctx context.Context, template EDIOrder) ([][]byte, map[int]string, error) {
+	if err := g.validate(template); err != nil {
+		return nil, nil, fmt.Errorf("order validation failed: %w", err)
+	}
+	
+	var recorder segmentRecorder
+	e := g.newSegmentEmitter(ctx, &recorder)
+	e.quiet = true
+	err := g.writeInterchange(ctx, template, e)
+	if err == nil {
+		err = e.result()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := recorder.segments
+	
+	dynamic := make(map[int]string)
+	next := 0
+	for _, tag := range []string{SegmentTagUNB, SegmentTagBGM, SegmentTagDTM, SegmentTagUNZ} {
+		segment, err := g.buildDynamicSegment(ctx, tag, template, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		rendered, err := g.renderSegment(segment)
+		if err != nil {
+			return nil, nil, err
+		}
+		for next < len(lines) && !bytes.Equal(lines[next], rendered) {
+			next++
+		}
+		if next == len(lines) {
+			return nil, nil, fmt.Errorf("%w: %s segment built from the template does not match the generated output", ErrTemplateNotReusable, tag)
+		}
+		dynamic[next] = tag
+		next++
+	}
+	
+	if len(g.hmacKey) > 0 {
+		dynamic[len(lines)-1] = SegmentTagProprietaryHMC
+	}
+	
+	return lines, dynamic, nil
+}
+
+func (g *EDIFACTOrderGenerator) buildDynamicSegment(ctx context.Context, tag string, order EDIOrder, mac hash.Hash) (EDISegment, error) {
+	switch tag {
+	case SegmentTagUNB:
+		return g.builder().BuildUNB(ctx, order)
+	case SegmentTagBGM:
+		return g.builder().BuildBGM(ctx, order)
+	case SegmentTagDTM:
+		return g.builder().BuildDTM(ctx, order.OrderDate, QualifierDocumentDate)
+	case SegmentTagUNZ:
+		return g.builder().BuildUNZ(ctx, order, 1)
+	case SegmentTagProprietaryHMC:
+		return buildOptional(ctx, g, "ProprietaryHMC", func(ctx context.Context, b HMCBuilder) (EDISegment, error) {
+			return b.BuildProprietaryHMC(ctx, order, mac.Sum(nil))
+		})
+	default:
+		return EDISegment{}, fmt.Errorf("unsupported dynamic segment %s", tag)
+	}
+}
+
+type InterchangeHeader struct {
+	SenderID          string
+	SenderQualifier   string
+	ReceiverID        string
+	ReceiverQualifier string
+	ControlRef        string
+	Date              time.Time
+	SyntaxIdentifier  string
+	SyntaxVersion     string
+	TestIndicator     int
+}
+
+type Interchange struct {
+	Header InterchangeHeader
+	Orders []EDIOrder
+}
+
+type Acknowledgement struct {
+	Original         InterchangeHeader
+	ControlRef       string
+	MessageRefNumber string
+	Messages         []MessageAcknowledgement
+}
+
+type MessageAcknowledgement struct {
+	MessageRefNumber  string
+	MessageType       string
+	MessageVersion    string
+	MessageRelease    string
+	ResponsibleAgency string
+	Accepted          bool
+	ErrorCode         string
+}
+
+func (a Acknowledgement) action() string {
+	for _, msg := range a.Messages {
+		if msg.Accepted {
+			return ActionAcknowledged
+		}
+	}
+	if len(a.Messages) == 0 {
+		return ActionAcknowledged
+	}
+	return ActionRejected
+}
+
+func (a Acknowledgement) Validate() error {
+	if a.Original.ControlRef == "" {
+		return &ValidationError{Field: "Acknowledgement.Original.ControlRef", Message: "original interchange control reference is required"}
+	}
+	if a.Original.SenderID == "" || a.Original.ReceiverID == "" {
+		return &ValidationError{Field: "Acknowledgement.Original", Message: "original sender and receiver are required"}
+	}
+	for i, msg := range a.Messages {
+		if msg.MessageRefNumber == "" {
+			return &ValidationError{Field: fmt.Sprintf("Acknowledgement.Messages[%d].MessageRefNumber", i), Message: "message reference number is required"}
+		}
+		if msg.Accepted && msg.ErrorCode != "" {
+			return &ValidationError{Field: fmt.Sprintf("Acknowledgement.Messages[%d].ErrorCode", i), Message: "accepted messages cannot carry an error code"}
+		}
+	}
+	return nil
+}
+
+func (a Acknowledgement) envelope(now time.Time) EDIOrder {
+	envelope := a.Original.applyTo(EDIOrder{}).reversedEnvelope(now)
+	if a.ControlRef != "" {
+		envelope.InterchangeControlRef = a.ControlRef
+	}
+	envelope.MessageRefNumber = a.MessageRefNumber
+	if envelope.MessageRefNumber == "" {
+		envelope.MessageRefNumber = "1"
+	}
+	return envelope
+}
+
+type SegmentMeta struct {
+	Tag            string
+	ElementCount   int
+	EstimatedBytes int
+	IsOptional     bool
+}
+
+var defaultLineSegmentOrder = []string{
+	SegmentTagIMD,
+	SegmentTagQTY,
+	SegmentTagPRI,
+	SegmentTagALC,
+	SegmentTagMOA,
+	SegmentTagTDT,
+	SegmentTagDTM,
+}
+
+var mandatorySegments = map[string]bool{
+	SegmentTagUNB: true,
+	SegmentTagUNH: true,
+	SegmentTagBGM: true,
+	SegmentTagUNS: true,
+	SegmentTagUNT: true,
+	SegmentTagUNZ: true,
+}
+
+func isMandatorySegment(segment EDISegment) bool {
+	if segment.Tag == SegmentTagDTM {
+		return len(segment.Elements) > 0 && strings.HasPrefix(segment.Elements[0], QualifierDocumentDate+":")
+	}
+	return mandatorySegments[segment.Tag]
+}
+
+type SegmentReport struct {
+	Tag          string
+	RawContent   string
+	SegmentIndex int
+	CharOffset   int
+}
+
+type InterchangeStats struct {
+	MessagesWritten int
+	SegmentsWritten int
+	BytesWritten    int
+	Duration        time.Duration
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	written int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.written += n
+	return n, err
+}
+
+type MessageRefNumberPool struct {
+	mu   sync.Mutex
+	next int
+	used map[string]bool
+}
+
+func NewMessageRefNumberPool() *MessageRefNumberPool {
+	return &MessageRefNumberPool{
+		next: 1,
+		used: make(map[string]bool),
+	}
+}
+
+func (p *MessageRefNumberPool) Reserve(ref string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	
+	if p.used[ref] {
+		return false
+	}
+	p.used[ref] = true
+	return true
+}
+
+func (p *MessageRefNumberPool) Next() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	
+	for {
+		ref := strconv.Itoa(p.next)
+		p.next++
+		if !p.used[ref] {
+			p.used[ref] = true
+			return ref
+		}
+	}
+}
+
+func (h InterchangeHeader) applyTo(order EDIOrder) EDIOrder {
+	order.InterchangeSenderID = h.SenderID
+	order.InterchangeSenderQualifier = h.SenderQualifier
+	order.InterchangeReceiverID = h.ReceiverID
+	order.InterchangeReceiverQualifier = h.ReceiverQualifier
+	order.InterchangeControlRef = h.ControlRef
+	order.SyntaxIdentifier = h.SyntaxIdentifier
+	order.SyntaxVersion = h.SyntaxVersion
+	order.TestIndicator = h.TestIndicator
+	return order
+}
+
+func (h InterchangeHeader) envelope(orders []EDIOrder, now time.Time) EDIOrder {
+	envelope := h.applyTo(EDIOrder{OrderDate: h.Date})
+	if envelope.OrderDate.IsZero() && len(orders) > 0 {
+		envelope.OrderDate = orders[0].OrderDate
+	}
+	if envelope.OrderDate.IsZero() {
+		envelope.OrderDate = now
+	}
+	return envelope
+}
+
+func (g *EDIFACTOrderGenerator) GenerateInterchange(ctx context.Context, interchange Interchange, writer io.Writer) (stats InterchangeStats, err error) {
+	start := time.Now()
+	
+	select {
+	case <-ctx.Done():
+		return stats, ErrContextCancelled
+	default:
+	}
+	
+	if len(interchange.Orders) == 0 && !g.allowEmptyInterchange {
+		return stats, fmt.Errorf("%w: interchange %s has no orders", ErrNoMessages, interchange.Header.ControlRef)
+	}
+	
+	orders := make([]EDIOrder, len(interchange.Orders))
+	messageRefs := NewMessageRefNumberPool()
+	for i, order := range interchange.Orders {
+		if order.MessageRefNumber != "" && !messageRefs.Reserve(order.MessageRefNumber) {
+			return stats, &ValidationError{
+				Field:   fmt.Sprintf("Interchange.Orders[%d].MessageRefNumber", i),
+				Message: fmt.Sprintf("message reference number %s is not unique within the interchange", order.MessageRefNumber),
+			}
+		}
+	}
+	for i, order := range interchange.Orders {
+		if order.MessageRefNumber == "" {
+			order.MessageRefNumber = messageRefs.Next()
+		}
+		order = interchange.Header.applyTo(order)
+		if err := g.validate(order); err != nil {
+			return stats, fmt.Errorf("order at index %d validation failed: %w", i, err)
+		}
+		orders[i] = order
+	}
+	
+	envelope := interchange.Header.envelope(orders, g.now())
+	if len(orders) > 0 {
+		envelope.MessageType = orders[0].MessageType
+	}
+	counter := &countingWriter{writer: writer}
+	e := g.newSegmentEmitter(ctx, counter)
+	defer func() {
+		stats.SegmentsWritten = e.count
+		stats.BytesWritten = counter.written
+		stats.Duration = time.Since(start)
+	}()
+	mac := g.startSignature(e)
+	
+	if g.needsServiceStringAdvice() {
+		if err := e.writeServiceStringAdvice(); err != nil {
+			return stats, err
+		}
+	}
+	
+	unb, err := g.builder().BuildUNB(ctx, envelope)
+	if err := e.emit(unb, err, "UNB"); err != nil {
+		return stats, err
+	}
+	
+	for _, order := range orders {
+		if err := g.writeMessage(ctx, order, e); err != nil {
+			return stats, err
+		}
+		stats.MessagesWritten++
+	}
+	
+	unz, err := g.builder().BuildUNZ(ctx, envelope, len(orders))
+	if err := e.emit(unz, err, "UNZ"); err != nil {
+		return stats, err
+	}
+	
+	if err := g.writeSignature(ctx, envelope, mac, e); err != nil {
+		return stats, err
+	}
+	
+	return stats, e.result()
+}
+
+func (g *EDIFACTOrderGenerator) GenerateStream(ctx context.Context, interchanges []Interchange, writer io.Writer) error {
+	controlRefs := make(map[string]bool, len(interchanges))
+	for i, interchange := range interchanges {
+		ref := interchange.Header.ControlRef
+		if controlRefs[ref] {
+			return fmt.Errorf("%w: %s at index %d", ErrDuplicateControlRef, ref, i)
+		}
+		controlRefs[ref] = true
+	}
+	
+	for i, interchange := range interchanges {
+		if _, err := g.GenerateInterchange(ctx, interchange, writer); err != nil {
+			return fmt.Errorf("interchange at index %d: %w", i, err)
+		}
+	}
+	
+	return nil
+}
+
+func (g *EDIFACTOrderGenerator) GenerateCONTRL(ctx context.Context, ack Acknowledgement, writer io.Writer) error {
+	select {
+	case <-ctx.Done():
+		return ErrContextCancelled
+	default:
+	}
+	
+	if err := ack.Validate(); err != nil {
+		return fmt.Errorf("acknowledgement validation failed: %w", err)
+	}
+	
+	envelope := ack.envelope(g.now())
+	envelope.MessageType = MessageTypeCONTRL
+	ack.MessageRefNumber = envelope.MessageRefNumber
+	e := g.newSegmentEmitter(ctx, writer)
+	mac := g.startSignature(e)
+	
+	if g.needsServiceStringAdvice() {
+		if err := e.writeServiceStringAdvice(); err != nil {
+			return err
+		}
+	}
+	
+	unb, err := g.builder().BuildUNB(ctx, envelope)
+	if err := e.emit(unb, err, "UNB"); err != nil {
+		return err
+	}
+	
+	start := e.count
+	unh, err := buildOptional(ctx, g, "AcknowledgementUNH", func(ctx context.Context, b AcknowledgementBuilder) (EDISegment, error) {
+		return b.BuildAcknowledgementUNH(ctx, ack)
+	})
+	if err := e.emit(unh, err, "UNH"); err != nil {
+		return err
+	}
+	
+	uci, err := buildOptional(ctx, g, "UCI", func(ctx context.Context, b AcknowledgementBuilder) (EDISegment, error) {
+		return b.BuildUCI(ctx, ack)
+	})
+	if err := e.emit(uci, err, "UCI"); err != nil {
+		return err
+	}
+	
+	for _, msg := range ack.Messages {
+		ucm, err := buildOptional(ctx, g, "UCM", func(ctx context.Context, b AcknowledgementBuilder) (EDISegment, error) {
+			return b.BuildUCM(ctx, msg)
+		})
+		if err := e.emit(ucm, err, "UCM"); err != nil {
+			return err
+		}
+	}
+	
+	unt, err := g.builder().BuildUNT(ctx, envelope, g.untCount(e, start))
+	if err := e.emit(unt, err, "UNT"); err != nil {
+		return err
+	}
+	
+	unz, err := g.builder().BuildUNZ(ctx, envelope, 1)
+	if err := e.emit(unz, err, "UNZ"); err != nil {
+		return err
+	}
+	
+	if err := g.writeSignature(ctx, envelope, mac, e); err != nil {
+		return err
+	}
+	
+	return e.result()
+}
+
+func (g *EDIFACTOrderGenerator) buildPartyNAD(ctx context.Context, partyQualifier string, address Address) (EDISegment, error) {
+	if address.ID == "" && address.LocationCode != "" {
+		return buildOptional(ctx, g, "NADLocation", func(ctx context.Context, b NADLocationBuilder) (EDISegment, error) {
+			return b.BuildNADLocation(ctx, partyQualifier, address.LocationCode)
+		})
+	}
+	return g.builder().BuildNAD(ctx, partyQualifier, address)
+}
+
+func (g *EDIFACTOrderGenerator) writeReferences(ctx context.Context, refs []Reference, e *segmentEmitter) error {
+	for _, ref := range refs {
+		lineRFF, err := buildOptional(ctx, g, "RFF", func(ctx context.Context, b RFFBuilder) (EDISegment, error) {
+			return b.BuildRFF(ctx, ref.Qualifier, ref.Number)
+		})
+		if err := e.emit(lineRFF, err, "line RFF"); err != nil {
+			return err
+		}
+		
+		if !ref.Date.IsZero() {
+			refDTM, err := g.builder().BuildDTM(ctx, ref.Date, QualifierReferenceDate)
+			if err := e.emit(refDTM, err, "reference DTM"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (g *EDIFACTOrderGenerator) writeDeliveryWindows(ctx context.Context, address Address, e *segmentEmitter) error {
+	for _, window := range address.DeliveryWindows {
+		loc, err := buildOptional(ctx, g, "LOC", func(ctx context.Context, b DockWindowBuilder) (EDISegment, error) {
+			return b.BuildLOC(ctx, window.DockCode)
+		})
+		if err := e.emit(loc, err, "dock LOC"); err != nil {
+			return err
+		}
+		
+		windowDTM, err := buildOptional(ctx, g, "DockWindowDTM", func(ctx context.Context, b DockWindowBuilder) (EDISegment, error) {
+			return b.BuildDockWindowDTM(ctx, window)
+		})
+		if err := e.emit(windowDTM, err, "dock window DTM"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *EDIFACTOrderGenerator) writeAllowanceCharge(ctx context.Context, item EDIOrderItem, e *segmentEmitter) error {
+	alc, err := buildOptional(ctx, g, "ALC", func(ctx context.Context, b ALCBuilder) (EDISegment, error) {
+		return b.BuildALC(ctx, item)
+	})
+	if err := e.emit(alc, err, "ALC"); err != nil {
+		return err
+	}
+	
+	percentageQualifier, amountQualifier := PercentageAllowance, AmountAllowance
+	if item.Discount < 0 {
+		percentageQualifier, amountQualifier = PercentageCharge, AmountCharge
+	}
+	value := math.Abs(item.Discount)
+	
+	if item.DiscountType == DiscountTypePercentage {
+		pcd, err := buildOptional(ctx, g, "PCD", func(ctx context.Context, b PCDBuilder) (EDISegment, error) {
+			return b.BuildPCD(ctx, percentageQualifier, value)
+		})
+		return e.emit(pcd, err, "ALC PCD")
+	}
+	moa, err := buildOptional(ctx, g, "MOAAmount", func(ctx context.Context, b MOAAmountBuilder) (EDISegment, error) {
+		return b.BuildMOAAmount(ctx, amountQualifier, value)
+	})
+	return e.emit(moa, err, "ALC MOA")
+}
+
+type segmentEmitter struct {
+	generator  *EDIFACTOrderGenerator
+	writer     io.Writer
+	count      int
+	accumulate bool
+	errs       []error
+	inspection *inspection
+	correlationID string
+	buffered   bool
+	buf        []byte
+	quiet      bool
+}
+
+func (g *EDIFACTOrderGenerator) newSegmentEmitter(ctx context.Context, writer io.Writer) *segmentEmitter {
+	return &segmentEmitter{
+		generator:  g,
+		writer:     writer,
+		accumulate: g.accumulateSegmentErrors,
+		correlationID: CorrelationIDFromContext(ctx),
+	}
+}
+
+func (e *segmentEmitter) emit(segment EDISegment, buildErr error, name string) error {
+	if buildErr != nil {
+		return e.fail(fmt.Errorf("failed to build %s: %w", name, buildErr))
+	}
+	
+	if e.inspection != nil {
+		line, err := e.generator.segmentLine(segment)
+		if err != nil {
+			return e.fail(fmt.Errorf("failed to build %s: %w", name, err))
+		}
+		data, err := e.generator.renderSegment(segment)
+		if err != nil {
+			return e.fail(fmt.Errorf("failed to build %s: %w", name, err))
+		}
+		e.inspection.add(SegmentMeta{
+			Tag:            segment.Tag,
+			ElementCount:   len(segment.Elements),
+			EstimatedBytes: len(data),
+			IsOptional:     !isMandatorySegment(segment),
+		}, line)
+		e.count++
+		return nil
+	}
+	
+	if err := e.write(segment); err != nil {
+		if errors.Is(err, ErrSegmentTooLong) || errors.Is(err, ErrUnencodableCharacter) {
+			return e.fail(fmt.Errorf("failed to build %s: %w", name, err))
+		}
+		return err
+	}
+	e.count++
+	
+	if e.generator.observer != nil && !e.quiet {
+		e.generator.observer(SegmentEvent{
+			CorrelationID: e.correlationID,
+			Tag:           segment.Tag,
+			Index:         e.count,
+		})
+	}
+	
+	return nil
+}
+
+func (e *segmentEmitter) write(segment EDISegment) error {
+	if !e.buffered {
+		return e.generator.writeSegment(segment, e.writer)
+	}
+	
+	g := e.generator
+	buf, err := appendSegment(e.buf, segment, g.elementSeparator[0], g.segmentTerminator[0], g.releaseCharacter[0])
+	if err == nil {
+		e.buf = buf
+		return nil
+	}
+	if !errors.Is(err, ErrSegmentTooLong) || !g.truncateLongSegments {
+		return err
+	}
+	
+	data, err := g.renderSegment(segment)
+	if err != nil {
+		return err
+	}
+	e.buf = append(e.buf, data...)
+	return nil
+}
+
+func (g *EDIFACTOrderGenerator) needsServiceStringAdvice() bool {
+	d := DefaultDelimiters
+	return g.syntaxVersion4 ||
+		g.componentSeparator != string(d.Component) ||
+		g.elementSeparator != string(d.Element) ||
+		g.decimalMark != string(d.Decimal) ||
+		g.releaseCharacter != string(d.Release) ||
+		g.segmentTerminator != string(d.Terminator)
+}
+
+func (e *segmentEmitter) writeServiceStringAdvice() error {
+	g := e.generator
+	repetition := string(DefaultDelimiters.Repetition)
+	if g.syntaxVersion4 {
+		repetition = g.repetitionSeparator
+	}
+	advice := SegmentTagUNA + g.componentSeparator + g.elementSeparator + g.decimalMark + g.releaseCharacter + repetition + g.segmentTerminator + "\n"
+	if e.inspection != nil {
+		e.inspection.add(SegmentMeta{Tag: SegmentTagUNA, EstimatedBytes: len(advice), IsOptional: true}, strings.TrimSuffix(advice, "\n"))
+		return nil
+	}
+	
+	data, err := g.encoding.Encode(advice)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s segment: %w", SegmentTagUNA, err)
+	}
+	
+	return writeFull(e.writer, data)
+}
+
+func (e *segmentEmitter) emitAll(segments []EDISegment) error {
+	for _, segment := range segments {
+		if err := e.emit(segment, nil, segment.Tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *segmentEmitter) fail(err error) error {
+	if !e.accumulate || errors.Is(err, ErrContextCancelled) {
+		return err
+	}
+	e.errs = append(e.errs, err)
+	return nil
+}
+
+func (e *segmentEmitter) result() error {
+	if len(e.errs) == 0 {
+		return nil
+	}
+	return &SegmentErrors{Errors: e.errs}
+}
+
+func (g *EDIFACTOrderGenerator) writeMessage(ctx context.Context, order EDIOrder, e *segmentEmitter) error {
+	if g.autoComputeAmounts {
+		order = order.withComputedAmounts()
+	}
+	
+	start := e.count
+	
+	unh, err := g.builder().BuildUNH(ctx, order)
+	if err := e.emit(unh, err, "UNH"); err != nil {
+		return err
+	}
+	
+	bgm, err := g.builder().BuildBGM(ctx, order)
+	if err := e.emit(bgm, err, "BGM"); err != nil {
+		return err
+	}
+	
+	if order.BusinessFunction != "" {
+		bus, err := buildOptional(ctx, g, "BUS", func(ctx context.Context, b BUSBuilder) (EDISegment, error) {
+			return b.BuildBUS(ctx, order)
+		})
+		if err := e.emit(bus, err, "BUS"); err != nil {
+			return err
+		}
+	}
+	
+	if err := e.emitAll(order.ExtraSegments[AnchorAfterBGM]); err != nil {
+		return err
+	}
+	
+	dtm, err := g.builder().BuildDTM(ctx, order.OrderDate, QualifierDocumentDate)
+	if err := e.emit(dtm, err, "DTM"); err != nil {
+		return err
+	}
+	
+	if !order.DeliveryDate.IsZero() {
+		qualifier := QualifierDeliveryDate
+		if order.DeliveryDateQualifier != "" {
+			qualifier = order.DeliveryDateQualifier
+		}
+		deliveryDTM, err := g.builder().BuildDTM(ctx, order.DeliveryDate, qualifier)
+		if err := e.emit(deliveryDTM, err, "delivery DTM"); err != nil {
+			return err
+		}
+	}
+	
+	if order.ContractNumber != "" {
+		contractRFF, err := buildOptional(ctx, g, "RFF", func(ctx context.Context, b RFFBuilder) (EDISegment, error) {
+			return b.BuildRFF(ctx, ReferenceContract, order.ContractNumber)
+		})
+		if err := e.emit(contractRFF, err, "contract RFF"); err != nil {
+			return err
+		}
+	}
+	
+	if order.ScheduleID != "" {
+		scheduleRFF, err := buildOptional(ctx, g, "RFF", func(ctx context.Context, b RFFBuilder) (EDISegment, error) {
+			return b.BuildRFF(ctx, ReferenceDeliverySchedule, order.ScheduleID)
+		})
+		if err := e.emit(scheduleRFF, err, "schedule RFF"); err != nil {
+			return err
+		}
+	}
+	
+	if order.Currency != "" {
+		cux, err := g.builder().BuildCUX(ctx, order)
+		if err := e.emit(cux, err, "CUX"); err != nil {
+			return err
+		}
+	}
+	
+	parties := order.parties()
+	if g.enforcePartyOrder {
+		sort.SliceStable(parties, func(i, j int) bool {
+			return partyRank(parties[i].qualifier) < partyRank(parties[j].qualifier)
+		})
+	}
+	
+	for _, party := range parties {
+		partyNAD, err := g.buildPartyNAD(ctx, party.qualifier, party.address)
+		if err := e.emit(partyNAD, err, party.qualifier+" NAD"); err != nil {
+			return err
+		}
+		
+		if party.qualifier == PartyDelivery {
+			if err := g.writeDeliveryWindows(ctx, party.address, e); err != nil {
+				return err
+			}
+		}
+	}
+	
+	if err := e.emitAll(order.ExtraSegments[AnchorAfterHeaderNAD]); err != nil {
+		return err
+	}
+	
+	if order.DeliveryTerms != "" || order.DeliveryTermsCode != "" {
+		tod, err := g.builder().BuildTOD(ctx, order)
+		if err := e.emit(tod, err, "TOD"); err != nil {
+			return err
+		}
+	}
+	
+	if order.PaymentTerms != "" || order.PaymentTermsCode != "" {
+		pat, err := g.builder().BuildPAT(ctx, order)
+		if err := e.emit(pat, err, "PAT"); err != nil {
+			return err
+		}
+	}
+	
+	for _, inst := range order.PaymentInstalments {
+		pat, err := buildOptional(ctx, g, "InstalmentPAT", func(ctx context.Context, b InstalmentPATBuilder) (EDISegment, error) {
+			return b.BuildInstalmentPAT(ctx, inst)
+		})
+		if err := e.emit(pat, err, "instalment PAT"); err != nil {
+			return err
+		}
+		
+		if !inst.DueDate.IsZero() {
+			dueDTM, err := g.builder().BuildDTM(ctx, inst.DueDate, QualifierTermsDueDate)
+			if err := e.emit(dueDTM, err, "instalment DTM"); err != nil {
+				return err
+			}
+		}
+		
+		pcd, err := buildOptional(ctx, g, "PCD", func(ctx context.Context, b PCDBuilder) (EDISegment, error) {
+			return b.BuildPCD(ctx, PercentageInstalment, inst.Percentage)
+		})
+		if err := e.emit(pcd, err, "instalment PCD"); err != nil {
+			return err
+		}
+		
+		if inst.Amount != 0 {
+			moa, err := buildOptional(ctx, g, "MOAAmount", func(ctx context.Context, b MOAAmountBuilder) (EDISegment, error) {
+				return b.BuildMOAAmount(ctx, AmountInstalment, inst.Amount)
+			})
+			if err := e.emit(moa, err, "instalment MOA"); err != nil {
+				return err
+			}
+		}
+	}
+	
+	if order.PaymentInstructions != nil {
+		pai, err := buildOptional(ctx, g, "PAI", func(ctx context.Context, b PAIBuilder) (EDISegment, error) {
+			return b.BuildPAI(ctx, *order.PaymentInstructions)
+		})
+		if err := e.emit(pai, err, "PAI"); err != nil {
+			return err
+		}
+	}
+	
+	for _, code := range order.RequirementConditions {
+		rcs, err := buildOptional(ctx, g, "RCS", func(ctx context.Context, b RCSBuilder) (EDISegment, error) {
+			return b.BuildRCS(ctx, code)
+		})
+		if err := e.emit(rcs, err, "RCS"); err != nil {
+			return err
+		}
+	}
+	
+	if order.TransportMode != "" || order.TransportModeCode != "" {
+		tdt, err := g.builder().BuildTDT(ctx, order)
+		if err := e.emit(tdt, err, "TDT"); err != nil {
+			return err
+		}
+	}
+	
+	for _, item := range order.Items {
+		select {
+		case <-ctx.Done():
+			return ErrContextCancelled
+		default:
+		}
+		
+		lin, err := g.builder().BuildLIN(ctx, item)
+		if err := e.emit(lin, err, "LIN"); err != nil {
+			return err
+		}
+		
+		if err := g.writeReferences(ctx, item.LineRefs, e); err != nil {
+			return err
+		}
+		
+		if item.ScheduleRef != "" {
+			scheduleRFF, err := buildOptional(ctx, g, "RFF", func(ctx context.Context, b RFFBuilder) (EDISegment, error) {
+				return b.BuildRFF(ctx, ReferenceDeliverySchedule, item.ScheduleRef)
+			})
+			if err := e.emit(scheduleRFF, err, "line schedule RFF"); err != nil {
+				return err
+			}
+		}
+		
+		for _, tag := range g.lineOrder() {
+			if err := g.writeLineGroup(ctx, order, item, tag, e); err != nil {
+				return err
+			}
+		}
+		
+		if err := g.writeReferences(ctx, item.References, e); err != nil {
+			return err
+		}
+		
+		schedule, err := NormalizeSchedule(item.DeliverySchedule)
+		if err != nil {
+			return err
+		}
+		
+		for _, entry := range schedule {
+			scc, err := buildOptional(ctx, g, "SCC", func(ctx context.Context, b SCCBuilder) (EDISegment, error) {
+				return b.BuildSCC(ctx, entry)
+			})
+			if err := e.emit(scc, err, "SCC"); err != nil {
+				return err
+			}
+			
+			scheduleQTY, err := g.builder().BuildQTY(ctx, EDIOrderItem{Quantity: entry.Quantity, UnitOfMeasure: item.UnitOfMeasure})
+			if err := e.emit(scheduleQTY, err, "schedule QTY"); err != nil {
+				return err
+			}
+			
+			fromDTM, err := g.builder().BuildDTM(ctx, entry.From, QualifierLineDeliveryDate)
+			if err := e.emit(fromDTM, err, "schedule DTM"); err != nil {
+				return err
+			}
+			
+			if !entry.To.IsZero() {
+				toDTM, err := g.builder().BuildDTM(ctx, entry.To, QualifierLatestDeliveryDate)
+				if err := e.emit(toDTM, err, "schedule DTM"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	
+	uns := EDISegment{Tag: SegmentTagUNS, Elements: []string{"S"}}
+	if err := e.emit(uns, nil, "UNS"); err != nil {
+		return err
+	}
+	
+	if len(order.ControlTotals) == 0 {
+		cnt, err := g.builder().BuildCNT(ctx, order)
+		if err := e.emit(cnt, err, "CNT"); err != nil {
+			return err
+		}
+		
+		if g.quantityControlTotal {
+			quantityCNT, err := buildOptional(ctx, g, "ControlTotal", func(ctx context.Context, b ControlTotalBuilder) (EDISegment, error) {
+				return b.BuildControlTotal(ctx, order, ControlTotal{Qualifier: ControlTotalQuantity, Selector: ControlSelectQuantity})
+			})
+			if err := e.emit(quantityCNT, err, "quantity CNT"); err != nil {
+				return err
+			}
+		}
+	}
+	
+	for _, total := range order.ControlTotals {
+		cnt, err := buildOptional(ctx, g, "ControlTotal", func(ctx context.Context, b ControlTotalBuilder) (EDISegment, error) {
+			return b.BuildControlTotal(ctx, order, total)
+		})
+		if err := e.emit(cnt, err, "CNT"); err != nil {
+			return err
+		}
+	}
+	
+	moaTotal, err := g.builder().BuildMOATotal(ctx, order)
+	if err := e.emit(moaTotal, err, "MOA total"); err != nil {
+		return err
+	}
+	
+	if order.SamplingParams != nil {
+		sps, err := buildOptional(ctx, g, "SPS", func(ctx context.Context, b SPSBuilder) (EDISegment, error) {
+			return b.BuildSPS(ctx, *order.SamplingParams)
+		})
+		if err := e.emit(sps, err, "SPS"); err != nil {
+			return err
+		}
+	}
+	
+	if err := e.emitAll(order.ExtraSegments[AnchorInSummary]); err != nil {
+		return err
+	}
+	
+	unt, err := g.builder().BuildUNT(ctx, order, g.untCount(e, start))
+	if err := e.emit(unt, err, "UNT"); err != nil {
+		return err
+	}
+	
+	return nil
+}
+
+func (g *EDIFACTOrderGenerator) untCount(e *segmentEmitter, start int) int {
+	count := e.count - start + 1
+	if g.legacyUNTCount {
+		count--
+	}
+	return count
+}
+
+func (g *EDIFACTOrderGenerator) lineOrder() []string {
+	if len(g.lineSegmentOrder) == 0 {
+		return defaultLineSegmentOrder
+	}
+	return g.lineSegmentOrder
+}
+
+func (g *EDIFACTOrderGenerator) writeLineGroup(ctx context.Context, order EDIOrder, item EDIOrderItem, tag string, e *segmentEmitter) error {
+	switch tag {
+	case SegmentTagIMD:
+		if len(item.IMDs) == 0 || item.Description != "" || item.ItemDescriptionCode != "" {
+			imd, err := g.builder().BuildIMD(ctx, item)
+			if err := e.emit(imd, err, "IMD"); err != nil {
+				return err
+			}
+		}
+		
+		for _, desc := range item.IMDs {
+			imd, err := buildOptional(ctx, g, "ItemDescription", func(ctx context.Context, b ItemDescriptionBuilder) (EDISegment, error) {
+				return b.BuildItemDescription(ctx, desc)
+			})
+			if err := e.emit(imd, err, "IMD"); err != nil {
+				return err
+			}
+		}
+	case SegmentTagQTY:
+		qty, err := g.builder().BuildQTY(ctx, item)
+		if err := e.emit(qty, err, "QTY"); err != nil {
+			return err
+		}
+		
+		if item.ReturnedQuantity != 0 {
+			returnedQTY, err := buildOptional(ctx, g, "ReturnedQTY", func(ctx context.Context, b ReturnedQTYBuilder) (EDISegment, error) {
+				return b.BuildReturnedQTY(ctx, item)
+			})
+			if err := e.emit(returnedQTY, err, "returned QTY"); err != nil {
+				return err
+			}
+		}
+		
+		for _, metered := range item.MeteredQuantities {
+			mtq, err := buildOptional(ctx, g, "MTQ", func(ctx context.Context, b MTQBuilder) (EDISegment, error) {
+				return b.BuildMTQ(ctx, metered)
+			})
+			if err := e.emit(mtq, err, "MTQ"); err != nil {
+				return err
+			}
+		}
+	case SegmentTagPRI:
+		if item.UnitPrice != 0 || g.zeroPriceMode != ZeroPriceOmit {
+			pri, err := g.builder().BuildPRI(ctx, item)
+			if err := e.emit(pri, err, "PRI"); err != nil {
+				return err
+			}
+		}
+		
+		for _, pb := range item.PriceBreaks {
+			breakPRI, err := g.builder().BuildPRI(ctx, EDIOrderItem{UnitPrice: pb.Price})
+			if err := e.emit(breakPRI, err, "price break PRI"); err != nil {
+				return err
+			}
+			
+			apr, err := buildOptional(ctx, g, "APR", func(ctx context.Context, b PriceBreakBuilder) (EDISegment, error) {
+				return b.BuildAPR(ctx, pb)
+			})
+			if err := e.emit(apr, err, "APR"); err != nil {
+				return err
+			}
+			
+			rng, err := buildOptional(ctx, g, "RNG", func(ctx context.Context, b PriceBreakBuilder) (EDISegment, error) {
+				return b.BuildRNG(ctx, pb, item.UnitOfMeasure)
+			})
+			if err := e.emit(rng, err, "RNG"); err != nil {
+				return err
+			}
+		}
+	case SegmentTagALC:
+		if item.Discount != 0 {
+			if err := g.writeAllowanceCharge(ctx, item, e); err != nil {
+				return err
+			}
+		}
+	case SegmentTagMOA:
+		moa, err := g.builder().BuildMOA(ctx, item)
+		if err := e.emit(moa, err, "MOA"); err != nil {
+			return err
+		}
+		
+		if err := e.emitAll(order.ExtraSegments[AnchorPerLineAfterMOA]); err != nil {
+			return err
+		}
+	case SegmentTagTDT:
+		if item.LineTransportMode != "" || item.LineCarrierCode != "" {
+			lineTDT, err := buildOptional(ctx, g, "LineTDT", func(ctx context.Context, b LineTDTBuilder) (EDISegment, error) {
+				return b.BuildLineTDT(ctx, item)
+			})
+			if err := e.emit(lineTDT, err, "line TDT"); err != nil {
+				return err
+			}
+		}
+	case SegmentTagDTM:
+		if !item.DeliveryDate.IsZero() {
+			itemDTM, err := g.builder().BuildDTM(ctx, item.DeliveryDate, QualifierLineDeliveryDate)
+			if err := e.emit(itemDTM, err, "item DTM"); err != nil {
+				return err
+			}
+		}
+		
+		for _, d := range item.Dates {
+			lineDTM, err := g.builder().BuildDTM(ctx, d.Date, d.Qualifier)
+			if err := e.emit(lineDTM, err, "line DTM"); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported line segment %q", tag)
+	}
+	return nil
+}
+
+func (g *EDIFACTOrderGenerator) writeSegment(segment EDISegment, writer io.Writer) error {
+	data, err := g.renderSegment(segment)
+	if err != nil {
+		return err
+	}
+	
+	return writeFull(writer, data)
+}
+
+func writeFull(writer io.Writer, data []byte) error {
+	n, err := writer.Write(data)
+	if err != nil {
+		return err
+	}
+	if n < len(data) {
+		return fmt.Errorf("%w: wrote %d of %d bytes", io.ErrShortWrite, n, len(data))
+	}
+	return nil
+}
+
+func (g *EDIFACTOrderGenerator) renderSegment(segment EDISegment) ([]byte, error) {
+	builder := g.pool.Get().(*strings.Builder)
+	builder.Reset()
+	defer g.pool.Put(builder)
+	
+	str, err := g.segmentLine(segment)
+	if err != nil {
+		return nil, err
+	}
+	
+	builder.WriteString(str)
+	builder.WriteString("\n")
+	
+	data, err := g.encoding.Encode(builder.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s segment: %w", segment.Tag, err)
+	}
+	
+	return data, nil
+}
+
+func (g *EDIFACTOrderGenerator) segmentLine(segment EDISegment) (string, error) {
+	str := g.segmentText(segment)
+	if len(str) > MaxSegmentLength {
+		if !g.truncateLongSegments {
+			return "", ErrSegmentTooLong
+		}
+		str, _ = g.BuildTruncating(segment, MaxSegmentLength)
+	}
+	return str, nil
+}
+
+func (g *EDIFACTOrderGenerator) segmentText(segment EDISegment) string {
+	repetition := ""
+	if g.syntaxVersion4 {
+		repetition = g.repetitionSeparator
+	}
+	return segment.render(g.elementSeparator, g.componentSeparator, repetition, g.segmentTerminator, g.releaseCharacter)
+}
+
+func (g *EDIFACTOrderGenerator) BuildTruncating(segment EDISegment, maxLen int) (string, bool) {
+	str := g.segmentText(segment)
+	if len(str) <= maxLen {
+		return str, false
+	}
+	
+	elements := append([]string(nil), segment.Elements...)
+	for len(elements) > 0 {
+		last := len(elements) - 1
+		runes := []rune(elements[last])
+		render := func(n int) string {
+			elements[last] = string(runes[:n])
+			return g.segmentText(EDISegment{Tag: segment.Tag, Elements: elements})
+		}
+		
+		keep := sort.Search(len(runes)+1, func(n int) bool {
+			return len(render(n)) > maxLen
+		}) - 1
+		if keep >= 0 {
+			return render(keep), true
+		}
+		elements = elements[:last]
+	}
+	
+	return g.segmentText(EDISegment{Tag: segment.Tag}), true
+}
+
+func (b *DefaultSegmentBuilder) BuildUNB(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	syntaxID := "UNOA"
+	syntaxVersion := "2"
+	if b.generator.syntaxVersion4 {
+		syntaxVersion = "4"
+	}
+	if order.SyntaxIdentifier != "" {
+		syntaxID = order.SyntaxIdentifier
+	}
+	if order.SyntaxVersion != "" {
+		syntaxVersion = order.SyntaxVersion
+	}
+	if b.generator.syntaxVersion4 && syntaxVersion != "4" {
+		return EDISegment{}, &ValidationError{Field: "EDIOrder.SyntaxVersion", Message: fmt.Sprintf("syntax version %s conflicts with syntax version 4 mode", syntaxVersion)}
+	}
+	
+	date := order.OrderDate.Format(unbDateFormat(syntaxID, syntaxVersion))
+	time := order.OrderDate.Format(DateFormatHHMM)
+	
+	testIndicator := ""
+	if order.TestIndicator == IndicatorTest {
+		testIndicator = "1"
+	}
+	
+	sender := order.InterchangeSenderID
+	if order.InterchangeSenderQualifier != "" {
+		sender = joinComponents(sender, order.InterchangeSenderQualifier)
+	}
+	receiver := order.InterchangeReceiverID
+	if order.InterchangeReceiverQualifier != "" {
+		receiver = joinComponents(receiver, order.InterchangeReceiverQualifier)
+	}
+	
+	applicationRef := b.generator.applicationReference(order)
+	
+	if b.generator.syntaxVersion4 {
+		elements := []string{
+			joinComponents(syntaxID, syntaxVersion),
+			sender,
+			receiver,
+			joinComponents(date, time),
+			order.InterchangeControlRef,
+		}
+		if applicationRef != "" || testIndicator != "" {
+			elements = append(elements, "", applicationRef)
+		}
+		if testIndicator != "" {
+			elements = append(elements, "", "", "", testIndicator)
+		}
+		return EDISegment{Tag: SegmentTagUNB, Elements: elements}, nil
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagUNB,
+		Elements: []string{
+			joinComponents(syntaxID, syntaxVersion),
+			sender,
+			receiver,
+			date,
+			time,
+			order.InterchangeControlRef,
+			"",
+			applicationRef,
+			testIndicator,
+		},
+	}, nil
+}
+
+func unbDateFormat(syntaxID, syntaxVersion string) string {
+	if syntaxID == "UNOA" {
+		if version, err := strconv.Atoi(syntaxVersion); err != nil || version < 4 {
+			return DateFormatYYMMDD
+		}
+	}
+	return DateFormatCCYYMMDD
+}
+
+func (b *DefaultSegmentBuilder) BuildUNH(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	key := order.messageTypeKey()
+	associationCode := "EAN008"
+	if order.AssociationCode != "" {
+		associationCode = order.AssociationCode
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagUNH,
+		Elements: []string{
+			order.MessageRefNumber,
+			joinComponents(key.Type, key.Version, key.Release, key.Agency, associationCode),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildBGM(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	documentID := order.OrderNumber
+	if order.OrderVersion != "" || order.OrderRevision != "" {
+		parts := []string{order.OrderNumber, order.OrderVersion}
+		if order.OrderRevision != "" {
+			parts = append(parts, order.OrderRevision)
+		}
+		documentID = joinComponents(parts...)
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagBGM,
+		Elements: []string{
+			CodeOrder,
+			documentID,
+			CodeOriginal,
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildDTM(ctx context.Context, date time.Time, qualifier string) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	formattedDate := date.Format(DateFormatCCYYMMDD)
+	return EDISegment{
+		Tag: SegmentTagDTM,
+		Elements: []string{
+			joinComponents(qualifier, formattedDate, "102"),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildCUX(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	qualifier := CurrencyReference
+	if order.CurrencyQualifier != "" {
+		qualifier = order.CurrencyQualifier
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagCUX,
+		Elements: []string{
+			joinComponents(qualifier, order.Currency, "9"),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildNAD(ctx context.Context, partyQualifier string, address Address) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	elements := []string{partyQualifier}
+	
+	idType := IDTypeBuyer
+	if address.IDType != "" {
+		idType = address.IDType
+	}
+	
+	if idType == IDTypeBIC {
+		bic := address.BICCode
+		if bic == "" {
+			bic = address.ID
+		}
+		if !isValidBIC(bic) {
+			return EDISegment{}, &ValidationError{Field: "Address.BICCode", Message: fmt.Sprintf("BIC %q must be 8 or 11 alphanumeric characters", bic)}
+		}
+		elements = append(elements, joinComponents(bic, "", idType))
+	} else if address.ID != "" {
+		elements = append(elements, joinComponents(address.ID, "", idType))
+	} else {
+		elements = append(elements, "")
+	}
+	
+	if address.isStructured() {
+		elements = append(elements,
+			joinComponents(address.Lines...),
+			address.Name,
+			joinComponents(address.StreetLines...),
+			address.City,
+			address.Region,
+			address.PostalCode,
+			address.CountryCode,
+		)
+		for len(elements) > 0 && elements[len(elements)-1] == "" {
+			elements = elements[:len(elements)-1]
+		}
+		return EDISegment{Tag: SegmentTagNAD, Elements: elements}, nil
+	}
+	
+	addrStr := joinComponents(address.Lines...)
+	elements = append(elements, addrStr, "", address.Name)
+	
+	return EDISegment{Tag: SegmentTagNAD, Elements: elements}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildNADLocation(ctx context.Context, partyQualifier, locode string) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	if !isValidLocode(locode) {
+		return EDISegment{}, &ValidationError{Field: "Address.LocationCode", Message: fmt.Sprintf("location code %q is not a valid UN/LOCODE", locode)}
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagNAD,
+		Elements: []string{
+			partyQualifier,
+			joinComponents(locode, "", IDTypeLocode),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildTOD(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	elements := []string{"3", ""}
+	
+	if order.DeliveryTermsCode != "" {
+		elements = append(elements, joinComponents("", "", order.DeliveryTermsCode))
+	} else {
+		elements = append(elements, joinComponents("", "", order.DeliveryTerms))
+	}
+	
+	if order.DeliveryTermsLocation != "" {
+		elements = append(elements, order.DeliveryTermsLocation)
+	}
+	
+	return EDISegment{Tag: SegmentTagTOD, Elements: elements}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildPAT(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	elements := []string{"1", ""}
+	
+	if order.PaymentTermsCode != "" {
+		elements = append(elements, order.PaymentTermsCode)
+	} else {
+		elements = append(elements, order.PaymentTerms)
+	}
+	
+	return EDISegment{Tag: SegmentTagPAT, Elements: elements}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildTDT(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	elements := []string{"20", "1", ""}
+	
+	if order.TransportModeCode != "" {
+		elements = append(elements, order.TransportModeCode)
+	} else {
+		elements = append(elements, order.TransportMode)
+	}
+	
+	return EDISegment{Tag: SegmentTagTDT, Elements: elements}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildLIN(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	elements := []string{
+		strconv.Itoa(item.LineNumber),
+		"",
+		joinComponents(item.BuyerItemCode, ItemNumberEAN),
+		"",
+	}
+	
+	if item.SupplierItemCode != "" {
+		elements = append(elements, joinComponents(item.SupplierItemCode, ItemNumberSupplier))
+	} else {
+		elements = append(elements, "")
+	}
+	
+	if item.EANCode != "" {
+		elements = append(elements, joinComponents(item.EANCode, ItemNumberEAN))
+	}
+	
+	return EDISegment{Tag: SegmentTagLIN, Elements: elements}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildIMD(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	if item.IMDFormatCode != "" && !imdFormatCodes[item.IMDFormatCode] {
+		return EDISegment{}, &ValidationError{Field: "EDIOrderItem.IMDFormatCode", Message: fmt.Sprintf("unknown IMD format code %q", item.IMDFormatCode)}
+	}
+	
+	if item.ItemDescriptionCode != "" {
+		format := ItemFormatCoded
+		if item.Description != "" {
+			format = ItemFormatBoth
+		}
+		if item.IMDFormatCode != "" {
+			format = item.IMDFormatCode
+		}
+		
+		description := item.Description
+		if format == ItemFormatCoded {
+			description = ""
+		}
+		
+		components := []string{item.ItemDescriptionCode, item.ItemDescriptionCodeList, item.ItemDescriptionAgency, description}
+		for len(components) > 1 && components[len(components)-1] == "" {
+			components = components[:len(components)-1]
+		}
+		
+		return EDISegment{
+			Tag: SegmentTagIMD,
+			Elements: []string{
+				format,
+				"",
+				"",
+				joinComponents(components...),
+			},
+		}, nil
+	}
+	
+	format := ItemFormatFreeText
+	if item.IMDFormatCode != "" {
+		format = item.IMDFormatCode
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagIMD,
+		Elements: []string{
+			format,
+			"",
+			"",
+			joinComponents("", "", "", item.Description),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildQTY(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return b.quantitySegment("EDIOrderItem.Quantity", QuantityOrdered, item.Quantity, item.UnitOfMeasure)
+}
+
+func (b *DefaultSegmentBuilder) quantitySegment(field, qualifier string, quantity float64, uom string) (EDISegment, error) {
+	if uom == "" {
+		uom = "PCE"
+	}
+	
+	quantityStr := b.generator.formatSigned(quantity, b.generator.quantityPrecisionFor(uom))
+	if err := checkNumericLength(field, quantityStr, MaxQuantityDigits); err != nil {
+		return EDISegment{}, err
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagQTY,
+		Elements: []string{
+			joinComponents(qualifier, quantityStr, uom),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildPRI(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	priceStr := strconv.FormatFloat(item.UnitPrice, 'f', 2, 64)
+	if err := checkNumericLength("EDIOrderItem.UnitPrice", priceStr, MaxPriceDigits); err != nil {
+		return EDISegment{}, err
+	}
+	
+	qualifier := PriceNet
+	if item.UnitPrice == 0 && b.generator.zeroPriceMode == ZeroPriceFreeGoods {
+		qualifier = PriceFreeGoods
+	}
+	
+	composite := joinComponents(qualifier, priceStr)
+	if item.PriceBasisQuantity != 0 || item.PriceBasisUOM != "" {
+		basis := ""
+		if item.PriceBasisQuantity != 0 {
+			basis = strconv.FormatFloat(item.PriceBasisQuantity, 'f', -1, 64)
+		}
+		composite = joinComponents(composite, "", "", basis)
+		if item.PriceBasisUOM != "" {
+			composite = joinComponents(composite, item.PriceBasisUOM)
+		}
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagPRI,
+		Elements: []string{
+			composite,
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildMOA(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	amountStr := b.generator.formatSigned(item.Amount, 2)
+	if err := checkNumericLength("EDIOrderItem.Amount", amountStr, MaxAmountDigits); err != nil {
+		return EDISegment{}, err
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagMOA,
+		Elements: []string{
+			joinComponents(AmountLine, amountStr),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildCNT(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagCNT,
+		Elements: []string{
+			joinComponents(ControlTotalLines, strconv.Itoa(order.TotalLines)),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildMOATotal(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	amountStr := b.generator.formatSigned(order.TotalAmount, 2)
+	if err := checkNumericLength("EDIOrder.TotalAmount", amountStr, MaxAmountDigits); err != nil {
+		return EDISegment{}, err
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagMOA,
+		Elements: []string{
+			joinComponents(AmountTotal, amountStr),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildUNT(ctx context.Context, order EDIOrder, segmentCount int) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagUNT,
+		Elements: []string{
+			strconv.Itoa(segmentCount),
+			order.MessageRefNumber,
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildUNZ(ctx context.Context, order EDIOrder, messageCount int) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagUNZ,
+		Elements: []string{
+			strconv.Itoa(messageCount),
+			order.InterchangeControlRef,
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildSCC(ctx context.Context, entry ScheduleEntry) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	elements := []string{ScheduleFirm}
+	if entry.Frequency != "" {
+		elements = append(elements, "", entry.Frequency)
+	}
+	
+	return EDISegment{Tag: SegmentTagSCC, Elements: elements}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildMTQ(ctx context.Context, mtq MeteredQty) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	composite := joinComponents(mtq.Qualifier, mtq.Quantity)
+	if mtq.UOM != "" {
+		composite = joinComponents(composite, mtq.UOM)
+	}
+	
+	return EDISegment{Tag: SegmentTagMTQ, Elements: []string{composite}}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildRFF(ctx context.Context, qualifier, reference string) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagRFF,
+		Elements: []string{
+			joinComponents(qualifier, reference),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildAPR(ctx context.Context, pb PriceBreak) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	tradeClass := TradeClassWholesale
+	if pb.TradeClass != "" {
+		tradeClass = pb.TradeClass
+	}
+	
+	return EDISegment{Tag: SegmentTagAPR, Elements: []string{tradeClass}}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildRNG(ctx context.Context, pb PriceBreak, uom string) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	if uom == "" {
+		uom = "PCE"
+	}
+	
+	precision := b.generator.quantityPrecisionFor(uom)
+	composite := joinComponents(uom, strconv.FormatFloat(pb.MinQuantity, 'f', precision, 64))
+	if pb.MaxQuantity != 0 {
+		composite = joinComponents(composite, strconv.FormatFloat(pb.MaxQuantity, 'f', precision, 64))
+	}
+	
+	return EDISegment{Tag: SegmentTagRNG, Elements: []string{RangeQuantity, composite}}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildControlTotal(ctx context.Context, order EDIOrder, total ControlTotal) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	var value string
+	switch total.Selector {
+	case ControlSelectLines:
+		value = strconv.Itoa(len(order.Items))
+	case ControlSelectQuantity:
+		value = strconv.FormatFloat(order.computedTotalQuantity(), 'f', b.generator.quantityPrecision, 64)
+	case ControlSelectPackages:
+		packages := 0
+		for _, item := range order.Items {
+			packages += item.PackageCount
+		}
+		value = strconv.Itoa(packages)
+	default:
+		return EDISegment{}, fmt.Errorf("unknown control total selector %q", total.Selector)
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagCNT,
+		Elements: []string{
+			joinComponents(total.Qualifier, value),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildALC(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	if item.Discount < 0 {
+		return EDISegment{
+			Tag:      SegmentTagALC,
+			Elements: []string{ChargeIndicator, "", "", AllowanceSequence},
+		}, nil
+	}
+	
+	return EDISegment{
+		Tag:      SegmentTagALC,
+		Elements: []string{AllowanceIndicator, "", "", AllowanceSequence, AllowanceServiceDiscount},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildBUS(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagBUS,
+		Elements: []string{
+			joinComponents(BusinessFunctionUnderlying, order.BusinessFunction),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildInstalmentPAT(ctx context.Context, inst Instalment) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	elements := []string{PaymentTermsBasic}
+	if inst.TermsCode != "" {
+		elements = append(elements, "", inst.TermsCode)
+	}
+	
+	return EDISegment{Tag: SegmentTagPAT, Elements: elements}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildPCD(ctx context.Context, qualifier string, percentage float64) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagPCD,
+		Elements: []string{
+			joinComponents(qualifier, strconv.FormatFloat(percentage, 'f', -1, 64)),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildMOAAmount(ctx context.Context, qualifier string, amount float64) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	amountStr := b.generator.formatSigned(amount, 2)
+	if err := checkNumericLength("MOA."+qualifier, amountStr, MaxAmountDigits); err != nil {
+		return EDISegment{}, err
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagMOA,
+		Elements: []string{
+			joinComponents(qualifier, amountStr),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildItemDescription(ctx context.Context, desc ItemDescription) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	format := ItemFormatFreeText
+	switch {
+	case desc.Code != "" && desc.Text != "":
+		format = ItemFormatBoth
+	case desc.Code != "":
+		format = ItemFormatCoded
+	}
+	
+	components := []string{desc.Code, desc.CodeList, desc.Agency, desc.Text, "", desc.Language}
+	for len(components) > 1 && components[len(components)-1] == "" {
+		components = components[:len(components)-1]
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagIMD,
+		Elements: []string{
+			format,
+			desc.Characteristic,
+			"",
+			joinComponents(components...),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildLineTDT(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	elements := []string{"20", "1", "", item.LineTransportMode}
+	if item.LineCarrierCode != "" {
+		elements = append(elements, item.LineCarrierCode)
+	}
+	
+	return EDISegment{Tag: SegmentTagTDT, Elements: elements}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildLOC(ctx context.Context, location string) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{Tag: SegmentTagLOC, Elements: []string{location}}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildDockWindowDTM(ctx context.Context, window DockWindow) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagDTM,
+		Elements: []string{
+			joinComponents(QualifierLineDeliveryDate, window.TimeFrom+"-"+window.TimeTo, FormatCodeTimeWindow),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildRCS(ctx context.Context, code string) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	if !requirementSectorCodes[code] {
+		return EDISegment{}, &ValidationError{Field: "EDIOrder.RequirementConditions", Message: fmt.Sprintf("requirement code %q is not in the supported 7293 code list", code)}
+	}
+	
+	return EDISegment{Tag: SegmentTagRCS, Elements: []string{code}}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildAcknowledgementUNH(ctx context.Context, ack Acknowledgement) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagUNH,
+		Elements: []string{
+			ack.MessageRefNumber,
+			joinComponents(MessageTypeCONTRL, "D", "3", "UN"),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildUCI(ctx context.Context, ack Acknowledgement) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	sender := ack.Original.SenderID
+	if ack.Original.SenderQualifier != "" {
+		sender = joinComponents(sender, ack.Original.SenderQualifier)
+	}
+	receiver := ack.Original.ReceiverID
+	if ack.Original.ReceiverQualifier != "" {
+		receiver = joinComponents(receiver, ack.Original.ReceiverQualifier)
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagUCI,
+		Elements: []string{
+			ack.Original.ControlRef,
+			sender,
+			receiver,
+			ack.action(),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildUCM(ctx context.Context, msg MessageAcknowledgement) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	messageType := msg.MessageType
+	if messageType == "" {
+		messageType = DefaultMessageType
+	}
+	version, release, agency := msg.MessageVersion, msg.MessageRelease, msg.ResponsibleAgency
+	if version == "" {
+		version = "D"
+	}
+	if release == "" {
+		release = "96A"
+	}
+	if agency == "" {
+		agency = "UN"
+	}
+	
+	action := ActionAcknowledged
+	if !msg.Accepted {
+		action = ActionRejected
+	}
+	
+	elements := []string{
+		msg.MessageRefNumber,
+		joinComponents(messageType, version, release, agency),
+		action,
+	}
+	if msg.ErrorCode != "" {
+		elements = append(elements, msg.ErrorCode)
+	}
+	
+	return EDISegment{Tag: SegmentTagUCM, Elements: elements}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildSPS(ctx context.Context, p SamplingParams) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	elements := []string{p.Qualifier, p.Frequency, p.Size}
+	for len(elements) > 1 && elements[len(elements)-1] == "" {
+		elements = elements[:len(elements)-1]
+	}
+	
+	return EDISegment{Tag: SegmentTagSPS, Elements: elements}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildProprietaryHMC(ctx context.Context, order EDIOrder, mac []byte) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{
+		Tag: SegmentTagProprietaryHMC,
+		Elements: []string{
+			order.InterchangeControlRef,
+			hex.EncodeToString(mac),
+		},
+	}, nil
+}
+
+func (b *DefaultSegmentBuilder) BuildReturnedQTY(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return b.quantitySegment("EDIOrderItem.ReturnedQuantity", QuantityReturned, item.ReturnedQuantity, item.UnitOfMeasure)
+}
+
+func (b *DefaultSegmentBuilder) BuildPAI(ctx context.Context, p PaymentInstructions) (EDISegment, error) {
+	select {
+	case <-ctx.Done():
+		return EDISegment{}, ErrContextCancelled
+	default:
+	}
+	
+	return EDISegment{
+		Tag:      SegmentTagPAI,
+		Elements: []string{joinComponents(p.Conditions, p.Guarantee, p.MeansOfPayment)},
+	}, nil
+}
+
+type pendingLine struct {
+	lineNumber int
+	segments   []EDISegment
+}
+
+type lineHeap []pendingLine
+
+func (h lineHeap) Len() int           { return len(h) }
+func (h lineHeap) Less(i, j int) bool { return h[i].lineNumber < h[j].lineNumber }
+func (h lineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *lineHeap) Push(x interface{}) {
+	*h = append(*h, x.(pendingLine))
+}
+
+func (h *lineHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	line := old[n-1]
+	*h = old[:n-1]
+	return line
+}
+
+type OrderedSegmentWriter struct {
+	generator    *EDIFACTOrderGenerator
+	writer       io.Writer
+	expected     []int
+	next         int
+	pending      lineHeap
+	segmentCount int
+	err          error
+	mu           sync.Mutex
+}
+
+func NewOrderedSegmentWriter(generator *EDIFACTOrderGenerator, writer io.Writer, lineNumbers []int) *OrderedSegmentWriter {
+	expected := make([]int, len(lineNumbers))
+	copy(expected, lineNumbers)
+	sort.Ints(expected)
+	
+	return &OrderedSegmentWriter{
+		generator: generator,
+		writer:    writer,
+		expected:  expected,
+	}
+}
+
+func (w *OrderedSegmentWriter) Write(lineNumber int, segments []EDISegment) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	
+	if w.err != nil {
+		return w.err
+	}
+	
+	idx := sort.SearchInts(w.expected, lineNumber)
+	if idx == len(w.expected) || w.expected[idx] != lineNumber || idx < w.next {
+		w.err = fmt.Errorf("%w: %d", ErrUnexpectedLine, lineNumber)
+		return w.err
+	}
+	for _, line := range w.pending {
+		if line.lineNumber == lineNumber {
+			w.err = fmt.Errorf("%w: %d written twice", ErrUnexpectedLine, lineNumber)
+			return w.err
+		}
+	}
+	
+	heap.Push(&w.pending, pendingLine{lineNumber: lineNumber, segments: segments})
+	
+	for w.pending.Len() > 0 && w.next < len(w.expected) && w.pending[0].lineNumber == w.expected[w.next] {
+		line := heap.Pop(&w.pending).(pendingLine)
+		for _, segment := range line.segments {
+			if err := w.generator.writeSegment(segment, w.writer); err != nil {
+				w.err = err
+				return err
+			}
+			w.segmentCount++
+		}
+		w.next++
+	}
+	
+	return nil
+}
+
+func (w *OrderedSegmentWriter) Abort(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *OrderedSegmentWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *OrderedSegmentWriter) SegmentCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.segmentCount
+}
+
+func (w *OrderedSegmentWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	
+	if w.err != nil {
+		return w.err
+	}
+	if w.next != len(w.expected) {
+		return fmt.Errorf("%w: %d of %d lines written", ErrIncompleteOutput, w.next, len(w.expected))
+	}
+	return nil
+}
+
+const (
+	X12ElementSeparator   = "*"
+	X12SegmentTerminator  = "~"
+	X12ComponentSeparator = ">"
+	X12Version            = "004010"
+	X12FunctionalIDRFQ    = "RQ"
+	X12TransactionRFQ     = "840"
+)
+
+var x12UnitsOfMeasure = map[string]string{
+	"PCE": "EA",
+	"KGM": "KG",
+	"LTR": "LT",
+	"MTR": "MR",
+	"BX":  "BX",
+	"CT":  "CT",
+}
+
+type x12Writer struct {
+	writer       io.Writer
+	segmentCount int
+}
+
+func (w *x12Writer) write(tag string, elements ...string) error {
+	for i, elem := range elements {
+		if tag == "ISA" && i == len(elements)-1 {
+			continue
+		}
+		if strings.ContainsAny(elem, X12ElementSeparator+X12SegmentTerminator+X12ComponentSeparator) {
+			return fmt.Errorf("%w: %q in %s segment", ErrInvalidSeparator, elem, tag)
+		}
+	}
 	
-	if len(chars) != 4 {
-		return ErrInvalidSeparator
+	for len(elements) > 0 && elements[len(elements)-1] == "" {
+		elements = elements[:len(elements)-1]
+	}
+	
+	line := tag
+	if len(elements) > 0 {
+		line += X12ElementSeparator + strings.Join(elements, X12ElementSeparator)
 	}
 	
+	if err := writeFull(w.writer, []byte(line+X12SegmentTerminator+"\n")); err != nil {
+		return err
+	}
+	w.segmentCount++
 	return nil
 }
 
-func (g *EDIFACTOrderGenerator) WithCustomSeparators(terminator, element, component, decimal, release string) (*EDIFACTOrderGenerator, error) {
-	g.segmentTerminator = terminator
-	g.elementSeparator = element
-	g.componentSeparator = component
-	g.decimalMark = decimal
-	g.releaseCharacter = release
-	
-	if err := g.validateSeparators(); err != nil {
-		return nil, err
+func x12ControlNumber(ref string) (string, error) {
+	n, err := strconv.ParseUint(ref, 10, 64)
+	if err != nil || n > 999999999 {
+		return "", &ValidationError{Field: "EDIOrder.InterchangeControlRef", Message: "X12 control number must be numeric with at most 9 digits"}
 	}
-	
-	return g, nil
+	return fmt.Sprintf("%09d", n), nil
 }
 
-func (g *EDIFACTOrderGenerator) WithSegmentBuilder(builder SegmentBuilder) *EDIFACTOrderGenerator {
-	g.segmentBuilder = builder
-	return g
+func x12InterchangeID(field, id string) (string, error) {
+	if len(id) > 15 {
+		return "", &ValidationError{Field: field, Message: fmt.Sprintf("X12 interchange ID %q exceeds 15 characters", id)}
+	}
+	return fmt.Sprintf("%-15s", id), nil
 }
 
-func (g *EDIFACTOrderGenerator) Generate(ctx context.Context, order EDIOrder, writer io.Writer) error {
+func x12UnitOfMeasure(uom string) string {
+	if uom == "" {
+		return "EA"
+	}
+	if mapped, ok := x12UnitsOfMeasure[uom]; ok {
+		return mapped
+	}
+	return uom
+}
+
+func (g *EDIFACTOrderGenerator) GenerateX12_840(ctx context.Context, order EDIOrder, writer io.Writer) error {
 	select {
 	case <-ctx.Done():
 		return ErrContextCancelled
 	default:
 	}
 	
-	if err := order.Validate(); err != nil {
+	if err := g.validate(order); err != nil {
 		return fmt.Errorf("order validation failed: %w", err)
 	}
 	
-	segmentCount := 0
-	foundUNH := false
-	
-	unb, err := g.segmentBuilder.BuildUNB(ctx, order)
+	controlNumber, err := x12ControlNumber(order.InterchangeControlRef)
 	if err != nil {
-		return fmt.Errorf("failed to build UNB: %w", err)
+		return err
 	}
-	
-	if err := g.writeSegment(unb, writer); err != nil {
+	senderID, err := x12InterchangeID("EDIOrder.InterchangeSenderID", order.InterchangeSenderID)
+	if err != nil {
 		return err
 	}
-	
-	unh, err := g.segmentBuilder.BuildUNH(ctx, order)
+	receiverID, err := x12InterchangeID("EDIOrder.InterchangeReceiverID", order.InterchangeReceiverID)
 	if err != nil {
-		return fmt.Errorf("failed to build UNH: %w", err)
+		return err
+	}
+	groupControl := strings.TrimLeft(controlNumber, "0")
+	if groupControl == "" {
+		groupControl = "0"
 	}
 	
-	if err := g.writeSegment(unh, writer); err != nil {
-		return err
+	usage := "P"
+	if order.TestIndicator == IndicatorTest {
+		usage = "T"
 	}
-	foundUNH = true
-	segmentCount = 1
 	
-	bgm, err := g.segmentBuilder.BuildBGM(ctx, order)
-	if err != nil {
-		return fmt.Errorf("failed to build BGM: %w", err)
+	w := &x12Writer{writer: writer}
+	
+	if err := w.write("ISA",
+		"00", fmt.Sprintf("%-10s", ""),
+		"00", fmt.Sprintf("%-10s", ""),
+		"ZZ", senderID,
+		"ZZ", receiverID,
+		order.OrderDate.Format(DateFormatYYMMDD),
+		order.OrderDate.Format(DateFormatHHMM),
+		"U", "00401", controlNumber, "0", usage, X12ComponentSeparator,
+	); err != nil {
+		return err
 	}
 	
-	if err := g.writeSegment(bgm, writer); err != nil {
+	if err := w.write("GS", X12FunctionalIDRFQ, order.InterchangeSenderID, order.InterchangeReceiverID,
+		order.OrderDate.Format(DateFormatCCYYMMDD), order.OrderDate.Format(DateFormatHHMM),
+		groupControl, "X", X12Version); err != nil {
 		return err
 	}
-	if foundUNH {
-		segmentCount++
+	
+	transactionControl := order.MessageRefNumber
+	if len(transactionControl) < 4 {
+		transactionControl = strings.Repeat("0", 4-len(transactionControl)) + transactionControl
 	}
 	
-	dtm, err := g.segmentBuilder.BuildDTM(ctx, order.OrderDate, QualifierDocumentDate)
-	if err != nil {
-		return fmt.Errorf("failed to build DTM: %w", err)
+	stStart := w.segmentCount
+	if err := w.write("ST", X12TransactionRFQ, transactionControl); err != nil {
+		return err
 	}
 	
-	if err := g.writeSegment(dtm, writer); err != nil {
+	if err := w.write("BQT", "00", order.OrderNumber, order.OrderDate.Format(DateFormatCCYYMMDD)); err != nil {
 		return err
 	}
-	if foundUNH {
-		segmentCount++
+	
+	if order.Currency != "" {
+		if err := w.write("CUR", "BY", order.Currency); err != nil {
+			return err
+		}
 	}
 	
 	if !order.DeliveryDate.IsZero() {
-		qualifier := QualifierDeliveryDate
-		if order.DeliveryDateQualifier != "" {
-			qualifier = order.DeliveryDateQualifier
+		if err := w.write("DTM", "002", order.DeliveryDate.Format(DateFormatCCYYMMDD)); err != nil {
+			return err
 		}
-		deliveryDTM, err := g.segmentBuilder.BuildDTM(ctx, order.DeliveryDate, qualifier)
-		if err != nil {
-			return fmt.Errorf("failed to build delivery DTM: %w", err)
+	}
+	
+	for _, party := range order.parties() {
+		idQualifier := ""
+		if party.address.ID != "" {
+			idQualifier = "92"
 		}
-		
-		if err := g.writeSegment(deliveryDTM, writer); err != nil {
+		if err := w.write("N1", party.qualifier, party.address.Name, idQualifier, party.address.ID); err != nil {
 			return err
 		}
-		if foundUNH {
-			segmentCount++
+		for i := 0; i < len(party.address.Lines); i += 2 {
+			lines := party.address.Lines[i:min(i+2, len(party.address.Lines))]
+			if err := w.write("N3", lines...); err != nil {
+				return err
+			}
 		}
 	}
 	
-	if order.Currency != "" {
-		cux, err := g.segmentBuilder.BuildCUX(ctx, order)
-		if err != nil {
-			return fmt.Errorf("failed to build CUX: %w", err)
+	for _, item := range order.Items {
+		select {
+		case <-ctx.Done():
+			return ErrContextCancelled
+		default:
 		}
 		
-		if err := g.writeSegment(cux, writer); err != nil {
+		elements := []string{
+			strconv.Itoa(item.LineNumber),
+			strconv.FormatFloat(item.Quantity, 'f', -1, 64),
+			x12UnitOfMeasure(item.UnitOfMeasure),
+			"", "",
+			"BP", item.BuyerItemCode,
+		}
+		if item.SupplierItemCode != "" {
+			elements = append(elements, "VP", item.SupplierItemCode)
+		}
+		if item.EANCode != "" {
+			elements = append(elements, "EN", item.EANCode)
+		}
+		if err := w.write("PO1", elements...); err != nil {
 			return err
 		}
-		if foundUNH {
-			segmentCount++
+		
+		if item.Description != "" {
+			if err := w.write("PID", "F", "", "", "", item.Description); err != nil {
+				return err
+			}
 		}
 	}
 	
-	if order.Buyer.Name != "" {
-		buyerNAD, err := g.segmentBuilder.BuildNAD(ctx, PartyBuyer, order.Buyer)
-		if err != nil {
-			return fmt.Errorf("failed to build buyer NAD: %w", err)
+	if err := w.write("CTT", strconv.Itoa(len(order.Items))); err != nil {
+		return err
+	}
+	
+	if err := w.write("SE", strconv.Itoa(w.segmentCount-stStart+1), transactionControl); err != nil {
+		return err
+	}
+	
+	if err := w.write("GE", "1", groupControl); err != nil {
+		return err
+	}
+	
+	return w.write("IEA", "1", controlNumber)
+}
+
+type X12FieldMapping struct {
+	X12Path    string
+	OrderField string
+	Note       string
+}
+
+var X12_850FieldMappings = []X12FieldMapping{
+	{X12Path: "ISA06", OrderField: "EDIOrder.InterchangeSenderID"},
+	{X12Path: "ISA08", OrderField: "EDIOrder.InterchangeReceiverID"},
+	{X12Path: "ISA13", OrderField: "EDIOrder.InterchangeControlRef", Note: "leading zeros removed"},
+	{X12Path: "ISA15", OrderField: "EDIOrder.TestIndicator", Note: "T maps to IndicatorTest"},
+	{X12Path: "ST02", OrderField: "EDIOrder.MessageRefNumber"},
+	{X12Path: "BEG03", OrderField: "EDIOrder.OrderNumber"},
+	{X12Path: "BEG05", OrderField: "EDIOrder.OrderDate", Note: "CCYYMMDD"},
+	{X12Path: "CUR02", OrderField: "EDIOrder.Currency"},
+	{X12Path: "DTM[002]/DTM02", OrderField: "EDIOrder.DeliveryDate", Note: "delivery requested"},
+	{X12Path: "DTM[004]/DTM02", OrderField: "EDIOrder.OrderDate", Note: "used when BEG05 is empty"},
+	{X12Path: "N1[BY]", OrderField: "EDIOrder.Buyer"},
+	{X12Path: "N1[SE|VN|SU]", OrderField: "EDIOrder.Seller"},
+	{X12Path: "N1[ST|DP]", OrderField: "EDIOrder.Delivery"},
+	{X12Path: "N1[BT|IV]", OrderField: "EDIOrder.Invoice"},
+	{X12Path: "N1[*]", OrderField: "EDIOrder.AdditionalParties", Note: "N101 kept as the party qualifier"},
+	{X12Path: "N1/N102", OrderField: "Address.Name"},
+	{X12Path: "N1/N103", OrderField: "Address.IDType", Note: "UL maps to 9, 1 and 9 map to 16, 92 is kept, others map to ZZZ"},
+	{X12Path: "N1/N104", OrderField: "Address.ID"},
+	{X12Path: "N1/N3", OrderField: "Address.Lines", Note: "Address.StreetLines when N4 is present"},
+	{X12Path: "N1/N4/N401", OrderField: "Address.City"},
+	{X12Path: "N1/N4/N402", OrderField: "Address.Region"},
+	{X12Path: "N1/N4/N403", OrderField: "Address.PostalCode"},
+	{X12Path: "N1/N4/N404", OrderField: "Address.CountryCode"},
+	{X12Path: "PO1/PO101", OrderField: "EDIOrderItem.LineNumber", Note: "falls back to the line position"},
+	{X12Path: "PO1/PO102", OrderField: "EDIOrderItem.Quantity"},
+	{X12Path: "PO1/PO103", OrderField: "EDIOrderItem.UnitOfMeasure", Note: "EA maps to PCE"},
+	{X12Path: "PO1/PO104", OrderField: "EDIOrderItem.UnitPrice"},
+	{X12Path: "PO1[BP|IN]", OrderField: "EDIOrderItem.BuyerItemCode"},
+	{X12Path: "PO1[VP|VN]", OrderField: "EDIOrderItem.SupplierItemCode"},
+	{X12Path: "PO1[EN|UP|UK]", OrderField: "EDIOrderItem.EANCode"},
+	{X12Path: "PO1/PID05", OrderField: "EDIOrderItem.Description"},
+}
+
+type X12Order struct {
+	SenderID           string
+	ReceiverID         string
+	ControlNumber      string
+	Usage              string
+	TransactionControl string
+	BEG                X12BEG
+	Currency           string
+	Dates              []X12DTM
+	Parties            []X12Party
+	Lines              []X12Line
+}
+
+type X12BEG struct {
+	Purpose   string
+	OrderType string
+	PONumber  string
+	Date      string
+}
+
+type X12DTM struct {
+	Qualifier string
+	Date      string
+}
+
+type X12Party struct {
+	EntityCode   string
+	Name         string
+	IDQualifier  string
+	ID           string
+	AddressLines []string
+	City         string
+	State        string
+	PostalCode   string
+	Country      string
+}
+
+type X12Line struct {
+	AssignedID    string
+	Quantity      float64
+	UnitOfMeasure string
+	UnitPrice     float64
+	ProductIDs    []X12ProductID
+	Description   string
+}
+
+type X12ProductID struct {
+	Qualifier string
+	ID        string
+}
+
+var x12PartyIDTypes = map[string]string{
+	"UL": IDTypeBuyer,
+	"1":  "16",
+	"9":  "16",
+	"92": "92",
+}
+
+func FromX12_850(x12 X12Order) EDIOrder {
+	controlRef := strings.TrimLeft(strings.TrimSpace(x12.ControlNumber), "0")
+	if controlRef == "" && x12.ControlNumber != "" {
+		controlRef = "0"
+	}
+	
+	order := EDIOrder{
+		InterchangeSenderID:   strings.TrimSpace(x12.SenderID),
+		InterchangeReceiverID: strings.TrimSpace(x12.ReceiverID),
+		InterchangeControlRef: controlRef,
+		MessageRefNumber:      x12.TransactionControl,
+		OrderNumber:           x12.BEG.PONumber,
+		OrderDate:             parseX12Date(x12.BEG.Date),
+		Currency:              x12.Currency,
+		TestIndicator:         IndicatorProduction,
+	}
+	if x12.Usage == "T" {
+		order.TestIndicator = IndicatorTest
+	}
+	
+	for _, dtm := range x12.Dates {
+		switch dtm.Qualifier {
+		case "002":
+			order.DeliveryDate = parseX12Date(dtm.Date)
+		case "004":
+			if order.OrderDate.IsZero() {
+				order.OrderDate = parseX12Date(dtm.Date)
+			}
+		}
+	}
+	
+	for _, party := range x12.Parties {
+		address := party.address()
+		switch party.EntityCode {
+		case "BY":
+			order.Buyer = address
+		case "SE", "VN", "SU":
+			order.Seller = address
+		case "ST", PartyDelivery:
+			order.Delivery = address
+		case "BT", PartyInvoice:
+			order.Invoice = address
+		default:
+			order.AdditionalParties = append(order.AdditionalParties, Party{Qualifier: party.EntityCode, Address: address})
+		}
+	}
+	
+	for i, line := range x12.Lines {
+		item := EDIOrderItem{
+			Quantity:      line.Quantity,
+			UnitOfMeasure: edifactUnitOfMeasure(line.UnitOfMeasure),
+			UnitPrice:     line.UnitPrice,
+			Description:   line.Description,
 		}
+		if n, err := strconv.Atoi(line.AssignedID); err == nil && n > 0 {
+			item.LineNumber = n
+		} else {
+			item.LineNumber = i + 1
+		}
+		for _, product := range line.ProductIDs {
+			switch product.Qualifier {
+			case "BP", "IN":
+				item.BuyerItemCode = product.ID
+			case "VP", "VN":
+				item.SupplierItemCode = product.ID
+			case "EN", "UP", "UK":
+				item.EANCode = product.ID
+			}
+		}
+		item.ComputeAmount()
 		
-		if err := g.writeSegment(buyerNAD, writer); err != nil {
-			return err
+		order.Items = append(order.Items, item)
+		order.TotalAmount += item.Amount
+		order.TotalQuantity += item.Quantity
+	}
+	order.TotalAmount = math.Round(order.TotalAmount*100) / 100
+	order.TotalLines = len(order.Items)
+	
+	return order
+}
+
+func (p X12Party) address() Address {
+	address := Address{
+		Name:        p.Name,
+		ID:          p.ID,
+		City:        p.City,
+		Region:      p.State,
+		PostalCode:  p.PostalCode,
+		CountryCode: p.Country,
+	}
+	if p.ID != "" {
+		address.IDType = "ZZZ"
+		if idType, ok := x12PartyIDTypes[p.IDQualifier]; ok {
+			address.IDType = idType
+		}
+	}
+	
+	lines := append([]string(nil), p.AddressLines...)
+	if address.isStructured() {
+		address.StreetLines = lines
+	} else {
+		address.Lines = lines
+	}
+	return address
+}
+
+func parseX12Date(value string) time.Time {
+	date, err := time.Parse(DateFormatCCYYMMDD, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+func edifactUnitOfMeasure(uom string) string {
+	if uom == "" || uom == "EA" {
+		return "PCE"
+	}
+	for edifact, x12 := range x12UnitsOfMeasure {
+		if x12 == uom {
+			return edifact
 		}
-		if foundUNH {
-			segmentCount++
+	}
+	return uom
+}
+
+const (
+	RoleBuyer    = "buyer"
+	RoleSeller   = "seller"
+	RoleDelivery = "delivery"
+	RoleInvoice  = "invoice"
+)
+
+type CanonicalParty struct {
+	Role         string
+	Name         string
+	AddressLines []string
+	ID           string
+	IDScheme     string
+}
+
+type CanonicalLine struct {
+	LineNumber       int
+	BuyerItemCode    string
+	SupplierItemCode string
+	EANCode          string
+	Description      string
+	Quantity         float64
+	UnitOfMeasure    string
+	UnitPrice        float64
+	TaxRate          float64
+	Amount           float64
+	DeliveryDate     time.Time
+}
+
+type CanonicalOrder struct {
+	OrderNumber       string
+	OrderDate         time.Time
+	SenderID          string
+	ReceiverID        string
+	Currency          string
+	ContractNumber    string
+	ScheduleID        string
+	Parties           []CanonicalParty
+	DeliveryDate      time.Time
+	DeliveryTerms     string
+	DeliveryTermsCode string
+	DeliveryLocation  string
+	PaymentTerms      string
+	PaymentTermsCode  string
+	TransportMode     string
+	TransportModeCode string
+	Lines             []CanonicalLine
+	TotalAmount       float64
+	Test              bool
+}
+
+func ToCanonical(o EDIOrder) CanonicalOrder {
+	c := CanonicalOrder{
+		OrderNumber:       o.OrderNumber,
+		OrderDate:         o.OrderDate,
+		SenderID:          o.InterchangeSenderID,
+		ReceiverID:        o.InterchangeReceiverID,
+		Currency:          o.Currency,
+		ContractNumber:    o.ContractNumber,
+		ScheduleID:        o.ScheduleID,
+		DeliveryDate:      o.DeliveryDate,
+		DeliveryTerms:     o.DeliveryTerms,
+		DeliveryTermsCode: o.DeliveryTermsCode,
+		DeliveryLocation:  o.DeliveryTermsLocation,
+		PaymentTerms:      o.PaymentTerms,
+		PaymentTermsCode:  o.PaymentTermsCode,
+		TransportMode:     o.TransportMode,
+		TransportModeCode: o.TransportModeCode,
+		TotalAmount:       o.TotalAmount,
+		Test:              o.TestIndicator == IndicatorTest,
+	}
+	
+	roles := map[string]string{
+		PartyBuyer:    RoleBuyer,
+		PartySeller:   RoleSeller,
+		PartyDelivery: RoleDelivery,
+		PartyInvoice:  RoleInvoice,
+	}
+	for _, party := range o.parties() {
+		role, ok := roles[party.qualifier]
+		if !ok || strings.HasPrefix(party.field, "AdditionalParties") {
+			role = party.qualifier
 		}
+		c.Parties = append(c.Parties, CanonicalParty{
+			Role:         role,
+			Name:         party.address.Name,
+			AddressLines: append([]string(nil), party.address.Lines...),
+			ID:           party.address.ID,
+			IDScheme:     party.address.IDType,
+		})
 	}
 	
-	if order.Seller.Name != "" {
-		sellerNAD, err := g.segmentBuilder.BuildNAD(ctx, PartySeller, order.Seller)
-		if err != nil {
-			return fmt.Errorf("failed to build seller NAD: %w", err)
+	for _, item := range o.Items {
+		c.Lines = append(c.Lines, CanonicalLine{
+			LineNumber:       item.LineNumber,
+			BuyerItemCode:    item.BuyerItemCode,
+			SupplierItemCode: item.SupplierItemCode,
+			EANCode:          item.EANCode,
+			Description:      item.Description,
+			Quantity:         item.Quantity,
+			UnitOfMeasure:    item.UnitOfMeasure,
+			UnitPrice:        item.UnitPrice,
+			TaxRate:          item.TaxRate,
+			Amount:           item.Amount,
+			DeliveryDate:     item.DeliveryDate,
+		})
+	}
+	
+	return c
+}
+
+func FromCanonical(c CanonicalOrder) EDIOrder {
+	o := EDIOrder{
+		InterchangeSenderID:   c.SenderID,
+		InterchangeReceiverID: c.ReceiverID,
+		OrderNumber:           c.OrderNumber,
+		OrderDate:             c.OrderDate,
+		Currency:              c.Currency,
+		ContractNumber:        c.ContractNumber,
+		ScheduleID:            c.ScheduleID,
+		DeliveryDate:          c.DeliveryDate,
+		DeliveryTerms:         c.DeliveryTerms,
+		DeliveryTermsCode:     c.DeliveryTermsCode,
+		DeliveryTermsLocation: c.DeliveryLocation,
+		PaymentTerms:          c.PaymentTerms,
+		PaymentTermsCode:      c.PaymentTermsCode,
+		TransportMode:         c.TransportMode,
+		TransportModeCode:     c.TransportModeCode,
+		TotalAmount:           c.TotalAmount,
+		TotalLines:            len(c.Lines),
+	}
+	if c.Test {
+		o.TestIndicator = IndicatorTest
+	}
+	
+	for _, party := range c.Parties {
+		address := Address{
+			Name:   party.Name,
+			Lines:  append([]string(nil), party.AddressLines...),
+			ID:     party.ID,
+			IDType: party.IDScheme,
 		}
-		
-		if err := g.writeSegment(sellerNAD, writer); err != nil {
-			return err
+		switch party.Role {
+		case RoleBuyer:
+			o.Buyer = address
+		case RoleSeller:
+			o.Seller = address
+		case RoleDelivery:
+			o.Delivery = address
+		case RoleInvoice:
+			o.Invoice = address
+		default:
+			o.AdditionalParties = append(o.AdditionalParties, Party{Qualifier: party.Role, Address: address})
 		}
-		if foundUNH {
-			segmentCount++
+	}
+	
+	for _, line := range c.Lines {
+		o.Items = append(o.Items, EDIOrderItem{
+			LineNumber:       line.LineNumber,
+			BuyerItemCode:    line.BuyerItemCode,
+			SupplierItemCode: line.SupplierItemCode,
+			EANCode:          line.EANCode,
+			Description:      line.Description,
+			Quantity:         line.Quantity,
+			UnitOfMeasure:    line.UnitOfMeasure,
+			UnitPrice:        line.UnitPrice,
+			TaxRate:          line.TaxRate,
+			Amount:           line.Amount,
+			DeliveryDate:     line.DeliveryDate,
+		})
+		o.TotalQuantity += line.Quantity
+	}
+	
+	return o
+}
+
+type Delimiters struct {
+	Component  byte
+	Element    byte
+	Decimal    byte
+	Release    byte
+	Repetition byte
+	Terminator byte
+}
+
+var DefaultDelimiters = Delimiters{
+	Component:  ':',
+	Element:    '+',
+	Decimal:    '.',
+	Release:    '?',
+	Repetition: ' ',
+	Terminator: '\'',
+}
+
+const serviceStringAdviceLength = 9
+
+func ParseServiceStringAdvice(header []byte) (Delimiters, bool, error) {
+	if !bytes.HasPrefix(header, []byte(SegmentTagUNA)) {
+		return DefaultDelimiters, false, nil
+	}
+	if len(header) < serviceStringAdviceLength {
+		return Delimiters{}, true, fmt.Errorf("%w: expected %d bytes, got %d", ErrMalformedUNA, serviceStringAdviceLength, len(header))
+	}
+	
+	d := Delimiters{
+		Component:  header[3],
+		Element:    header[4],
+		Decimal:    header[5],
+		Release:    header[6],
+		Repetition: header[7],
+		Terminator: header[8],
+	}
+	
+	seen := make(map[byte]bool)
+	for _, c := range []byte{d.Component, d.Element, d.Release, d.Terminator} {
+		if seen[c] {
+			return Delimiters{}, true, fmt.Errorf("%w: duplicate service character %q", ErrMalformedUNA, c)
 		}
+		seen[c] = true
+	}
+	if d.Decimal != '.' && d.Decimal != ',' {
+		return Delimiters{}, true, fmt.Errorf("%w: invalid decimal mark %q", ErrMalformedUNA, d.Decimal)
 	}
 	
-	if order.Delivery.Name != "" {
-		deliveryNAD, err := g.segmentBuilder.BuildNAD(ctx, PartyDelivery, order.Delivery)
-		if err != nil {
-			return fmt.Errorf("failed to build delivery NAD: %w", err)
+	return d, true, nil
+}
+
+func (d Delimiters) split(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case d.Release:
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
 		}
-		
-		if err := g.writeSegment(deliveryNAD, writer); err != nil {
-			return err
+	}
+	return append(parts, s[start:])
+}
+
+func (d Delimiters) unescape(s string) string {
+	if strings.IndexByte(s, d.Release) < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == d.Release && i+1 < len(s) {
+			i++
 		}
-		if foundUNH {
-			segmentCount++
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func (d Delimiters) Components(element string) []string {
+	parts := d.split(element, d.Component)
+	for i, part := range parts {
+		parts[i] = d.unescape(part)
+	}
+	return parts
+}
+
+func (d Delimiters) ParseNumber(s string) (float64, error) {
+	if d.Decimal != '.' {
+		s = strings.ReplaceAll(s, string(d.Decimal), ".")
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+type SegmentReader struct {
+	reader     *bufio.Reader
+	delimiters Delimiters
+	started    bool
+}
+
+func NewSegmentReader(r io.Reader) *SegmentReader {
+	return &SegmentReader{
+		reader:     bufio.NewReader(r),
+		delimiters: DefaultDelimiters,
+	}
+}
+
+func (s *SegmentReader) Delimiters() Delimiters {
+	return s.delimiters
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+func (s *SegmentReader) skipLeadingJunk() error {
+	if prefix, err := s.reader.Peek(len(utf8BOM)); err == nil && bytes.Equal(prefix, utf8BOM) {
+		if _, err := s.reader.Discard(len(utf8BOM)); err != nil {
+			return err
 		}
 	}
 	
-	if order.Invoice.Name != "" {
-		invoiceNAD, err := g.segmentBuilder.BuildNAD(ctx, PartyInvoice, order.Invoice)
+	for {
+		c, err := s.reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			return fmt.Errorf("failed to build invoice NAD: %w", err)
+			return err
 		}
-		
-		if err := g.writeSegment(invoiceNAD, writer); err != nil {
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return s.reader.UnreadByte()
+		}
+	}
+}
+
+func (s *SegmentReader) readServiceStringAdvice() error {
+	s.started = true
+	
+	if err := s.skipLeadingJunk(); err != nil {
+		return err
+	}
+	
+	header, err := s.reader.Peek(serviceStringAdviceLength)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	
+	delimiters, found, err := ParseServiceStringAdvice(header)
+	if err != nil {
+		return err
+	}
+	if found {
+		if _, err := s.reader.Discard(serviceStringAdviceLength); err != nil {
 			return err
 		}
-		if foundUNH {
-			segmentCount++
+	}
+	s.delimiters = delimiters
+	return nil
+}
+
+func (s *SegmentReader) Next() (EDISegment, error) {
+	if !s.started {
+		if err := s.readServiceStringAdvice(); err != nil {
+			return EDISegment{}, err
 		}
 	}
 	
-	if order.DeliveryTerms != "" || order.DeliveryTermsCode != "" {
-		tod, err := g.segmentBuilder.BuildTOD(ctx, order)
+	var raw []byte
+	escaped := false
+	for {
+		c, err := s.reader.ReadByte()
+		if err == io.EOF {
+			if len(bytes.TrimSpace(raw)) == 0 {
+				return EDISegment{}, io.EOF
+			}
+			return EDISegment{}, fmt.Errorf("%w: unterminated segment %q", io.ErrUnexpectedEOF, raw)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to build TOD: %w", err)
+			return EDISegment{}, err
 		}
 		
-		if err := g.writeSegment(tod, writer); err != nil {
-			return err
+		if len(raw) == 0 && (c == '\r' || c == '\n') {
+			continue
 		}
-		if foundUNH {
-			segmentCount++
+		if escaped {
+			escaped = false
+		} else if c == s.delimiters.Release {
+			escaped = true
+		} else if c == s.delimiters.Terminator {
+			break
+		}
+		raw = append(raw, c)
+	}
+	
+	parts := s.delimiters.split(string(raw), s.delimiters.Element)
+	return EDISegment{Tag: parts[0], Elements: parts[1:]}, nil
+}
+
+type messageDecoder struct {
+	delimiters Delimiters
+	order      EDIOrder
+	item       *EDIOrderItem
+	segments   int
+}
+
+func segmentElement(segment EDISegment, index int) string {
+	if index < len(segment.Elements) {
+		return segment.Elements[index]
+	}
+	return ""
+}
+
+func componentAt(components []string, index int) string {
+	if index < len(components) {
+		return components[index]
+	}
+	return ""
+}
+
+func (m *messageDecoder) element(segment EDISegment, index int) string {
+	return m.delimiters.unescape(segmentElement(segment, index))
+}
+
+func (m *messageDecoder) components(segment EDISegment, index int) []string {
+	return m.delimiters.Components(segmentElement(segment, index))
+}
+
+func (m *messageDecoder) number(segment EDISegment, value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := m.delimiters.ParseNumber(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid number %q in %s segment", ErrMalformedSegment, value, segment.Tag)
+	}
+	return n, nil
+}
+
+func (m *messageDecoder) flushItem() {
+	if m.item != nil {
+		m.order.Items = append(m.order.Items, *m.item)
+		m.item = nil
+	}
+}
+
+func parseDTMValue(value, format string) (time.Time, error) {
+	switch format {
+	case "203":
+		return time.Parse("200601021504", value)
+	case "102", "":
+		return time.Parse(DateFormatCCYYMMDD, value)
+	case "718":
+		from, _, ok := strings.Cut(value, "-")
+		if !ok {
+			return time.Time{}, fmt.Errorf("%w: invalid date range %q", ErrMalformedSegment, value)
 		}
+		return time.Parse(DateFormatCCYYMMDD, from)
+	default:
+		return time.Time{}, fmt.Errorf("%w: unsupported date format %s", ErrMalformedSegment, format)
+	}
+}
+
+func parseTimeWindow(value string) (string, string, error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok || !isDigits(from) || !isDigits(to) {
+		return "", "", fmt.Errorf("%w: invalid time window %q", ErrMalformedSegment, value)
+	}
+	return from, to, nil
+}
+
+func (m *messageDecoder) decodeAddress(segment EDISegment) Address {
+	id := m.components(segment, 1)
+	address := Address{
+		ID:     componentAt(id, 0),
+		IDType: componentAt(id, 2),
+		Name:   m.element(segment, 3),
+		City:   m.element(segment, 5),
+		Region: m.element(segment, 6),
+		PostalCode:  m.element(segment, 7),
+		CountryCode: m.element(segment, 8),
+	}
+	if segmentElement(segment, 2) != "" {
+		address.Lines = m.components(segment, 2)
 	}
 	
-	if order.PaymentTerms != "" || order.PaymentTermsCode != "" {
-		pat, err := g.segmentBuilder.BuildPAT(ctx, order)
-		if err != nil {
-			return fmt.Errorf("failed to build PAT: %w", err)
-		}
-		
-		if err := g.writeSegment(pat, writer); err != nil {
-			return err
-		}
-		if foundUNH {
-			segmentCount++
-		}
+	if address.Name == "" {
+		address.Name = m.element(segment, 4)
+	} else if segmentElement(segment, 4) != "" {
+		address.StreetLines = m.components(segment, 4)
 	}
 	
-	if order.TransportMode != "" || order.TransportModeCode != "" {
-		tdt, err := g.segmentBuilder.BuildTDT(ctx, order)
-		if err != nil {
-			return fmt.Errorf("failed to build TDT: %w", err)
-		}
-		
-		if err := g.writeSegment(tdt, writer); err != nil {
-			return err
-		}
-		if foundUNH {
-			segmentCount++
-		}
+	if address.IDType == IDTypeLocode && len(segment.Elements) == 2 {
+		address.LocationCode = address.ID
+		address.ID = ""
+		address.IDType = ""
 	}
+	return address
+}
+
+func (m *messageDecoder) decode(segment EDISegment) error {
+	m.segments++
 	
-	for _, item := range order.Items {
-		select {
-		case <-ctx.Done():
-			return ErrContextCancelled
-		default:
+	switch segment.Tag {
+	case SegmentTagUNH:
+		m.order.MessageRefNumber = m.element(segment, 0)
+		identifier := m.components(segment, 1)
+		m.order.MessageType = componentAt(identifier, 0)
+		m.order.MessageVersion = componentAt(identifier, 1)
+		m.order.MessageRelease = componentAt(identifier, 2)
+		m.order.ResponsibleAgency = componentAt(identifier, 3)
+		m.order.AssociationCode = componentAt(identifier, 4)
+	case SegmentTagBGM:
+		documentID := m.components(segment, 1)
+		m.order.OrderNumber = componentAt(documentID, 0)
+		m.order.OrderVersion = componentAt(documentID, 1)
+		m.order.OrderRevision = componentAt(documentID, 2)
+	case SegmentTagDTM:
+		dtm := m.components(segment, 0)
+		if componentAt(dtm, 2) == FormatCodeTimeWindow {
+			from, to, err := parseTimeWindow(componentAt(dtm, 1))
+			if err != nil {
+				return err
+			}
+			if windows := m.order.Delivery.DeliveryWindows; m.item == nil && len(windows) > 0 {
+				windows[len(windows)-1].TimeFrom = from
+				windows[len(windows)-1].TimeTo = to
+			}
+			return nil
 		}
-		
-		lin, err := g.segmentBuilder.BuildLIN(ctx, item)
+		date, err := parseDTMValue(componentAt(dtm, 1), componentAt(dtm, 2))
 		if err != nil {
-			return fmt.Errorf("failed to build LIN: %w", err)
-		}
-		
-		if err := g.writeSegment(lin, writer); err != nil {
 			return err
 		}
-		if foundUNH {
-			segmentCount++
+		switch qualifier := componentAt(dtm, 0); {
+		case m.item != nil:
+			if qualifier == QualifierLineDeliveryDate {
+				m.item.DeliveryDate = date
+			} else {
+				m.item.Dates = append(m.item.Dates, LineDate{Qualifier: qualifier, Date: date})
+			}
+		case qualifier == QualifierDocumentDate:
+			m.order.OrderDate = date
+		case qualifier == QualifierDeliveryDate:
+			m.order.DeliveryDate = date
 		}
-		
-		imd, err := g.segmentBuilder.BuildIMD(ctx, item)
-		if err != nil {
-			return fmt.Errorf("failed to build IMD: %w", err)
+	case SegmentTagCUX:
+		cux := m.components(segment, 0)
+		m.order.Currency = componentAt(cux, 1)
+		if qualifier := componentAt(cux, 0); qualifier != CurrencyReference {
+			m.order.CurrencyQualifier = qualifier
 		}
-		
-		if err := g.writeSegment(imd, writer); err != nil {
-			return err
+	case SegmentTagNAD:
+		address := m.decodeAddress(segment)
+		switch qualifier := m.element(segment, 0); qualifier {
+		case PartyBuyer:
+			m.order.Buyer = address
+		case PartySeller:
+			m.order.Seller = address
+		case PartyDelivery:
+			m.order.Delivery = address
+		case PartyInvoice:
+			m.order.Invoice = address
+		default:
+			m.order.AdditionalParties = append(m.order.AdditionalParties, Party{Qualifier: qualifier, Address: address})
 		}
-		if foundUNH {
-			segmentCount++
+	case SegmentTagLOC:
+		if m.item == nil && m.order.Delivery.Name != "" {
+			m.order.Delivery.DeliveryWindows = append(m.order.Delivery.DeliveryWindows, DockWindow{DockCode: m.element(segment, 0)})
 		}
-		
-		qty, err := g.segmentBuilder.BuildQTY(ctx, item)
+	case SegmentTagLIN:
+		m.flushItem()
+		lineNumber, err := strconv.Atoi(m.element(segment, 0))
 		if err != nil {
-			return fmt.Errorf("failed to build QTY: %w", err)
-		}
-		
-		if err := g.writeSegment(qty, writer); err != nil {
-			return err
+			return fmt.Errorf("%w: invalid line number %q", ErrMalformedSegment, segmentElement(segment, 0))
 		}
-		if foundUNH {
-			segmentCount++
+		m.item = &EDIOrderItem{
+			LineNumber:       lineNumber,
+			BuyerItemCode:    componentAt(m.components(segment, 2), 0),
+			SupplierItemCode: componentAt(m.components(segment, 4), 0),
+			EANCode:          componentAt(m.components(segment, 5), 0),
 		}
-		
-		pri, err := g.segmentBuilder.BuildPRI(ctx, item)
-		if err != nil {
-			return fmt.Errorf("failed to build PRI: %w", err)
+	case SegmentTagIMD:
+		if m.item != nil && m.item.Description == "" {
+			description := m.components(segment, 3)
+			m.item.ItemDescriptionCode = componentAt(description, 0)
+			m.item.ItemDescriptionCodeList = componentAt(description, 1)
+			m.item.ItemDescriptionAgency = componentAt(description, 2)
+			m.item.Description = componentAt(description, 3)
 		}
-		
-		if err := g.writeSegment(pri, writer); err != nil {
-			return err
+	case SegmentTagQTY:
+		qty := m.components(segment, 0)
+		if m.item != nil && componentAt(qty, 0) == QuantityOrdered {
+			quantity, err := m.number(segment, componentAt(qty, 1))
+			if err != nil {
+				return err
+			}
+			m.item.Quantity = quantity
+			m.item.UnitOfMeasure = componentAt(qty, 2)
+		} else if m.item != nil && componentAt(qty, 0) == QuantityReturned {
+			quantity, err := m.number(segment, componentAt(qty, 1))
+			if err != nil {
+				return err
+			}
+			m.item.ReturnedQuantity = quantity
 		}
-		if foundUNH {
-			segmentCount++
+	case SegmentTagPRI:
+		pri := m.components(segment, 0)
+		if m.item != nil {
+			price, err := m.number(segment, componentAt(pri, 1))
+			if err != nil {
+				return err
+			}
+			basis, err := m.number(segment, componentAt(pri, 4))
+			if err != nil {
+				return err
+			}
+			m.item.UnitPrice = price
+			m.item.PriceBasisQuantity = basis
+			m.item.PriceBasisUOM = componentAt(pri, 5)
 		}
-		
-		moa, err := g.segmentBuilder.BuildMOA(ctx, item)
+	case SegmentTagMOA:
+		moa := m.components(segment, 0)
+		amount, err := m.number(segment, componentAt(moa, 1))
 		if err != nil {
-			return fmt.Errorf("failed to build MOA: %w", err)
-		}
-		
-		if err := g.writeSegment(moa, writer); err != nil {
 			return err
 		}
-		if foundUNH {
-			segmentCount++
+		switch qualifier := componentAt(moa, 0); {
+		case qualifier == AmountLine && m.item != nil:
+			m.item.Amount = amount
+		case qualifier == AmountTotal:
+			m.order.TotalAmount = amount
 		}
-		
-		if !item.DeliveryDate.IsZero() {
-			itemDTM, err := g.segmentBuilder.BuildDTM(ctx, item.DeliveryDate, QualifierLineDeliveryDate)
+	case SegmentTagUNS:
+		m.flushItem()
+	case SegmentTagCNT:
+		cnt := m.components(segment, 0)
+		switch componentAt(cnt, 0) {
+		case ControlTotalLines:
+			lines, err := strconv.Atoi(componentAt(cnt, 1))
 			if err != nil {
-				return fmt.Errorf("failed to build item DTM: %w", err)
+				return fmt.Errorf("%w: invalid line count %q", ErrMalformedSegment, componentAt(cnt, 1))
 			}
-			
-			if err := g.writeSegment(itemDTM, writer); err != nil {
+			m.order.TotalLines = lines
+		case ControlTotalQuantity:
+			quantity, err := m.number(segment, componentAt(cnt, 1))
+			if err != nil {
 				return err
 			}
-			if foundUNH {
-				segmentCount++
-			}
+			m.order.TotalQuantity = quantity
+		}
+	case SegmentTagUNT:
+		m.flushItem()
+		count, err := strconv.Atoi(m.element(segment, 0))
+		if err != nil || count != m.segments {
+			return fmt.Errorf("%w: UNT declares %s segments, message has %d", ErrControlCountMismatch, segmentElement(segment, 0), m.segments)
+		}
+		if ref := m.element(segment, 1); ref != m.order.MessageRefNumber {
+			return fmt.Errorf("%w: UNT reference %q does not match UNH reference %q", ErrControlCountMismatch, ref, m.order.MessageRefNumber)
 		}
 	}
 	
-	uns := EDISegment{Tag: SegmentTagUNS, Elements: []string{"S"}}
-	if err := g.writeSegment(uns, writer); err != nil {
-		return err
-	}
-	if foundUNH {
-		segmentCount++
-	}
-	
-	cnt, err := g.segmentBuilder.BuildCNT(ctx, order)
-	if err != nil {
-		return fmt.Errorf("failed to build CNT: %w", err)
-	}
-	
-	if err := g.writeSegment(cnt, writer); err != nil {
-		return err
-	}
-	if foundUNH {
-		segmentCount++
-	}
-	
-	moaTotal, err := g.segmentBuilder.BuildMOATotal(ctx, order)
-	if err != nil {
-		return fmt.Errorf("failed to build MOA total: %w", err)
-	}
+	return nil
+}
+
+func decodeUNB(segment EDISegment, d Delimiters) InterchangeHeader {
+	syntax := d.Components(segmentElement(segment, 0))
+	sender := d.Components(segmentElement(segment, 1))
+	receiver := d.Components(segmentElement(segment, 2))
 	
-	if err := g.writeSegment(moaTotal, writer); err != nil {
-		return err
-	}
-	if foundUNH {
-		segmentCount++
+	header := InterchangeHeader{
+		SyntaxIdentifier:  componentAt(syntax, 0),
+		SyntaxVersion:     componentAt(syntax, 1),
+		SenderID:          componentAt(sender, 0),
+		SenderQualifier:   componentAt(sender, 1),
+		ReceiverID:        componentAt(receiver, 0),
+		ReceiverQualifier: componentAt(receiver, 1),
+		TestIndicator:     IndicatorProduction,
 	}
 	
-	unt, err := g.segmentBuilder.BuildUNT(ctx, order, segmentCount)
-	if err != nil {
-		return fmt.Errorf("failed to build UNT: %w", err)
+	date, clock := segmentElement(segment, 3), segmentElement(segment, 4)
+	controlRefIndex, testIndex := 5, 8
+	if strings.Contains(date, string(d.Component)) {
+		dateTime := d.Components(date)
+		date, clock = componentAt(dateTime, 0), componentAt(dateTime, 1)
+		controlRefIndex, testIndex = 4, 10
 	}
-	
-	if err := g.writeSegment(unt, writer); err != nil {
-		return err
+	layout := DateFormatCCYYMMDD
+	if len(date) == len(DateFormatYYMMDD) {
+		layout = DateFormatYYMMDD
 	}
-	
-	messageCount := 1
-	unz, err := g.segmentBuilder.BuildUNZ(ctx, order, messageCount)
-	if err != nil {
-		return fmt.Errorf("failed to build UNZ: %w", err)
+	if parsed, err := time.Parse(layout+DateFormatHHMM, date+clock); err == nil {
+		header.Date = parsed
 	}
 	
-	if err := g.writeSegment(unz, writer); err != nil {
-		return err
+	header.ControlRef = d.unescape(segmentElement(segment, controlRefIndex))
+	if segmentElement(segment, testIndex) == "1" {
+		header.TestIndicator = IndicatorTest
 	}
-	
-	return nil
+	return header
 }
 
-func (g *EDIFACTOrderGenerator) writeSegment(segment EDISegment, writer io.Writer) error {
-	builder := g.pool.Get().(*strings.Builder)
-	builder.Reset()
-	defer g.pool.Put(builder)
+func ParseInterchange(ctx context.Context, r io.Reader) (InterchangeHeader, iter.Seq2[EDIOrder, error]) {
+	reader := NewSegmentReader(r)
 	
-	str, err := segment.String(g.elementSeparator, g.segmentTerminator, g.releaseCharacter)
+	unb, err := reader.Next()
+	if err == nil && unb.Tag != SegmentTagUNB {
+		err = fmt.Errorf("%w: expected UNB, got %s", ErrUnexpectedSegment, unb.Tag)
+	}
 	if err != nil {
-		return err
+		if err == io.EOF {
+			err = fmt.Errorf("%w: missing UNB segment", io.ErrUnexpectedEOF)
+		}
+		return InterchangeHeader{}, func(yield func(EDIOrder, error) bool) {
+			yield(EDIOrder{}, err)
+		}
 	}
+	delimiters := reader.Delimiters()
+	header := decodeUNB(unb, delimiters)
 	
-	builder.WriteString(str)
-	builder.WriteString("\n")
-	
-	_, err = writer.Write([]byte(builder.String()))
-	return err
+	return header, func(yield func(EDIOrder, error) bool) {
+		var decoder *messageDecoder
+		messages := 0
+		
+		for {
+			select {
+			case <-ctx.Done():
+				yield(EDIOrder{}, ErrContextCancelled)
+				return
+			default:
+			}
+			
+			segment, err := reader.Next()
+			if err == io.EOF {
+				err = fmt.Errorf("%w: missing UNZ segment", io.ErrUnexpectedEOF)
+			}
+			if err != nil {
+				yield(EDIOrder{}, err)
+				return
+			}
+			
+			switch {
+			case segment.Tag == SegmentTagUNH:
+				if decoder != nil {
+					yield(EDIOrder{}, fmt.Errorf("%w: UNH before UNT of message %s", ErrUnexpectedSegment, decoder.order.MessageRefNumber))
+					return
+				}
+				decoder = &messageDecoder{delimiters: delimiters, order: header.applyTo(EDIOrder{})}
+				if err := decoder.decode(segment); err != nil {
+					yield(EDIOrder{}, err)
+					return
+				}
+			case segment.Tag == SegmentTagUNZ:
+				if decoder != nil {
+					yield(EDIOrder{}, fmt.Errorf("%w: UNZ before UNT", ErrUnexpectedSegment))
+					return
+				}
+				if count, err := strconv.Atoi(delimiters.unescape(segmentElement(segment, 0))); err != nil || count != messages {
+					yield(EDIOrder{}, fmt.Errorf("%w: UNZ declares %s messages, interchange has %d", ErrControlCountMismatch, segmentElement(segment, 0), messages))
+					return
+				}
+				if ref := delimiters.unescape(segmentElement(segment, 1)); ref != header.ControlRef {
+					yield(EDIOrder{}, fmt.Errorf("%w: UNZ reference %q does not match UNB reference %q", ErrControlCountMismatch, ref, header.ControlRef))
+				}
+				return
+			case decoder == nil:
+				yield(EDIOrder{}, fmt.Errorf("%w: %s outside a message", ErrUnexpectedSegment, segment.Tag))
+				return
+			default:
+				if err := decoder.decode(segment); err != nil {
+					yield(EDIOrder{}, err)
+					return
+				}
+				if segment.Tag == SegmentTagUNT {
+					order := decoder.order
+					decoder = nil
+					messages++
+					if !yield(order, nil) {
+						return
+					}
+				}
+			}
+		}
+	}
 }
 
-func (b *DefaultSegmentBuilder) BuildUNB(ctx context.Context, order EDIOrder) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
-	}
-	
-	date := order.OrderDate.Format(DateFormatYYMMDD)
-	time := order.OrderDate.Format(DateFormatHHMM)
+func Parse(ctx context.Context, r io.Reader) (EDIOrder, error) {
+	_, messages := ParseInterchange(ctx, r)
 	
-	syntaxID := "UNOA"
-	syntaxVersion := "2"
-	if order.SyntaxIdentifier != "" {
-		syntaxID = order.SyntaxIdentifier
-	}
-	if order.SyntaxVersion != "" {
-		syntaxVersion = order.SyntaxVersion
+	var parsed EDIOrder
+	count := 0
+	for order, err := range messages {
+		if err != nil {
+			return EDIOrder{}, err
+		}
+		if count > 0 {
+			return EDIOrder{}, fmt.Errorf("%w: Parse expects a single message", ErrUnexpectedSegment)
+		}
+		parsed = order
+		count++
 	}
 	
-	testIndicator := ""
-	if order.TestIndicator == 1 {
-		testIndicator = "1"
+	if count == 0 {
+		return EDIOrder{}, fmt.Errorf("%w: interchange contains no message", ErrUnexpectedSegment)
 	}
-	
-	return EDISegment{
-		Tag: SegmentTagUNB,
-		Elements: []string{
-			fmt.Sprintf("%s:%s", syntaxID, syntaxVersion),
-			order.InterchangeSenderID,
-			order.InterchangeReceiverID,
-			date,
-			time,
-			order.InterchangeControlRef,
-			"",
-			"",
-			testIndicator,
-		},
-	}, nil
+	return parsed, nil
 }
 
-func (b *DefaultSegmentBuilder) BuildUNH(ctx context.Context, order EDIOrder) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
-	}
-	
-	messageVersion := "D"
-	messageRelease := "96A"
-	responsibleAgency := "UN"
-	associationCode := "EAN008"
-	
-	if order.MessageVersion != "" {
-		messageVersion = order.MessageVersion
-	}
-	if order.MessageRelease != "" {
-		messageRelease = order.MessageRelease
-	}
-	if order.ResponsibleAgency != "" {
-		responsibleAgency = order.ResponsibleAgency
-	}
-	if order.AssociationCode != "" {
-		associationCode = order.AssociationCode
-	}
-	
-	return EDISegment{
-		Tag: SegmentTagUNH,
-		Elements: []string{
-			order.MessageRefNumber,
-			fmt.Sprintf("ORDERS:%s:%s:%s:%s", messageVersion, messageRelease, responsibleAgency, associationCode),
-		},
-	}, nil
-}
+const DefaultFilenameTemplate = "ORDER_{{.OrderNumber}}_{{.Timestamp}}"
 
-func (b *DefaultSegmentBuilder) BuildBGM(ctx context.Context, order EDIOrder) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
-	}
-	
-	return EDISegment{
-		Tag: SegmentTagBGM,
-		Elements: []string{
-			CodeOrder,
-			order.OrderNumber,
-			CodeOriginal,
-		},
-	}, nil
+type EDIWriter struct {
+	outputDir        string
+	filenameTemplate *template.Template
+	clock            func() time.Time
+	mu               sync.Mutex
 }
 
-func (b *DefaultSegmentBuilder) BuildDTM(ctx context.Context, date time.Time, qualifier string) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
-	}
-	
-	formattedDate := date.Format(DateFormatCCYYMMDD)
-	return EDISegment{
-		Tag: SegmentTagDTM,
-		Elements: []string{
-			fmt.Sprintf("%s:%s:102", qualifier, formattedDate),
-		},
-	}, nil
+type filenameFields struct {
+	OrderNumber string
+	Timestamp   string
+	SenderID    string
+	ReceiverID  string
 }
 
-func (b *DefaultSegmentBuilder) BuildCUX(ctx context.Context, order EDIOrder) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
-	}
-	
-	qualifier := CurrencyReference
-	if order.CurrencyQualifier != "" {
-		qualifier = order.CurrencyQualifier
+func NewEDIWriter(outputDir string) *EDIWriter {
+	return &EDIWriter{
+		outputDir:        outputDir,
+		filenameTemplate: template.Must(template.New("filename").Option("missingkey=error").Parse(DefaultFilenameTemplate)),
+		clock:            time.Now,
 	}
-	
-	return EDISegment{
-		Tag: SegmentTagCUX,
-		Elements: []string{
-			fmt.Sprintf("%s:%s:9", qualifier, order.Currency),
-		},
-	}, nil
 }
 
-func (b *DefaultSegmentBuilder) BuildNAD(ctx context.Context, partyQualifier string, address Address) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
-	}
-	
-	elements := []string{partyQualifier}
-	
-	idType := IDTypeBuyer
-	if address.IDType != "" {
-		idType = address.IDType
-	}
-	
-	if address.ID != "" {
-		elements = append(elements, fmt.Sprintf("%s::%s", address.ID, idType))
-	} else {
-		elements = append(elements, "")
-	}
-	
-	addrStr := strings.Join(address.Lines, b.generator.componentSeparator)
-	elements = append(elements, addrStr, "", address.Name)
-	
-	return EDISegment{Tag: SegmentTagNAD, Elements: elements}, nil
+func (w *EDIWriter) WithClockFunc(fn func() time.Time) *EDIWriter {
+	w.clock = fn
+	return w
 }
 
-func (b *DefaultSegmentBuilder) BuildTOD(ctx context.Context, order EDIOrder) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
+func (w *EDIWriter) WithFilenameTemplate(tmpl string) (*EDIWriter, error) {
+	parsed, err := template.New("filename").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename template: %w", err)
 	}
 	
-	elements := []string{"3", ""}
-	
-	if order.DeliveryTermsCode != "" {
-		elements = append(elements, fmt.Sprintf("::%s", order.DeliveryTermsCode))
-	} else {
-		elements = append(elements, fmt.Sprintf("::%s", order.DeliveryTerms))
+	var probe strings.Builder
+	sample := filenameFields{OrderNumber: "PO", Timestamp: "20060102_150405", SenderID: "S", ReceiverID: "R"}
+	if err := parsed.Execute(&probe, sample); err != nil {
+		return nil, fmt.Errorf("invalid filename template: %w", err)
+	}
+	if sanitizeFilename(probe.String()) == "" {
+		return nil, fmt.Errorf("invalid filename template: template produces an empty filename")
 	}
 	
-	return EDISegment{Tag: SegmentTagTOD, Elements: elements}, nil
+	w.filenameTemplate = parsed
+	return w, nil
 }
 
-func (b *DefaultSegmentBuilder) BuildPAT(ctx context.Context, order EDIOrder) (EDISegment, error) {
+func (w *EDIWriter) WriteOrder(ctx context.Context, order EDIOrder, content string) (string, error) {
 	select {
 	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
+		return "", ctx.Err()
 	default:
 	}
 	
-	elements := []string{"1", ""}
+	if err := os.MkdirAll(w.outputDir, DirPerms); err != nil {
+		return "", fmt.Errorf("%w: failed to create directory: %v", ErrFileWrite, err)
+	}
 	
-	if order.PaymentTermsCode != "" {
-		elements = append(elements, order.PaymentTermsCode)
-	} else {
-		elements = append(elements, order.PaymentTerms)
+	baseName, err := w.orderBaseName(order)
+	if err != nil {
+		return "", err
 	}
 	
-	return EDISegment{Tag: SegmentTagPAT, Elements: elements}, nil
-}
-
-func (b *DefaultSegmentBuilder) BuildTDT(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	filename, err := w.orderPath(baseName, ".edi")
+	if err != nil {
+		return "", err
+	}
+	
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	
 	select {
 	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
+		return "", ctx.Err()
 	default:
 	}
 	
-	elements := []string{"20", "1", ""}
-	
-	if order.TransportModeCode != "" {
-		elements = append(elements, order.TransportModeCode)
-	} else {
-		elements = append(elements, order.TransportMode)
+	if err := writeFileSynced(filename, content); err != nil {
+		return "", err
 	}
 	
-	return EDISegment{Tag: SegmentTagTDT, Elements: elements}, nil
+	return filename, nil
 }
 
-func (b *DefaultSegmentBuilder) BuildLIN(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+func (w *EDIWriter) WriteOrderWithSummary(ctx context.Context, order EDIOrder, ediContent string) (string, string, error) {
 	select {
 	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
+		return "", "", ctx.Err()
 	default:
 	}
 	
-	elements := []string{
-		strconv.Itoa(item.LineNumber),
-		"",
-		fmt.Sprintf("%s:EN", item.BuyerItemCode),
-		"",
+	if err := os.MkdirAll(w.outputDir, DirPerms); err != nil {
+		return "", "", fmt.Errorf("%w: failed to create directory: %v", ErrFileWrite, err)
 	}
 	
-	if item.SupplierItemCode != "" {
-		elements = append(elements, fmt.Sprintf("%s:SA", item.SupplierItemCode))
-	} else {
-		elements = append(elements, "")
+	baseName, err := w.orderBaseName(order)
+	if err != nil {
+		return "", "", err
 	}
 	
-	return EDISegment{Tag: SegmentTagLIN, Elements: elements}, nil
-}
-
-func (b *DefaultSegmentBuilder) BuildIMD(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	ediPath, err := w.orderPath(baseName, ".edi")
+	if err != nil {
+		return "", "", err
+	}
+	summaryPath, err := w.orderPath(baseName, ".txt")
+	if err != nil {
+		return "", "", err
+	}
+	
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	
 	select {
 	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
+		return "", "", ctx.Err()
 	default:
 	}
 	
-	return EDISegment{
-		Tag: SegmentTagIMD,
-		Elements: []string{
-			"F",
-			"",
-			"",
-			fmt.Sprintf(":::%s", item.Description),
-		},
-	}, nil
+	if err := writeFileSynced(ediPath, ediContent); err != nil {
+		return "", "", err
+	}
+	if err := writeFileSynced(summaryPath, FormatOrderSummary(order)); err != nil {
+		return "", "", err
+	}
+	
+	return ediPath, summaryPath, nil
 }
 
-func (b *DefaultSegmentBuilder) BuildQTY(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
+func (w *EDIWriter) orderBaseName(order EDIOrder) (string, error) {
+	fields := filenameFields{
+		OrderNumber: sanitizeFilename(order.OrderNumber),
+		Timestamp:   w.clock().Format("20060102_150405"),
+		SenderID:    sanitizeFilename(order.InterchangeSenderID),
+		ReceiverID:  sanitizeFilename(order.InterchangeReceiverID),
 	}
 	
-	uom := item.UnitOfMeasure
-	if uom == "" {
-		uom = "PCE"
+	var name strings.Builder
+	if err := w.filenameTemplate.Execute(&name, fields); err != nil {
+		return "", fmt.Errorf("%w: failed to render filename: %v", ErrFileWrite, err)
 	}
 	
-	quantityStr := strconv.FormatFloat(item.Quantity, 'f', 2, 64)
+	return sanitizeFilename(name.String()), nil
+}
+
+func (w *EDIWriter) orderPath(baseName, ext string) (string, error) {
+	filename := filepath.Join(w.outputDir, baseName+ext)
 	
-	return EDISegment{
-		Tag: SegmentTagQTY,
-		Elements: []string{
-			fmt.Sprintf("%s:%s:%s", QuantityOrdered, quantityStr, uom),
-		},
-	}, nil
+	if !isPathSafe(w.outputDir, filename) {
+		return "", fmt.Errorf("%w: path traversal detected", ErrFileWrite)
+	}
+	
+	return filename, nil
 }
 
-func (b *DefaultSegmentBuilder) BuildPRI(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+type ArchiveWriter struct {
+	naming *EDIWriter
+	zip    *zip.Writer
+	names  map[string]bool
+	errs   []error
+	mu     sync.Mutex
+}
+
+func NewArchiveWriter(writer io.Writer, naming *EDIWriter) *ArchiveWriter {
+	if naming == nil {
+		naming = NewEDIWriter("")
+	}
+	return &ArchiveWriter{
+		naming: naming,
+		zip:    zip.NewWriter(writer),
+		names:  make(map[string]bool),
+	}
+}
+
+func (a *ArchiveWriter) WriteOrder(ctx context.Context, order EDIOrder, content string) (string, error) {
 	select {
 	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
+		return "", ctx.Err()
 	default:
 	}
 	
-	priceStr := strconv.FormatFloat(item.UnitPrice, 'f', 2, 64)
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	
-	return EDISegment{
-		Tag: SegmentTagPRI,
-		Elements: []string{
-			fmt.Sprintf("%s:%s", PriceNet, priceStr),
-		},
-	}, nil
+	name, err := a.entryName(order)
+	if err == nil {
+		err = a.writeEntry(name, content)
+	}
+	if err != nil {
+		err = fmt.Errorf("order %s: %w", order.OrderNumber, err)
+		a.errs = append(a.errs, err)
+		return "", err
+	}
+	
+	return name, nil
 }
 
-func (b *DefaultSegmentBuilder) BuildMOA(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
+func (a *ArchiveWriter) entryName(order EDIOrder) (string, error) {
+	baseName, err := a.naming.orderBaseName(order)
+	if err != nil {
+		return "", err
+	}
+	if baseName == "" || filepath.Base(baseName) != baseName {
+		return "", fmt.Errorf("%w: unsafe archive entry name %q", ErrFileWrite, baseName)
 	}
 	
-	amountStr := strconv.FormatFloat(item.Amount, 'f', 2, 64)
+	name := baseName + ".edi"
+	for i := 2; a.names[name]; i++ {
+		name = fmt.Sprintf("%s_%d.edi", baseName, i)
+	}
+	a.names[name] = true
 	
-	return EDISegment{
-		Tag: SegmentTagMOA,
-		Elements: []string{
-			fmt.Sprintf("%s:%s", AmountLine, amountStr),
-		},
-	}, nil
+	return name, nil
 }
 
-func (b *DefaultSegmentBuilder) BuildCNT(ctx context.Context, order EDIOrder) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
+func (a *ArchiveWriter) writeEntry(name, content string) error {
+	entry, err := a.zip.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: a.naming.clock(),
+	})
+	if err != nil {
+		return fmt.Errorf("%w: failed to create archive entry %s: %v", ErrFileWrite, name, err)
 	}
+	if _, err := io.WriteString(entry, content); err != nil {
+		return fmt.Errorf("%w: failed to write archive entry %s: %v", ErrFileWrite, name, err)
+	}
+	return nil
+}
+
+func (a *ArchiveWriter) Errors() []error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]error(nil), a.errs...)
+}
+
+func (a *ArchiveWriter) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	
-	return EDISegment{
-		Tag: SegmentTagCNT,
-		Elements: []string{
-			fmt.Sprintf("%s:%d", ControlTotalLines, order.TotalLines),
-		},
-	}, nil
+	if err := a.zip.Close(); err != nil {
+		return fmt.Errorf("%w: failed to finalize archive: %v", ErrFileWrite, err)
+	}
+	return nil
 }
 
-func (b *DefaultSegmentBuilder) BuildMOATotal(ctx context.Context, order EDIOrder) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
+func writeFileSynced(filename, content string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FilePerms)
+	if err != nil {
+		return fmt.Errorf("%w: failed to create file: %v", ErrFileWrite, err)
+	}
+	defer file.Close()
+	
+	_, err = file.WriteString(content)
+	if err != nil {
+		return fmt.Errorf("%w: failed to write content: %v", ErrFileWrite, err)
 	}
 	
-	amountStr := strconv.FormatFloat(order.TotalAmount, 'f', 2, 64)
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("%w: failed to sync file: %v", ErrFileWrite, err)
+	}
 	
-	return EDISegment{
-		Tag: SegmentTagMOA,
-		Elements: []string{
-			fmt.Sprintf("%s:%s", AmountTotal, amountStr),
-		},
-	}, nil
+	return nil
 }
 
-func (b *DefaultSegmentBuilder) BuildUNT(ctx context.Context, order EDIOrder, segmentCount int) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
+func FormatOrderSummary(order EDIOrder) string {
+	var b strings.Builder
+	
+	row := func(label, value string) {
+		fmt.Fprintf(&b, "%-20s %s\n", label, value)
+	}
+	party := func(address Address) string {
+		if address.Name == "" {
+			return "-"
+		}
+		if address.ID != "" {
+			return fmt.Sprintf("%s (%s)", address.Name, address.ID)
+		}
+		return address.Name
 	}
 	
-	return EDISegment{
-		Tag: SegmentTagUNT,
-		Elements: []string{
-			strconv.Itoa(segmentCount),
-			order.MessageRefNumber,
-		},
-	}, nil
+	b.WriteString("ORDER SUMMARY\n")
+	b.WriteString(strings.Repeat("-", 60) + "\n")
+	row("Order Number", order.OrderNumber)
+	row("Order Date", order.OrderDate.Format("2006-01-02"))
+	row("Buyer", party(order.Buyer))
+	row("Seller", party(order.Seller))
+	row("Delivery", party(order.Delivery))
+	row("Invoice", party(order.Invoice))
+	row("Line Count", strconv.Itoa(len(order.Items)))
+	row("Total Amount", strings.TrimSpace(strconv.FormatFloat(order.TotalAmount, 'f', 2, 64)+" "+order.Currency))
+	
+	b.WriteString(strings.Repeat("-", 60) + "\n")
+	fmt.Fprintf(&b, "%-6s %-20s %-20s %12s\n", "LINE", "ITEM", "DESCRIPTION", "AMOUNT")
+	for _, item := range order.Items {
+		fmt.Fprintf(&b, "%-6d %-20.20s %-20.20s %12.2f\n", item.LineNumber, item.BuyerItemCode, item.Description, item.Amount)
+	}
+	
+	return b.String()
 }
 
-func (b *DefaultSegmentBuilder) BuildUNZ(ctx context.Context, order EDIOrder, messageCount int) (EDISegment, error) {
-	select {
-	case <-ctx.Done():
-		return EDISegment{}, ErrContextCancelled
-	default:
+const (
+	DefaultPollInterval = 2 * time.Second
+	processedDirName    = "processed"
+	failedDirName       = "failed"
+)
+
+type DirWatcher struct {
+	inputDir     string
+	outputDir    string
+	gen          *EDIFACTOrderGenerator
+	writer       *EDIWriter
+	pollInterval time.Duration
+}
+
+func NewDirWatcher(inputDir, outputDir string, gen *EDIFACTOrderGenerator) *DirWatcher {
+	return &DirWatcher{
+		inputDir:     inputDir,
+		outputDir:    outputDir,
+		gen:          gen,
+		writer:       NewEDIWriter(outputDir),
+		pollInterval: DefaultPollInterval,
 	}
-	
-	return EDISegment{
-		Tag: SegmentTagUNZ,
-		Elements: []string{
-			strconv.Itoa(messageCount),
-			order.InterchangeControlRef,
-		},
-	}, nil
 }
 
-type EDIWriter struct {
-	outputDir string
-	mu        sync.Mutex
+func (d *DirWatcher) WithPollInterval(interval time.Duration) *DirWatcher {
+	d.pollInterval = interval
+	return d
 }
 
-func NewEDIWriter(outputDir string) *EDIWriter {
-	return &EDIWriter{outputDir: outputDir}
+func (d *DirWatcher) Watch(ctx context.Context) error {
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	
+	for {
+		if err := d.ProcessPending(ctx); err != nil {
+			return err
+		}
+		
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
-func (w *EDIWriter) WriteOrder(ctx context.Context, order EDIOrder, content string) (string, error) {
-	select {
-	case <-ctx.Done():
-		return "", ctx.Err()
-	default:
+func (d *DirWatcher) ProcessPending(ctx context.Context) error {
+	entries, err := os.ReadDir(d.inputDir)
+	if err != nil {
+		return fmt.Errorf("failed to read input directory: %w", err)
 	}
 	
-	if err := os.MkdirAll(w.outputDir, DirPerms); err != nil {
-		return "", fmt.Errorf("%w: failed to create directory: %v", ErrFileWrite, err)
+	for _, entry := range entries {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".json") {
+			continue
+		}
+		
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) < d.pollInterval {
+			continue
+		}
+		
+		path := filepath.Join(d.inputDir, entry.Name())
+		target := processedDirName
+		if err := d.processFile(ctx, path); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			target = failedDirName
+		}
+		
+		if err := d.moveInput(path, target); err != nil {
+			return err
+		}
 	}
 	
-	timestamp := time.Now().Format("20060102_150405")
-	safeOrderNumber := sanitizeFilename(order.OrderNumber)
-	
-	filename := filepath.Join(w.outputDir, fmt.Sprintf("ORDER_%s_%s.edi", safeOrderNumber, timestamp))
-	
-	if !isPathSafe(w.outputDir, filename) {
-		return "", fmt.Errorf("%w: path traversal detected", ErrFileWrite)
+	return nil
+}
+
+func (d *DirWatcher) processFile(ctx context.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
 	}
 	
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	var order EDIOrder
+	if err := json.Unmarshal(data, &order); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
 	
-	select {
-	case <-ctx.Done():
-		return "", ctx.Err()
-	default:
+	var buffer strings.Builder
+	if err := d.gen.Generate(ctx, order, &buffer); err != nil {
+		return fmt.Errorf("failed to generate EDI for %s: %w", path, err)
 	}
 	
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FilePerms)
-	if err != nil {
-		return "", fmt.Errorf("%w: failed to create file: %v", ErrFileWrite, err)
+	if _, err := d.writer.WriteOrder(ctx, order, buffer.String()); err != nil {
+		return err
 	}
-	defer file.Close()
 	
-	_, err = file.WriteString(content)
-	if err != nil {
-		return "", fmt.Errorf("%w: failed to write content: %v", ErrFileWrite, err)
+	return nil
+}
+
+func (d *DirWatcher) moveInput(path, subdir string) error {
+	targetDir := filepath.Join(d.inputDir, subdir)
+	if err := os.MkdirAll(targetDir, DirPerms); err != nil {
+		return fmt.Errorf("%w: failed to create directory: %v", ErrFileWrite, err)
 	}
 	
-	if err := file.Sync(); err != nil {
-		return "", fmt.Errorf("%w: failed to sync file: %v", ErrFileWrite, err)
+	target := filepath.Join(targetDir, filepath.Base(path))
+	if err := os.Rename(path, target); err != nil {
+		return fmt.Errorf("%w: failed to move %s: %v", ErrFileWrite, path, err)
 	}
 	
-	return filename, nil
+	return nil
 }
 
 func sanitizeFilename(name string) string {
@@ -1198,7 +7270,7 @@ func main() {
 		TotalAmount:   754.95,
 		TotalLines:    2,
 		TotalQuantity: 15,
-		TestIndicator: 1,
+		TestIndicator: IndicatorTest,
 		
 		MessageVersion:    "D",
 		MessageRelease:    "96A",
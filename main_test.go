@@ -0,0 +1,2891 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testOrderDate = time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+
+func testOrder() EDIOrder {
+	return EDIOrder{
+		InterchangeSenderID:   "SENDER",
+		InterchangeReceiverID: "RECEIVER",
+		InterchangeControlRef: "1",
+		MessageRefNumber:      "1",
+		OrderNumber:           "PO1",
+		OrderDate:             testOrderDate,
+		Currency:              "EUR",
+		Buyer:                 Address{Name: "Buyer", Lines: []string{"1 Main St"}, ID: "B1"},
+		Seller:                Address{Name: "Seller", Lines: []string{"2 Side St"}, ID: "S1"},
+		Items: []EDIOrderItem{
+			{LineNumber: 1, BuyerItemCode: "I1", Quantity: 2, UnitPrice: 3, Amount: 6, Description: "Widget"},
+		},
+		TotalAmount: 6,
+		TotalLines:  1,
+	}
+}
+
+func newTestGenerator(t testing.TB) *EDIFACTOrderGenerator {
+	t.Helper()
+	g, err := NewEDIFACTOrderGenerator()
+	if err != nil {
+		t.Fatalf("NewEDIFACTOrderGenerator() error = %v", err)
+	}
+	return g.WithClockFunc(func() time.Time { return testOrderDate })
+}
+
+func generate(t testing.TB, g *EDIFACTOrderGenerator, order EDIOrder) string {
+	t.Helper()
+	var out strings.Builder
+	if err := g.Generate(context.Background(), order, &out); err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	return out.String()
+}
+
+func segmentLines(output string) []string {
+	return strings.Split(strings.TrimSpace(output), "\n")
+}
+
+func TestEDISegmentEscapesReleaseCharacterFirst(t *testing.T) {
+	tests := []struct {
+		name     string
+		elements []string
+		want     string
+	}{
+		{name: "separators", elements: []string{"A+B'C"}, want: "TST+A?+B?'C'"},
+		{name: "release", elements: []string{"50?"}, want: "TST+50??'"},
+		{name: "composite", elements: []string{"21:5:PCE"}, want: "TST+21:5:PCE'"},
+		{name: "release before separator", elements: []string{"?+"}, want: "TST+???+'"},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EDISegment{Tag: "TST", Elements: tt.elements}.String("+", "'", "?")
+			if err != nil {
+				t.Fatalf("String() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type literalDTMBuilder struct {
+	SegmentBuilder
+}
+
+func (b literalDTMBuilder) BuildDTM(ctx context.Context, date time.Time, qualifier string) (EDISegment, error) {
+	return EDISegment{Tag: SegmentTagDTM, Elements: []string{qualifier + ":" + date.Format("20060102") + ":102"}}, nil
+}
+
+func TestCustomBuilderComponentsStayStructural(t *testing.T) {
+	g := newTestGenerator(t)
+	g.WithSegmentBuilder(literalDTMBuilder{SegmentBuilder: g.segmentBuilder})
+	
+	out := generate(t, g, testOrder())
+	if !strings.Contains(out, "DTM+137:20240301:102'") {
+		t.Errorf("custom builder DTM components were escaped:\n%s", out)
+	}
+	
+	segments, err := g.DryRun(context.Background(), testOrder())
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	for _, segment := range segments {
+		if segment.Tag == SegmentTagDTM && segment.IsOptional {
+			t.Errorf("document date DTM from a custom builder reported as optional")
+		}
+	}
+}
+
+func TestCustomComponentSeparatorReplacesColon(t *testing.T) {
+	g, err := newTestGenerator(t).WithCustomSeparators("'", "+", ">", ".", "?")
+	if err != nil {
+		t.Fatalf("WithCustomSeparators() error = %v", err)
+	}
+	order := testOrder()
+	order.Buyer.Name = "A>B"
+	
+	out := generate(t, g, order)
+	for _, want := range []string{"DTM+137>20240301>102'", "A?>B"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestSyntaxVersion4EscapesRepetitionSeparatorInData(t *testing.T) {
+	g := newTestGenerator(t).WithSyntaxVersion4(true)
+	order := testOrder()
+	order.Buyer.Name = "A*B"
+	
+	out := generate(t, g, order)
+	if !strings.Contains(out, "A?*B") {
+		t.Errorf("repetition separator in data not escaped:\n%s", out)
+	}
+	if strings.Contains(out, "??*") {
+		t.Errorf("repetition separator escaped twice:\n%s", out)
+	}
+	if !strings.HasPrefix(out, "UNA:+.?*'") {
+		t.Errorf("service string advice altered: %q", segmentLines(out)[0])
+	}
+}
+
+func parseGenerated(t *testing.T, g *EDIFACTOrderGenerator, order EDIOrder) EDIOrder {
+	t.Helper()
+	out := generate(t, g, order)
+	parsed, err := Parse(context.Background(), strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("Parse() error = %v\n%s", err, out)
+	}
+	return parsed
+}
+
+func sameDay(a, b time.Time) bool {
+	return a.Truncate(24*time.Hour).Equal(b.Truncate(24 * time.Hour))
+}
+
+func TestGenerateParseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*EDIFACTOrderGenerator) (*EDIFACTOrderGenerator, error)
+		modify func(*EDIOrder)
+	}{
+		{name: "plain"},
+		{
+			name: "service characters in data",
+			modify: func(o *EDIOrder) {
+				o.OrderNumber = "PO+1'x?y"
+				o.Buyer.Name = "Smith's + Sons"
+				o.Items[0].Description = "10.30 slot?"
+			},
+		},
+		{
+			name: "custom separators",
+			config: func(g *EDIFACTOrderGenerator) (*EDIFACTOrderGenerator, error) {
+				return g.WithCustomSeparators("~", "*", ">", ",", "!")
+			},
+			modify: func(o *EDIOrder) {
+				o.Buyer.Name = "A*B>C~D!E"
+				o.Items[0].UnitPrice = 2.5
+				o.Items[0].Amount = 5
+				o.TotalAmount = 5
+			},
+		},
+		{
+			name: "syntax version 4",
+			config: func(g *EDIFACTOrderGenerator) (*EDIFACTOrderGenerator, error) {
+				return g.WithSyntaxVersion4(true), nil
+			},
+			modify: func(o *EDIOrder) { o.Buyer.Name = "A*B" },
+		},
+		{
+			name: "structured address",
+			modify: func(o *EDIOrder) {
+				o.Seller = Address{Name: "Seller", ID: "S1", StreetLines: []string{"2 Side St"}, City: "Chicago", PostalCode: "60601", CountryCode: "US"}
+			},
+		},
+		{
+			name: "dock windows and dates",
+			modify: func(o *EDIOrder) {
+				o.Delivery = Address{
+					Name:            "Warehouse",
+					Lines:           []string{"3 Dock Rd"},
+					ID:              "D1",
+					DeliveryWindows: []DockWindow{{DockCode: "DOOR1", TimeFrom: "0800", TimeTo: "1200"}},
+				}
+				o.DeliveryDate = testOrderDate.AddDate(0, 0, 7)
+				o.Items[0].DeliveryDate = testOrderDate.AddDate(0, 0, 5)
+			},
+		},
+		{
+			name: "versioned order and several lines",
+			modify: func(o *EDIOrder) {
+				o.OrderVersion = "2"
+				o.OrderRevision = "1"
+				o.Items = append(o.Items, EDIOrderItem{LineNumber: 2, BuyerItemCode: "I2", SupplierItemCode: "SUP-2", Quantity: 1, UnitPrice: 4, Amount: 4})
+				o.TotalAmount = 10
+				o.TotalLines = 2
+			},
+		},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGenerator(t)
+			if tt.config != nil {
+				var err error
+				if g, err = tt.config(g); err != nil {
+					t.Fatalf("config error = %v", err)
+				}
+			}
+			order := testOrder()
+			if tt.modify != nil {
+				tt.modify(&order)
+			}
+			
+			parsed := parseGenerated(t, g, order)
+			
+			if parsed.OrderNumber != order.OrderNumber {
+				t.Errorf("OrderNumber = %q, want %q", parsed.OrderNumber, order.OrderNumber)
+			}
+			if parsed.OrderVersion != order.OrderVersion || parsed.OrderRevision != order.OrderRevision {
+				t.Errorf("version/revision = %q/%q, want %q/%q", parsed.OrderVersion, parsed.OrderRevision, order.OrderVersion, order.OrderRevision)
+			}
+			if !sameDay(parsed.OrderDate, order.OrderDate) {
+				t.Errorf("OrderDate = %v, want %v", parsed.OrderDate, order.OrderDate)
+			}
+			if !sameDay(parsed.DeliveryDate, order.DeliveryDate) {
+				t.Errorf("DeliveryDate = %v, want %v", parsed.DeliveryDate, order.DeliveryDate)
+			}
+			if parsed.Buyer.Name != order.Buyer.Name || parsed.Buyer.ID != order.Buyer.ID {
+				t.Errorf("Buyer = %+v, want %+v", parsed.Buyer, order.Buyer)
+			}
+			if parsed.Seller.Name != order.Seller.Name || parsed.Seller.City != order.Seller.City {
+				t.Errorf("Seller = %+v, want %+v", parsed.Seller, order.Seller)
+			}
+			if !slices.Equal(parsed.Delivery.DeliveryWindows, order.Delivery.DeliveryWindows) {
+				t.Errorf("Delivery.DeliveryWindows = %+v, want %+v", parsed.Delivery.DeliveryWindows, order.Delivery.DeliveryWindows)
+			}
+			if parsed.TotalAmount != order.TotalAmount || parsed.TotalLines != order.TotalLines {
+				t.Errorf("totals = %v/%d, want %v/%d", parsed.TotalAmount, parsed.TotalLines, order.TotalAmount, order.TotalLines)
+			}
+			if len(parsed.Items) != len(order.Items) {
+				t.Fatalf("len(Items) = %d, want %d", len(parsed.Items), len(order.Items))
+			}
+			for i, want := range order.Items {
+				got := parsed.Items[i]
+				if got.LineNumber != want.LineNumber || got.BuyerItemCode != want.BuyerItemCode || got.SupplierItemCode != want.SupplierItemCode {
+					t.Errorf("item %d codes = %+v, want %+v", i, got, want)
+				}
+				if got.Quantity != want.Quantity || got.UnitPrice != want.UnitPrice || got.Amount != want.Amount {
+					t.Errorf("item %d amounts = %v/%v/%v, want %v/%v/%v", i, got.Quantity, got.UnitPrice, got.Amount, want.Quantity, want.UnitPrice, want.Amount)
+				}
+				if got.Description != want.Description {
+					t.Errorf("item %d Description = %q, want %q", i, got.Description, want.Description)
+				}
+				if !sameDay(got.DeliveryDate, want.DeliveryDate) {
+					t.Errorf("item %d DeliveryDate = %v, want %v", i, got.DeliveryDate, want.DeliveryDate)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDTMValueFormats(t *testing.T) {
+	tests := []struct {
+		value, format string
+		want          time.Time
+	}{
+		{"20240301", "102", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"202403011030", "203", time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)},
+		{"20240301-20240307", "718", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseDTMValue(tt.value, tt.format)
+		if err != nil {
+			t.Errorf("parseDTMValue(%q, %q) error = %v", tt.value, tt.format, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseDTMValue(%q, %q) = %v, want %v", tt.value, tt.format, got, tt.want)
+		}
+	}
+	if _, err := parseDTMValue("20240301", "999"); err == nil {
+		t.Error("parseDTMValue with unknown format: want error")
+	}
+	if _, _, err := parseTimeWindow("0800-1200"); err != nil {
+		t.Errorf("parseTimeWindow() error = %v", err)
+	}
+	if _, _, err := parseTimeWindow("0800"); err == nil {
+		t.Error("parseTimeWindow without range: want error")
+	}
+}
+
+func TestParseRejectsControlCountMismatch(t *testing.T) {
+	out := generate(t, newTestGenerator(t), testOrder())
+	tampered := strings.Replace(out, "UNT+15+1'", "UNT+14+1'", 1)
+	if tampered == out {
+		t.Fatalf("fixture has no UNT+15 segment:\n%s", out)
+	}
+	if _, err := Parse(context.Background(), strings.NewReader(tampered)); !errors.Is(err, ErrControlCountMismatch) {
+		t.Errorf("Parse() error = %v, want ErrControlCountMismatch", err)
+	}
+}
+
+type blockingSegmentBuilder struct {
+	SegmentBuilder
+	release chan struct{}
+}
+
+func (b blockingSegmentBuilder) BuildCNT(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	<-b.release
+	return b.SegmentBuilder.BuildCNT(ctx, order)
+}
+
+func TestSegmentBuildTimeoutStopsBlockingBuilder(t *testing.T) {
+	g := newTestGenerator(t)
+	release := make(chan struct{})
+	defer close(release)
+	g.WithSegmentBuilder(blockingSegmentBuilder{SegmentBuilder: g.segmentBuilder, release: release})
+	g, err := g.WithSegmentBuildTimeout(20 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("WithSegmentBuildTimeout() error = %v", err)
+	}
+	
+	done := make(chan error, 1)
+	go func() {
+		var out strings.Builder
+		done <- g.Generate(context.Background(), testOrder(), &out)
+	}()
+	
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrSegmentBuildTimeout) {
+			t.Errorf("Generate() error = %v, want ErrSegmentBuildTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Generate() blocked despite segment build timeout")
+	}
+}
+
+func TestSegmentBuildTimeoutKeepsOutputUnchanged(t *testing.T) {
+	want := generate(t, newTestGenerator(t), testOrder())
+	g, err := newTestGenerator(t).WithSegmentBuildTimeout(time.Second)
+	if err != nil {
+		t.Fatalf("WithSegmentBuildTimeout() error = %v", err)
+	}
+	if got := generate(t, g, testOrder()); got != want {
+		t.Errorf("output with timeout differs:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+type lineTDTOverride struct {
+	SegmentBuilder
+}
+
+func (b lineTDTOverride) BuildLineTDT(ctx context.Context, item EDIOrderItem) (EDISegment, error) {
+	return EDISegment{Tag: SegmentTagTDT, Elements: []string{"20", "9", "", "ROAD"}}, nil
+}
+
+func TestOptionalBuilderOverridesOnlyItsSegment(t *testing.T) {
+	order := testOrder()
+	order.Items[0].LineTransportMode = "30"
+	want := generate(t, newTestGenerator(t), order)
+	
+	g := newTestGenerator(t)
+	g.WithSegmentBuilder(lineTDTOverride{SegmentBuilder: g.segmentBuilder})
+	got := generate(t, g, order)
+	if !strings.Contains(got, "TDT+20+9++ROAD'") {
+		t.Errorf("custom line TDT missing:\n%s", got)
+	}
+	if strings.Replace(got, "TDT+20+9++ROAD'", "TDT+20+1++30'", 1) != want {
+		t.Errorf("output differs outside the line TDT:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSegmentBuildTimeoutBoundsAbandonedBuilds(t *testing.T) {
+	g := newTestGenerator(t)
+	release := make(chan struct{})
+	g.WithSegmentBuilder(blockingSegmentBuilder{SegmentBuilder: g.segmentBuilder, release: release})
+	g, err := g.WithSegmentBuildTimeout(time.Millisecond)
+	if err != nil {
+		t.Fatalf("WithSegmentBuildTimeout() error = %v", err)
+	}
+	
+	for i := 0; i < MaxAbandonedSegmentBuilds; i++ {
+		if err := g.Generate(context.Background(), testOrder(), io.Discard); !errors.Is(err, ErrSegmentBuildTimeout) {
+			t.Fatalf("Generate() #%d error = %v, want ErrSegmentBuildTimeout", i, err)
+		}
+	}
+	if n := g.abandonedBuilds.Load(); n != MaxAbandonedSegmentBuilds {
+		t.Fatalf("abandoned builds = %d, want %d", n, MaxAbandonedSegmentBuilds)
+	}
+	
+	start := time.Now()
+	if err := g.Generate(context.Background(), testOrder(), io.Discard); !errors.Is(err, ErrSegmentBuildTimeout) {
+		t.Errorf("Generate() at limit error = %v, want ErrSegmentBuildTimeout", err)
+	}
+	if n := g.abandonedBuilds.Load(); n != MaxAbandonedSegmentBuilds {
+		t.Errorf("abandoned builds after fast fail = %d, want %d", n, MaxAbandonedSegmentBuilds)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Generate() at limit took %s, want fast fail", elapsed)
+	}
+	
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for g.abandonedBuilds.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned builds = %d after release, want 0", g.abandonedBuilds.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMessageTypeRegistryIsPermissiveByDefault(t *testing.T) {
+	order := testOrder()
+	order.MessageRelease = "07A"
+	
+	out := generate(t, newTestGenerator(t), order)
+	if !strings.Contains(out, "UNH+1+ORDERS:D:07A:UN:EAN008'") {
+		t.Errorf("UNH does not carry release 07A:\n%s", out)
+	}
+}
+
+func TestStrictMessageTypesRejectsUnknownVersion(t *testing.T) {
+	order := testOrder()
+	order.MessageRelease = "07A"
+	g := newTestGenerator(t).WithStrictMessageTypes(true)
+	
+	err := g.Generate(context.Background(), order, &strings.Builder{})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Generate() error = %v, want *ValidationError", err)
+	}
+	if validationErr.Field != "EDIOrder.MessageVersion" {
+		t.Errorf("Field = %q, want EDIOrder.MessageVersion", validationErr.Field)
+	}
+	
+	registry := NewMessageTypeRegistry()
+	registry.Register(DefaultMessageType, "D", "07A", "UN")
+	generate(t, g.WithMessageTypeRegistry(registry), order)
+}
+
+func TestSequentialGenerateProducesIdenticalOutput(t *testing.T) {
+	g := newTestGenerator(t).WithValidationCache(NewValidationCache(0))
+	order := testOrder()
+	
+	first := generate(t, g, order)
+	second := generate(t, g, order)
+	if first != second {
+		t.Errorf("second Generate() differs:\n%s\nfirst:\n%s", second, first)
+	}
+	
+	g.Reset()
+	if n := g.validationCache.Len(); n != 1 {
+		t.Errorf("validation cache holds %d entries after Reset, want the shared cache left alone", n)
+	}
+	if third := generate(t, g, order); third != first {
+		t.Errorf("Generate() after Reset differs:\n%s\nfirst:\n%s", third, first)
+	}
+}
+
+func TestValidationErrorFormatDoesNotMutateCachedErrors(t *testing.T) {
+	cache := NewValidationCache(0)
+	formatted, err := newTestGenerator(t).WithValidationCache(cache).WithValidationErrorFormat("{{.Field}}|{{.Message}}")
+	if err != nil {
+		t.Fatalf("WithValidationErrorFormat() error = %v", err)
+	}
+	plain := newTestGenerator(t).WithValidationCache(cache)
+	order := testOrder()
+	order.OrderNumber = ""
+	
+	err = formatted.Generate(context.Background(), order, &strings.Builder{})
+	if err == nil || !strings.HasSuffix(err.Error(), ": EDIOrder.OrderNumber|order number is required") {
+		t.Fatalf("formatted error = %v", err)
+	}
+	
+	err = plain.Generate(context.Background(), order, &strings.Builder{})
+	if err == nil || !strings.HasSuffix(err.Error(), ": validation error on field EDIOrder.OrderNumber: order number is required") {
+		t.Errorf("cached error picked up another generator's format: %v", err)
+	}
+}
+
+func testInterchange(controlRef string) Interchange {
+	return Interchange{
+		Header: InterchangeHeader{SenderID: "SENDER", ReceiverID: "RECEIVER", ControlRef: controlRef},
+		Orders: []EDIOrder{testOrder()},
+	}
+}
+
+func TestHMACSignAndVerify(t *testing.T) {
+	key := []byte("secret")
+	tests := []struct {
+		name     string
+		generate func(t *testing.T, g *EDIFACTOrderGenerator) string
+	}{
+		{
+			name: "order",
+			generate: func(t *testing.T, g *EDIFACTOrderGenerator) string {
+				return generate(t, g, testOrder())
+			},
+		},
+		{
+			name: "order with custom separators",
+			generate: func(t *testing.T, g *EDIFACTOrderGenerator) string {
+				g, err := g.WithCustomSeparators("~", "*", ">", ".", "!")
+				if err != nil {
+					t.Fatalf("WithCustomSeparators() error = %v", err)
+				}
+				return generate(t, g, testOrder())
+			},
+		},
+		{
+			name: "interchange",
+			generate: func(t *testing.T, g *EDIFACTOrderGenerator) string {
+				var out strings.Builder
+				if _, err := g.GenerateInterchange(context.Background(), testInterchange("7"), &out); err != nil {
+					t.Fatalf("GenerateInterchange() error = %v", err)
+				}
+				return out.String()
+			},
+		},
+		{
+			name: "CONTRL",
+			generate: func(t *testing.T, g *EDIFACTOrderGenerator) string {
+				ack := Acknowledgement{
+					Original: InterchangeHeader{SenderID: "SENDER", ReceiverID: "RECEIVER", ControlRef: "7"},
+					Messages: []MessageAcknowledgement{{MessageRefNumber: "1", Accepted: true}},
+				}
+				var out strings.Builder
+				if err := g.GenerateCONTRL(context.Background(), ack, &out); err != nil {
+					t.Fatalf("GenerateCONTRL() error = %v", err)
+				}
+				return out.String()
+			},
+		},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := tt.generate(t, newTestGenerator(t).WithHMACKey(key))
+			
+			ok, err := VerifyInterchangeHMAC([]byte(out), key)
+			if err != nil || !ok {
+				t.Fatalf("VerifyInterchangeHMAC() = %v, %v, want true\n%s", ok, err, out)
+			}
+			
+			if ok, _ := VerifyInterchangeHMAC([]byte(out), []byte("other")); ok {
+				t.Error("VerifyInterchangeHMAC() accepted the wrong key")
+			}
+			
+			tampered := strings.Replace(out, "RECEIVER", "RECEIVEX", 1)
+			if ok, err := VerifyInterchangeHMAC([]byte(tampered), key); err != nil || ok {
+				t.Errorf("VerifyInterchangeHMAC(tampered) = %v, %v, want false", ok, err)
+			}
+		})
+	}
+}
+
+func TestGenerateStreamSignsEveryInterchange(t *testing.T) {
+	g := newTestGenerator(t).WithHMACKey([]byte("secret"))
+	var out strings.Builder
+	if err := g.GenerateStream(context.Background(), []Interchange{testInterchange("1"), testInterchange("2")}, &out); err != nil {
+		t.Fatalf("GenerateStream() error = %v", err)
+	}
+	if n := strings.Count(out.String(), "\nHMC+"); n != 2 {
+		t.Errorf("stream has %d HMC segments, want 2:\n%s", n, out.String())
+	}
+}
+
+func TestVerifyInterchangeHMACWithoutSignature(t *testing.T) {
+	out := generate(t, newTestGenerator(t), testOrder())
+	if _, err := VerifyInterchangeHMAC([]byte(out), []byte("secret")); !errors.Is(err, ErrUnexpectedSegment) {
+		t.Errorf("VerifyInterchangeHMAC() error = %v, want ErrUnexpectedSegment", err)
+	}
+}
+
+func TestSignStyleOnNegativeQuantity(t *testing.T) {
+	tests := []struct {
+		style  SignStyle
+		qty    string
+		amount string
+	}{
+		{SignLeading, "QTY+21:-5.00:PCE'", "MOA+203:-15.00'"},
+		{SignTrailing, "QTY+21:5.00-:PCE'", "MOA+203:15.00-'"},
+		{SignParenthesized, "QTY+21:(5.00):PCE'", "MOA+203:(15.00)'"},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.style.String(), func(t *testing.T) {
+			order := testOrder()
+			order.Items[0].Quantity = -5
+			order.Items[0].Amount = -15
+			order.TotalAmount = -15
+			
+			out := generate(t, newTestGenerator(t).WithSignStyle(tt.style), order)
+			if !strings.Contains(out, tt.qty) {
+				t.Errorf("output lacks %s:\n%s", tt.qty, out)
+			}
+			if !strings.Contains(out, tt.amount) {
+				t.Errorf("output lacks %s:\n%s", tt.amount, out)
+			}
+		})
+	}
+}
+
+func TestNegativeQuantityRequiresSignStyle(t *testing.T) {
+	order := testOrder()
+	order.Items[0].Quantity = -5
+	order.Items[0].Amount = -15
+	order.TotalAmount = -15
+	
+	var validationErr *ValidationError
+	err := newTestGenerator(t).Generate(context.Background(), order, &strings.Builder{})
+	if !errors.As(err, &validationErr) || validationErr.Field != "EDIOrderItem.Quantity" {
+		t.Errorf("Generate() without a sign style error = %v, want EDIOrderItem.Quantity", err)
+	}
+	if err := order.Validate(); err == nil {
+		t.Error("EDIOrder.Validate() accepted a negative quantity")
+	}
+	
+	generate(t, newTestGenerator(t).WithSignStyle(SignLeading), order)
+	
+	order.Items[0].Quantity = 0
+	err = newTestGenerator(t).WithSignStyle(SignLeading).Generate(context.Background(), order, &strings.Builder{})
+	if !errors.As(err, &validationErr) || validationErr.Field != "EDIOrderItem.Quantity" {
+		t.Errorf("Generate() with a zero quantity error = %v, want EDIOrderItem.Quantity", err)
+	}
+}
+
+func TestUnknownSignStyleIsRejectedAtValidation(t *testing.T) {
+	g := newTestGenerator(t).WithSignStyle(SignStyle(42))
+	err := g.Generate(context.Background(), testOrder(), &strings.Builder{})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "EDIFACTOrderGenerator.SignStyle" {
+		t.Errorf("Generate() error = %v, want SignStyle validation error", err)
+	}
+}
+
+func TestUnknownZeroPriceModeIsRejectedAtValidation(t *testing.T) {
+	g := newTestGenerator(t).WithZeroPriceMode(ZeroPriceMode(42))
+	err := g.Generate(context.Background(), testOrder(), &strings.Builder{})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "EDIFACTOrderGenerator.ZeroPriceMode" {
+		t.Errorf("Generate() error = %v, want ZeroPriceMode validation error", err)
+	}
+}
+
+func TestDefaultApplicationReferenceMatchesMessageType(t *testing.T) {
+	tests := []struct {
+		name    string
+		g       func(*EDIFACTOrderGenerator) *EDIFACTOrderGenerator
+		modify  func(*EDIOrder)
+		wantUNB string
+	}{
+		{name: "default", wantUNB: "UNB+UNOA:2+SENDER+RECEIVER+240301+1030+1++ORDERS+'"},
+		{
+			name:    "message type",
+			modify:  func(o *EDIOrder) { o.MessageType = "ORDCHG" },
+			wantUNB: "UNB+UNOA:2+SENDER+RECEIVER+240301+1030+1++ORDCHG+'",
+		},
+		{
+			name:    "explicit reference",
+			modify:  func(o *EDIOrder) { o.ApplicationReference = "PURCHASING" },
+			wantUNB: "UNB+UNOA:2+SENDER+RECEIVER+240301+1030+1++PURCHASING+'",
+		},
+		{
+			name: "routing disabled",
+			g: func(g *EDIFACTOrderGenerator) *EDIFACTOrderGenerator {
+				return g.WithApplicationReferenceRouting(false)
+			},
+			wantUNB: "UNB+UNOA:2+SENDER+RECEIVER+240301+1030+1+++'",
+		},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGenerator(t)
+			if tt.g != nil {
+				g = tt.g(g)
+			}
+			order := testOrder()
+			if tt.modify != nil {
+				tt.modify(&order)
+			}
+			if got := segmentLines(generate(t, g, order))[0]; got != tt.wantUNB {
+				t.Errorf("UNB = %q, want %q", got, tt.wantUNB)
+			}
+		})
+	}
+}
+
+func TestAutoComputeAmountsAppliesToEveryEntryPoint(t *testing.T) {
+	order := testOrder()
+	order.Items[0].Amount = 0
+	const want = "MOA+203:6.00'"
+	
+	g := newTestGenerator(t).WithAutoComputeAmounts(true)
+	outputs := map[string]string{"Generate": generate(t, g, order)}
+	
+	var message strings.Builder
+	if _, err := g.GenerateMessage(context.Background(), order, &message); err != nil {
+		t.Fatalf("GenerateMessage() error = %v", err)
+	}
+	outputs["GenerateMessage"] = message.String()
+	
+	interchange := testInterchange("1")
+	interchange.Orders = []EDIOrder{order}
+	var envelope strings.Builder
+	if _, err := g.GenerateInterchange(context.Background(), interchange, &envelope); err != nil {
+		t.Fatalf("GenerateInterchange() error = %v", err)
+	}
+	outputs["GenerateInterchange"] = envelope.String()
+	
+	for name, out := range outputs {
+		if !strings.Contains(out, want) {
+			t.Errorf("%s output lacks %s:\n%s", name, want, out)
+		}
+	}
+}
+
+func TestGenerateToPipeCancelledWhileReaderIsSlow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	
+	reader, errCh := newTestGenerator(t).GenerateToPipe(ctx, testOrder())
+	defer reader.Close()
+	
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		t.Fatalf("reading head: %v", err)
+	}
+	cancel()
+	
+	if _, err := io.ReadAll(reader); !errors.Is(err, ErrContextCancelled) {
+		t.Errorf("reader error = %v, want ErrContextCancelled", err)
+	}
+	if err := <-errCh; !errors.Is(err, ErrContextCancelled) {
+		t.Errorf("generator error = %v, want ErrContextCancelled", err)
+	}
+}
+
+func TestGenerateToPipeCancelAfterCompletionKeepsSuccess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	want := generate(t, newTestGenerator(t), testOrder())
+	
+	reader, errCh := newTestGenerator(t).GenerateToPipe(ctx, testOrder())
+	got, err := io.ReadAll(reader)
+	cancel()
+	if err != nil {
+		t.Fatalf("reader error = %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("generator error = %v, want nil", err)
+	}
+	if string(got) != want {
+		t.Errorf("piped output differs:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLineAllowanceChargeGroup(t *testing.T) {
+	tests := []struct {
+		name         string
+		discount     float64
+		discountType string
+		want         []string
+	}{
+		{"percentage discount", 10, DiscountTypePercentage, []string{"ALC+A+++1+DI'", "PCD+1:10'"}},
+		{"amount discount", 1.5, DiscountTypeAmount, []string{"ALC+A+++1+DI'", "MOA+204:1.50'"}},
+		{"amount surcharge", -2, DiscountTypeAmount, []string{"ALC+C+++1'", "MOA+23:2.00'"}},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := testOrder()
+			order.Items[0].Discount = tt.discount
+			order.Items[0].DiscountType = tt.discountType
+			
+			out := generate(t, newTestGenerator(t), order)
+			if !strings.Contains(out, strings.Join(tt.want, "\n")) {
+				t.Errorf("output lacks %q:\n%s", tt.want, out)
+			}
+			if _, err := Parse(context.Background(), strings.NewReader(out)); err != nil {
+				t.Errorf("Parse() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestFixedClockDrivesGeneratedTimestamps(t *testing.T) {
+	g := newTestGenerator(t)
+	
+	heartbeat := g.MinimalOrder("SENDER", "RECEIVER", "HB1")
+	if !heartbeat.OrderDate.Equal(testOrderDate) {
+		t.Errorf("MinimalOrder date = %v, want %v", heartbeat.OrderDate, testOrderDate)
+	}
+	generate(t, g, heartbeat)
+	
+	ack := Acknowledgement{
+		Original: InterchangeHeader{SenderID: "SENDER", ReceiverID: "RECEIVER", ControlRef: "7"},
+		Messages: []MessageAcknowledgement{{MessageRefNumber: "1", Accepted: true}},
+	}
+	var first, second strings.Builder
+	for _, out := range []*strings.Builder{&first, &second} {
+		if err := g.GenerateCONTRL(context.Background(), ack, out); err != nil {
+			t.Fatalf("GenerateCONTRL() error = %v", err)
+		}
+	}
+	if first.String() != second.String() {
+		t.Errorf("CONTRL output is not deterministic:\n%s\n%s", first.String(), second.String())
+	}
+	if unb := segmentLines(first.String())[0]; !strings.Contains(unb, "+240301+1030+") {
+		t.Errorf("CONTRL UNB = %q, want the clock's date and time", unb)
+	}
+}
+
+func TestInterchangeEnvelopeDateDefaultsToFirstOrder(t *testing.T) {
+	interchange := testInterchange("1")
+	interchange.Orders[0].OrderDate = time.Date(2023, 12, 24, 8, 15, 0, 0, time.UTC)
+	
+	var out strings.Builder
+	if _, err := newTestGenerator(t).GenerateInterchange(context.Background(), interchange, &out); err != nil {
+		t.Fatalf("GenerateInterchange() error = %v", err)
+	}
+	if unb := segmentLines(out.String())[0]; !strings.Contains(unb, "+231224+0815+") {
+		t.Errorf("UNB = %q, want the first order's date", unb)
+	}
+}
+
+func TestSyntaxVersion4SeparatorConflictIsReportedByValidation(t *testing.T) {
+	g, err := newTestGenerator(t).WithRepetitionSeparator("+")
+	if err != nil {
+		t.Fatalf("WithRepetitionSeparator() error = %v", err)
+	}
+	
+	err = g.WithSyntaxVersion4(true).Generate(context.Background(), testOrder(), &strings.Builder{})
+	if !errors.Is(err, ErrInvalidSeparator) {
+		t.Errorf("Generate() error = %v, want ErrInvalidSeparator", err)
+	}
+}
+
+func TestGenerateX12RejectsLongInterchangeIDs(t *testing.T) {
+	order := testOrder()
+	order.InterchangeSenderID = "SENDER-ID-LONGER-THAN-15"
+	
+	err := newTestGenerator(t).GenerateX12_840(context.Background(), order, &strings.Builder{})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "EDIOrder.InterchangeSenderID" {
+		t.Errorf("GenerateX12_840() error = %v, want InterchangeSenderID validation error", err)
+	}
+	
+	order.InterchangeSenderID = "SENDER15CHARSXX"
+	var out strings.Builder
+	if err := newTestGenerator(t).GenerateX12_840(context.Background(), order, &out); err != nil {
+		t.Fatalf("GenerateX12_840() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "*ZZ*SENDER15CHARSXX*ZZ*RECEIVER       *") {
+		t.Errorf("ISA does not carry padded IDs:\n%s", out.String())
+	}
+}
+
+func TestBankTransferPAIFollowsInstalments(t *testing.T) {
+	order := testOrder()
+	order.PaymentInstalments = []Instalment{
+		{Percentage: 50, DueDate: testOrderDate.AddDate(0, 0, 30)},
+		{Percentage: 50, DueDate: testOrderDate.AddDate(0, 0, 60)},
+	}
+	order.PaymentInstructions = &PaymentInstructions{MeansOfPayment: PaymentMeansCreditTransfer}
+	
+	lines := segmentLines(generate(t, newTestGenerator(t), order))
+	pai, lastPCD := -1, -1
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "PAI+"):
+			pai = i
+			if line != "PAI+::30'" {
+				t.Errorf("PAI = %q, want PAI+::30'", line)
+			}
+		case strings.HasPrefix(line, "PCD+12:"):
+			lastPCD = i
+		}
+	}
+	if pai < 0 || lastPCD < 0 || pai < lastPCD {
+		t.Errorf("PAI at %d must follow the last instalment PCD at %d:\n%s", pai, lastPCD, strings.Join(lines, "\n"))
+	}
+}
+
+func TestLineReferencesAreEmittedOnce(t *testing.T) {
+	order := testOrder()
+	order.Items[0].References = []Reference{
+		{Qualifier: ReferenceOrder, Number: "BO-7", Date: testOrderDate.AddDate(0, -1, 0)},
+		{Qualifier: ReferencePromotionDeal, Number: "PROMO1"},
+	}
+	
+	out := generate(t, newTestGenerator(t), order)
+	want := "RFF+ON:BO-7'\nDTM+171:20240201:102'\nRFF+PD:PROMO1'\n"
+	if strings.Count(out, want) != 1 {
+		t.Errorf("line references not emitted exactly once as %q:\n%s", want, out)
+	}
+	if n := strings.Count(out, "RFF+"); n != 2 {
+		t.Errorf("output has %d RFF segments, want 2:\n%s", n, out)
+	}
+}
+
+func TestLineRefsFollowLIN(t *testing.T) {
+	order := testOrder()
+	order.Items[0].LineRefs = []Reference{{Qualifier: ReferenceOrder, Number: "BO-7", Date: testOrderDate.AddDate(0, -1, 0)}}
+	order.Items[0].References = []Reference{{Qualifier: ReferencePromotionDeal, Number: "PROMO1"}}
+	
+	out := generate(t, newTestGenerator(t), order)
+	if want := "LIN+1++I1:EN++'\nRFF+ON:BO-7'\nDTM+171:20240201:102'\nIMD+"; !strings.Contains(out, want) {
+		t.Errorf("line references do not directly follow LIN as %q:\n%s", want, out)
+	}
+	if n := strings.Count(out, "RFF+"); n != 2 {
+		t.Errorf("output has %d RFF segments, want 2:\n%s", n, out)
+	}
+	
+	order.Items[0].LineRefs[0].Number = ""
+	if err := order.Validate(); err == nil || !strings.Contains(err.Error(), "EDIOrderItem.LineRefs") {
+		t.Errorf("Validate() error = %v, want an EDIOrderItem.LineRefs error", err)
+	}
+}
+
+func TestInspectionHelpersShareOneWalk(t *testing.T) {
+	g := newTestGenerator(t)
+	order := testOrder()
+	
+	plan, err := g.SegmentPlan(order)
+	if err != nil {
+		t.Fatalf("SegmentPlan() error = %v", err)
+	}
+	metas, err := g.DryRun(context.Background(), order)
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	report, err := g.GenerateSegmentReport(context.Background(), order)
+	if err != nil {
+		t.Fatalf("GenerateSegmentReport() error = %v", err)
+	}
+	
+	lines := segmentLines(generate(t, g, order))
+	if len(plan) != len(lines) || len(metas) != len(lines) || len(report) != len(lines) {
+		t.Fatalf("plan/dry run/report sizes = %d/%d/%d, want %d", len(plan), len(metas), len(report), len(lines))
+	}
+	for i, line := range lines {
+		if plan[i] != metas[i].Tag || plan[i] != report[i].Tag || report[i].RawContent != line {
+			t.Errorf("segment %d: plan %s, dry run %s, report %q, output %q", i, plan[i], metas[i].Tag, report[i].RawContent, line)
+		}
+	}
+}
+
+func TestSegmentPlanReturnsValidationError(t *testing.T) {
+	order := testOrder()
+	order.OrderNumber = ""
+	if _, err := newTestGenerator(t).SegmentPlan(order); err == nil {
+		t.Error("SegmentPlan() error = nil, want validation error")
+	}
+}
+
+type stallingSegmentBuilder struct {
+	SegmentBuilder
+	stall *atomic.Bool
+}
+
+func (b stallingSegmentBuilder) BuildCNT(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	if b.stall.Load() {
+		<-ctx.Done()
+		return EDISegment{}, ErrContextCancelled
+	}
+	return b.SegmentBuilder.BuildCNT(ctx, order)
+}
+
+func TestPreGenerationCacheIgnoresCallerCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	
+	cache := NewPreGenerationCache(newTestGenerator(t))
+	cache.Prepare(ctx, "k", testOrder())
+	
+	var out strings.Builder
+	if err := cache.Generate(context.Background(), "k", "PO2", "2", testOrderDate, &out); err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "PO2") {
+		t.Errorf("cached output lacks the new order number:\n%s", out.String())
+	}
+}
+
+func TestPreGenerationCacheDoesNotCacheTimeouts(t *testing.T) {
+	g := newTestGenerator(t)
+	stall := &atomic.Bool{}
+	stall.Store(true)
+	g.WithSegmentBuilder(stallingSegmentBuilder{SegmentBuilder: g.segmentBuilder, stall: stall})
+	cache := NewPreGenerationCache(g).WithTimeout(20 * time.Millisecond)
+	
+	cache.Prepare(context.Background(), "k", testOrder())
+	err := cache.Generate(context.Background(), "k", "PO2", "2", testOrderDate, &strings.Builder{})
+	if !errors.Is(err, ErrContextCancelled) {
+		t.Fatalf("Generate() error = %v, want ErrContextCancelled", err)
+	}
+	
+	stall.Store(false)
+	cache.Prepare(context.Background(), "k", testOrder())
+	if err := cache.Generate(context.Background(), "k", "PO2", "2", testOrderDate, &strings.Builder{}); err != nil {
+		t.Errorf("Generate() after re-Prepare error = %v", err)
+	}
+}
+
+func TestPreGenerationCacheMatchesGenerate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*EDIFACTOrderGenerator) *EDIFACTOrderGenerator
+		modify func(*EDIOrder)
+	}{
+		{name: "plain"},
+		{name: "line break in data", modify: func(o *EDIOrder) { o.Items[0].Description = "two\nlines" }},
+		{name: "signed", config: func(g *EDIFACTOrderGenerator) *EDIFACTOrderGenerator { return g.WithHMACKey([]byte("secret")) }},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGenerator(t)
+			if tt.config != nil {
+				g = tt.config(g)
+			}
+			template := testOrder()
+			if tt.modify != nil {
+				tt.modify(&template)
+			}
+			cache := NewPreGenerationCache(g)
+			cache.Prepare(context.Background(), "k", template)
+			
+			var out strings.Builder
+			if err := cache.Generate(context.Background(), "k", "PO2", "2", testOrderDate.AddDate(0, 0, 1), &out); err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			
+			order := template
+			order.OrderNumber = "PO2"
+			order.InterchangeControlRef = "2"
+			order.OrderDate = testOrderDate.AddDate(0, 0, 1)
+			if want := generate(t, g, order); out.String() != want {
+				t.Errorf("cached output:\n%s\nwant:\n%s", out.String(), want)
+			}
+			
+			if len(g.hmacKey) > 0 {
+				ok, err := VerifyInterchangeHMAC([]byte(out.String()), g.hmacKey)
+				if err != nil || !ok {
+					t.Errorf("VerifyInterchangeHMAC() = %v, %v, want true", ok, err)
+				}
+			}
+		})
+	}
+}
+
+type numberingBGMBuilder struct {
+	SegmentBuilder
+	calls *atomic.Int32
+}
+
+func (b numberingBGMBuilder) BuildBGM(ctx context.Context, order EDIOrder) (EDISegment, error) {
+	return EDISegment{Tag: SegmentTagBGM, Elements: []string{"220", fmt.Sprint(b.calls.Add(1)), "9"}}, nil
+}
+
+func TestPreGenerationCacheRejectsIrreproducibleOutput(t *testing.T) {
+	g := newTestGenerator(t)
+	g.WithSegmentBuilder(numberingBGMBuilder{SegmentBuilder: g.segmentBuilder, calls: &atomic.Int32{}})
+	cache := NewPreGenerationCache(g)
+	cache.Prepare(context.Background(), "k", testOrder())
+	
+	err := cache.Generate(context.Background(), "k", "PO2", "2", testOrderDate, &strings.Builder{})
+	if !errors.Is(err, ErrTemplateNotReusable) {
+		t.Errorf("Generate() error = %v, want ErrTemplateNotReusable", err)
+	}
+}
+
+func TestValidationCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewValidationCache(2)
+	first, second, third := testOrder(), testOrder(), testOrder()
+	second.OrderNumber = "PO2"
+	third.OrderNumber = "PO3"
+	
+	for _, order := range []EDIOrder{first, second, first, third} {
+		if err := cache.Validate(order); err != nil {
+			t.Fatalf("Validate(%s) error = %v", order.OrderNumber, err)
+		}
+	}
+	if got := cache.Len(); got != 2 {
+		t.Fatalf("Len() = %d, want 2", got)
+	}
+	
+	key, _ := second.Hash()
+	if _, ok := cache.results[key]; ok {
+		t.Errorf("least recently used order %s was not evicted", second.OrderNumber)
+	}
+	key, _ = first.Hash()
+	if _, ok := cache.results[key]; !ok {
+		t.Errorf("recently used order %s was evicted", first.OrderNumber)
+	}
+}
+
+func benchmarkOrder() EDIOrder {
+	order := testOrder()
+	for i := 2; i <= 200; i++ {
+		item := order.Items[0]
+		item.LineNumber = i
+		item.BuyerItemCode = fmt.Sprintf("I%d", i)
+		order.Items = append(order.Items, item)
+	}
+	order.TotalAmount = 6 * float64(len(order.Items))
+	order.TotalLines = len(order.Items)
+	return order
+}
+
+func BenchmarkValidateUncached(b *testing.B) {
+	order := benchmarkOrder()
+	for b.Loop() {
+		if err := order.Validate(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkValidateCached(b *testing.B) {
+	order := benchmarkOrder()
+	cache := NewValidationCache(0)
+	for b.Loop() {
+		if err := cache.Validate(order); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func generateBoth(t testing.TB, g *EDIFACTOrderGenerator, order EDIOrder) (string, string) {
+	t.Helper()
+	var slow, fast strings.Builder
+	slowErr := g.Generate(context.Background(), order, &slow)
+	fastErr := g.GenerateFast(context.Background(), order, &fast)
+	if fmt.Sprint(slowErr) != fmt.Sprint(fastErr) {
+		t.Fatalf("GenerateFast() error = %v, Generate() error = %v", fastErr, slowErr)
+	}
+	return slow.String(), fast.String()
+}
+
+func TestGenerateFastMatchesGenerate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*EDIFACTOrderGenerator) (*EDIFACTOrderGenerator, error)
+		modify func(*EDIOrder)
+	}{
+		{name: "plain"},
+		{
+			name: "service characters in data",
+			modify: func(o *EDIOrder) {
+				o.OrderNumber = "PO+1'x?y"
+				o.Buyer.Name = "Smith's + Sons"
+				o.Items[0].Description = "Ümlaut?"
+			},
+		},
+		{
+			name:   "too many items",
+			modify: func(o *EDIOrder) { *o = benchmarkOrder() },
+		},
+		{
+			name: "custom separators",
+			config: func(g *EDIFACTOrderGenerator) (*EDIFACTOrderGenerator, error) {
+				return g.WithCustomSeparators("~", "*", ">", ",", "!")
+			},
+		},
+		{
+			name: "truncated segment",
+			config: func(g *EDIFACTOrderGenerator) (*EDIFACTOrderGenerator, error) {
+				return g.WithTruncateLongSegments(true), nil
+			},
+			modify: func(o *EDIOrder) { o.Items[0].Description = strings.Repeat("x+", 600) },
+		},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGenerator(t)
+			if tt.config != nil {
+				var err error
+				if g, err = tt.config(g); err != nil {
+					t.Fatalf("config error = %v", err)
+				}
+			}
+			order := testOrder()
+			if tt.modify != nil {
+				tt.modify(&order)
+			}
+			
+			slow, fast := generateBoth(t, g, order)
+			if fast != slow {
+				t.Errorf("GenerateFast() output:\n%s\nwant:\n%s", fast, slow)
+			}
+		})
+	}
+}
+
+func FuzzGenerateFastMatchesGenerate(f *testing.F) {
+	f.Add("Buyer", "Widget", "PO1", 2.0)
+	f.Add("A+B'C?D", "10:30", "PO?1", 0.5)
+	f.Add("Ärger", strings.Repeat("?", 400), "X", 1e6)
+	f.Fuzz(func(t *testing.T, name, description, orderNumber string, quantity float64) {
+		g := newTestGenerator(t)
+		order := testOrder()
+		order.Buyer.Name = name
+		order.Items[0].Description = description
+		order.OrderNumber = orderNumber
+		order.Items[0].Quantity = quantity
+		
+		slow, fast := generateBoth(t, g, order)
+		if fast != slow {
+			t.Errorf("GenerateFast() output:\n%s\nwant:\n%s", fast, slow)
+		}
+	})
+}
+
+func BenchmarkGenerateSmall(b *testing.B) {
+	g := newTestGenerator(b)
+	order := testOrder()
+	for _, bm := range []struct {
+		name     string
+		generate func(context.Context, EDIOrder, io.Writer) error
+	}{
+		{name: "Generate", generate: g.Generate},
+		{name: "GenerateFast", generate: g.GenerateFast},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for b.Loop() {
+				if err := bm.generate(context.Background(), order, io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) {
+	return len(p) / 2, nil
+}
+
+func TestCloneIsIndependent(t *testing.T) {
+	g := newTestGenerator(t).
+		WithValidationCache(NewValidationCache(5)).
+		WithHMACKey([]byte("secret")).
+		WithUOMPrecision(map[string]int{"KGM": 3})
+	want := generate(t, g, testOrder())
+	
+	clone := g.Clone()
+	if got := generate(t, clone, testOrder()); got != want {
+		t.Errorf("clone output:\n%s\nwant:\n%s", got, want)
+	}
+	
+	if clone.validationCache == g.validationCache {
+		t.Fatal("clone shares the validation cache")
+	}
+	if clone.validationCache.maxSize != 5 {
+		t.Errorf("clone cache size = %d, want 5", clone.validationCache.maxSize)
+	}
+	clone.validationCache.Reset()
+	if g.validationCache.Len() != 1 {
+		t.Errorf("original cache holds %d entries after the clone was reset, want 1", g.validationCache.Len())
+	}
+	
+	clone.hmacKey[0] = 'X'
+	clone.uomPrecision["KGM"] = 0
+	if string(g.hmacKey) != "secret" || g.uomPrecision["KGM"] != 3 {
+		t.Error("changing the clone altered the original")
+	}
+	if builder := clone.segmentBuilder.(*DefaultSegmentBuilder); builder.generator != clone {
+		t.Error("clone's default builder still points at the original")
+	}
+}
+
+func lineSegments(lineNumber int) []EDISegment {
+	return []EDISegment{
+		{Tag: SegmentTagLIN, Elements: []string{fmt.Sprint(lineNumber)}},
+		{Tag: SegmentTagQTY, Elements: []string{"21:1:PCE"}},
+	}
+}
+
+func TestOrderedSegmentWriterReordersLines(t *testing.T) {
+	var out strings.Builder
+	w := NewOrderedSegmentWriter(newTestGenerator(t), &out, []int{1, 2, 3})
+	for _, n := range []int{3, 1, 2} {
+		if err := w.Write(n, lineSegments(n)); err != nil {
+			t.Fatalf("Write(%d) error = %v", n, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	
+	want := "LIN+1'\nQTY+21:1:PCE'\nLIN+2'\nQTY+21:1:PCE'\nLIN+3'\nQTY+21:1:PCE'\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+	if n := w.SegmentCount(); n != 6 {
+		t.Errorf("SegmentCount() = %d, want 6", n)
+	}
+}
+
+func TestOrderedSegmentWriterRejectsDuplicates(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []int
+	}{
+		{name: "pending", lines: []int{3, 3}},
+		{name: "written", lines: []int{1, 1}},
+		{name: "unknown", lines: []int{4}},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			w := NewOrderedSegmentWriter(newTestGenerator(t), &out, []int{1, 2, 3})
+			var err error
+			for _, n := range tt.lines {
+				if err = w.Write(n, lineSegments(n)); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, ErrUnexpectedLine) {
+				t.Fatalf("Write() error = %v, want ErrUnexpectedLine", err)
+			}
+			if closeErr := w.Close(); !errors.Is(closeErr, ErrUnexpectedLine) {
+				t.Errorf("Close() error = %v, want ErrUnexpectedLine", closeErr)
+			}
+			if strings.Count(out.String(), "LIN+") > 1 {
+				t.Errorf("a line was written twice:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestOrderedSegmentWriterAbort(t *testing.T) {
+	var out strings.Builder
+	w := NewOrderedSegmentWriter(newTestGenerator(t), &out, []int{1, 2})
+	aborted := errors.New("line builder failed")
+	w.Abort(aborted)
+	w.Abort(errors.New("later failure"))
+	
+	if err := w.Write(1, lineSegments(1)); !errors.Is(err, aborted) {
+		t.Errorf("Write() after Abort error = %v, want %v", err, aborted)
+	}
+	if err := w.Close(); !errors.Is(err, aborted) {
+		t.Errorf("Close() after Abort error = %v, want %v", err, aborted)
+	}
+	if out.Len() != 0 {
+		t.Errorf("output after Abort = %q, want nothing", out.String())
+	}
+}
+
+func TestOrderedSegmentWriterIncompleteClose(t *testing.T) {
+	var out strings.Builder
+	w := NewOrderedSegmentWriter(newTestGenerator(t), &out, []int{1, 2, 3})
+	for _, n := range []int{1, 3} {
+		if err := w.Write(n, lineSegments(n)); err != nil {
+			t.Fatalf("Write(%d) error = %v", n, err)
+		}
+	}
+	
+	if err := w.Close(); !errors.Is(err, ErrIncompleteOutput) {
+		t.Errorf("Close() error = %v, want ErrIncompleteOutput", err)
+	}
+	if out.String() != "LIN+1'\nQTY+21:1:PCE'\n" {
+		t.Errorf("output = %q, want only line 1", out.String())
+	}
+}
+
+func TestShortWritesAreReported(t *testing.T) {
+	g := newTestGenerator(t)
+	if err := g.Generate(context.Background(), testOrder(), shortWriter{}); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("Generate() error = %v, want io.ErrShortWrite", err)
+	}
+	if err := g.GenerateX12_840(context.Background(), testOrder(), shortWriter{}); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("GenerateX12_840() error = %v, want io.ErrShortWrite", err)
+	}
+}
+
+func TestFixedWidthWriterBoundaries(t *testing.T) {
+	tests := []struct {
+		name  string
+		width int
+		input string
+		want  string
+	}{
+		{"shorter than width", 5, "abcd\n", "abcd\n"},
+		{"exactly width", 5, "abcde\n", "abcde\n"},
+		{"one over width", 5, "abcdef\n", "abcd~\nef\n"},
+		{"two full lines", 5, "abcdefgh\n", "abcd~\nefgh\n"},
+		{"minimum width", 2, "abc\n", "a~\nbc\n"},
+		{"exactly width without newline", 5, "abcde", "abcde"},
+		{"disabled", 1, "abcdef\n", "abcdef\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			w := FixedWidthWriter(&out, tt.width)
+			for i := range len(tt.input) {
+				if _, err := w.Write([]byte(tt.input[i : i+1])); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("output = %q, want %q", out.String(), tt.want)
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+				if tt.width >= 2 && len(line) > tt.width {
+					t.Errorf("line %q exceeds width %d", line, tt.width)
+				}
+			}
+		})
+	}
+}
+
+func TestFixedWidthWriterRejectsContinuationCharacter(t *testing.T) {
+	w := FixedWidthWriter(&strings.Builder{}, 80)
+	if _, err := w.Write([]byte("FTX+AAI+++a~b'\n")); !errors.Is(err, ErrInvalidSeparator) {
+		t.Errorf("Write() error = %v, want ErrInvalidSeparator", err)
+	}
+}
+
+func TestDeliveryWindowsRejectedOutsideDeliveryParty(t *testing.T) {
+	order := testOrder()
+	order.Buyer.DeliveryWindows = []DockWindow{{DockCode: "DOOR1", TimeFrom: "0800", TimeTo: "1200"}}
+	
+	var verr *ValidationError
+	if err := order.Validate(); !errors.As(err, &verr) || verr.Field != "EDIOrder.Buyer.DeliveryWindows" {
+		t.Errorf("Validate() error = %v, want EDIOrder.Buyer.DeliveryWindows", err)
+	}
+}
+
+func TestEANIsThirdLINItemIdentifier(t *testing.T) {
+	g := newTestGenerator(t)
+	order := testOrder()
+	order.Items[0].SupplierItemCode = "S-9"
+	order.Items[0].EANCode = "4006381333931"
+	
+	lines := segmentLines(generate(t, g, order))
+	if want := "LIN+1++I1:EN++S-9:SA+4006381333931:EN'"; !slices.Contains(lines, want) {
+		t.Fatalf("segments = %q, want %q", lines, want)
+	}
+	
+	parsed := parseGenerated(t, g, order)
+	if got := parsed.Items[0]; got.EANCode != "4006381333931" || got.BuyerItemCode != "I1" {
+		t.Errorf("parsed EANCode/BuyerItemCode = %q/%q, want 4006381333931/I1", got.EANCode, got.BuyerItemCode)
+	}
+}
+
+func TestEstimateSizeMatchesOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*EDIFACTOrderGenerator) *EDIFACTOrderGenerator
+	}{
+		{"default", func(g *EDIFACTOrderGenerator) *EDIFACTOrderGenerator { return g }},
+		{"signed", func(g *EDIFACTOrderGenerator) *EDIFACTOrderGenerator { return g.WithHMACKey([]byte("secret")) }},
+		{"syntax version 4", func(g *EDIFACTOrderGenerator) *EDIFACTOrderGenerator { return g.WithSyntaxVersion4(true) }},
+		{"ISO-8859-1", func(g *EDIFACTOrderGenerator) *EDIFACTOrderGenerator { return g.WithCharacterEncoding(EncodingISO88591) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := tt.config(newTestGenerator(t))
+			order := testOrder()
+			order.Items[0].Description = "Zürich O'Brien crème"
+			
+			out := generate(t, g, order)
+			size, err := g.EstimateSize(order)
+			if err != nil {
+				t.Fatalf("EstimateSize() error = %v", err)
+			}
+			if size != len(out) {
+				t.Errorf("EstimateSize() = %d, generated %d bytes", size, len(out))
+			}
+		})
+	}
+}
+
+func TestEmptyInterchange(t *testing.T) {
+	empty := testInterchange("7")
+	empty.Orders = nil
+	
+	_, err := newTestGenerator(t).GenerateInterchange(context.Background(), empty, &strings.Builder{})
+	if !errors.Is(err, ErrNoMessages) {
+		t.Errorf("GenerateInterchange() error = %v, want ErrNoMessages", err)
+	}
+	
+	var out strings.Builder
+	stats, err := newTestGenerator(t).WithAllowEmptyInterchange(true).GenerateInterchange(context.Background(), empty, &out)
+	if err != nil {
+		t.Fatalf("GenerateInterchange() with empty interchanges allowed error = %v", err)
+	}
+	lines := segmentLines(out.String())
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "UNB+") || lines[1] != "UNZ+0+7'" {
+		t.Errorf("segments = %q, want UNB followed by UNZ+0+7'", lines)
+	}
+	if stats.MessagesWritten != 0 {
+		t.Errorf("MessagesWritten = %d, want 0", stats.MessagesWritten)
+	}
+}
+
+func TestPartialLineSegmentOrderKeepsDefaultsForTheRest(t *testing.T) {
+	g, err := newTestGenerator(t).WithLineSegmentOrder([]string{"QTY", "IMD"})
+	if err != nil {
+		t.Fatalf("WithLineSegmentOrder() error = %v", err)
+	}
+	
+	var tags []string
+	inLine := false
+	for _, line := range segmentLines(generate(t, g, testOrder())) {
+		tag := line[:3]
+		switch {
+		case tag == SegmentTagLIN:
+			inLine = true
+		case tag == SegmentTagUNS:
+			inLine = false
+		case inLine:
+			tags = append(tags, tag)
+		}
+	}
+	want := []string{SegmentTagQTY, SegmentTagIMD, SegmentTagPRI, SegmentTagMOA}
+	if !slices.Equal(tags, want) {
+		t.Errorf("line segments = %v, want %v", tags, want)
+	}
+}
+
+func TestIsValidLocode(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"DEHAM", true},
+		{"USNYC", true},
+		{"GB2LD", true},
+		{"FR9Z9", true},
+		{"DE1AB", false},
+		{"DEHA0", false},
+		{"DEHA1", false},
+		{"D2HAM", false},
+		{"dehAM", false},
+		{"DEHA", false},
+		{"DEHAMB", false},
+		{"DE-HM", false},
+	}
+	for _, tt := range tests {
+		if got := isValidLocode(tt.code); got != tt.want {
+			t.Errorf("isValidLocode(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestIsValidExtraSegmentTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want bool
+	}{
+		{"FTX", true},
+		{"UNS", true},
+		{"UNA", false},
+		{"UNB", false},
+		{"UNG", false},
+		{"UNH", false},
+		{"UNT", false},
+		{"UNE", false},
+		{"UNZ", false},
+		{"ftx", false},
+		{"FT", false},
+	}
+	for _, tt := range tests {
+		if got := isValidExtraSegmentTag(tt.tag); got != tt.want {
+			t.Errorf("isValidExtraSegmentTag(%q) = %v, want %v", tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestLocationCodeCannotBeCombinedWithPartyIdentifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		address Address
+	}{
+		{"party ID", Address{Name: "Port", Lines: []string{"Quay 1"}, ID: "P1", LocationCode: "DEHAM"}},
+		{"BIC code", Address{Name: "Bank", Lines: []string{"1 Bank St"}, IDType: IDTypeBIC, BICCode: "DEUTDEFF", LocationCode: "DEHAM"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var verr *ValidationError
+			if err := tt.address.Validate(); !errors.As(err, &verr) || verr.Field != "Address.LocationCode" {
+				t.Errorf("Validate() error = %v, want Address.LocationCode", err)
+			}
+		})
+	}
+	
+	port := Address{Name: "Port", Lines: []string{"Quay 1"}, LocationCode: "DEHAM"}
+	if err := port.Validate(); err != nil {
+		t.Errorf("Validate() with only a location code error = %v", err)
+	}
+}
+
+func TestLowercaseReferenceQualifierIsAccepted(t *testing.T) {
+	item := testOrder().Items[0]
+	item.References = []Reference{{Qualifier: "pd", Number: "PROMO-1"}}
+	if err := item.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestCONTRLHonoursLegacyUNTCount(t *testing.T) {
+	ack := Acknowledgement{
+		Original: InterchangeHeader{SenderID: "SENDER", ReceiverID: "RECEIVER", ControlRef: "7"},
+		Messages: []MessageAcknowledgement{{MessageRefNumber: "1", Accepted: true}},
+	}
+	for _, tt := range []struct {
+		legacy bool
+		want   string
+	}{
+		{false, "UNT+4+"},
+		{true, "UNT+3+"},
+	} {
+		var out strings.Builder
+		if err := newTestGenerator(t).WithLegacyUNTCount(tt.legacy).GenerateCONTRL(context.Background(), ack, &out); err != nil {
+			t.Fatalf("GenerateCONTRL() error = %v", err)
+		}
+		found := false
+		for _, line := range segmentLines(out.String()) {
+			if strings.HasPrefix(line, "UNT+") {
+				found = strings.HasPrefix(line, tt.want)
+			}
+		}
+		if !found {
+			t.Errorf("legacy=%v: UNT does not start with %q:\n%s", tt.legacy, tt.want, out.String())
+		}
+	}
+}
+
+func TestEuroSignEncoding(t *testing.T) {
+	got, err := EncodingWindows1252.Encode("5 €")
+	if err != nil {
+		t.Fatalf("windows-1252 Encode() error = %v", err)
+	}
+	if want := []byte{'5', ' ', 0x80}; !bytes.Equal(got, want) {
+		t.Errorf("windows-1252 Encode() = % x, want % x", got, want)
+	}
+	
+	if _, err := EncodingISO88591.Encode("5 €"); !errors.Is(err, ErrUnencodableCharacter) {
+		t.Errorf("ISO-8859-1 Encode() error = %v, want ErrUnencodableCharacter", err)
+	}
+	
+	order := testOrder()
+	order.Items[0].Description = "Widget €"
+	out := generate(t, newTestGenerator(t).WithCharacterEncoding(EncodingWindows1252), order)
+	if !strings.Contains(out, "Widget \x80") {
+		t.Errorf("generated windows-1252 output lacks the 0x80 euro byte:\n%q", out)
+	}
+}
+
+func TestGenerateMessageOmitsEnvelope(t *testing.T) {
+	var out strings.Builder
+	count, err := newTestGenerator(t).GenerateMessage(context.Background(), testOrder(), &out)
+	if err != nil {
+		t.Fatalf("GenerateMessage() error = %v", err)
+	}
+	
+	lines := segmentLines(out.String())
+	for _, line := range lines {
+		if tag := line[:3]; tag == SegmentTagUNB || tag == SegmentTagUNZ {
+			t.Errorf("message-only output contains %s: %s", tag, line)
+		}
+	}
+	if !strings.HasPrefix(lines[0], "UNH+") {
+		t.Errorf("first segment = %q, want UNH", lines[0])
+	}
+	if count != len(lines) {
+		t.Errorf("GenerateMessage() count = %d, want %d", count, len(lines))
+	}
+	if want := fmt.Sprintf("UNT+%d+1'", len(lines)); lines[len(lines)-1] != want {
+		t.Errorf("last segment = %q, want %q", lines[len(lines)-1], want)
+	}
+}
+
+func TestUnknownPartyIDTypeIsFlagged(t *testing.T) {
+	order := testOrder()
+	order.Seller.IDType = "XX"
+	
+	err := newTestGenerator(t).Generate(context.Background(), order, &strings.Builder{})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Field != "EDIOrder.Seller.IDType" || !strings.Contains(verr.Message, PartySeller) {
+		t.Errorf("Generate() error = %v, want EDIOrder.Seller.IDType naming the SE party", err)
+	}
+	
+	if err := newTestGenerator(t).WithPermissiveIDTypes(true).Generate(context.Background(), order, &strings.Builder{}); err != nil {
+		t.Errorf("Generate() with permissive ID types error = %v", err)
+	}
+}
+
+func TestQuantityPrecisionPerUnitOfMeasure(t *testing.T) {
+	order := testOrder()
+	order.Items = []EDIOrderItem{
+		{LineNumber: 1, BuyerItemCode: "I1", Quantity: 10, UnitOfMeasure: "PCE", UnitPrice: 1, Amount: 10},
+		{LineNumber: 2, BuyerItemCode: "I2", Quantity: 2.5, UnitOfMeasure: "KGM", UnitPrice: 4, Amount: 10},
+		{LineNumber: 3, BuyerItemCode: "I3", Quantity: 1.5, UnitOfMeasure: "LTR", UnitPrice: 2, Amount: 3},
+	}
+	order.TotalAmount = 23
+	order.TotalLines = 3
+	
+	g := newTestGenerator(t).WithUOMPrecision(map[string]int{"PCE": 0, "KGM": 3})
+	out := generate(t, g, order)
+	for _, want := range []string{"QTY+21:10:PCE'", "QTY+21:2.500:KGM'", "QTY+21:1.50:LTR'"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestGLNQualifiedSender(t *testing.T) {
+	order := testOrder()
+	order.InterchangeSenderID = "4006381333931"
+	order.InterchangeSenderQualifier = InterchangeQualifierGLN
+	
+	lines := segmentLines(generate(t, newTestGenerator(t), order))
+	if !strings.HasPrefix(lines[0], "UNB+UNOA:2+4006381333931:14+RECEIVER+") {
+		t.Errorf("UNB = %q, want sender composite 4006381333931:14", lines[0])
+	}
+	
+	order.InterchangeSenderID = "4006381333932"
+	var verr *ValidationError
+	if err := order.Validate(); !errors.As(err, &verr) || verr.Field != "EDIOrder.InterchangeSenderID" {
+		t.Errorf("Validate() error = %v, want EDIOrder.InterchangeSenderID", err)
+	}
+}
+
+func TestDuplicatePartyRole(t *testing.T) {
+	order := testOrder()
+	order.Delivery = Address{Name: "Warehouse", Lines: []string{"3 Dock Rd"}, ID: "D1"}
+	order.AdditionalParties = []Party{{Qualifier: PartyDelivery, Address: Address{Name: "Overflow", Lines: []string{"4 Dock Rd"}, ID: "D2"}}}
+	
+	err := newTestGenerator(t).Generate(context.Background(), order, &strings.Builder{})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Field != "EDIOrder.AdditionalParties[0]" || !strings.Contains(verr.Message, PartyDelivery) {
+		t.Errorf("Generate() error = %v, want duplicate DP role on EDIOrder.AdditionalParties[0]", err)
+	}
+	
+	if err := newTestGenerator(t).WithRepeatableParties(PartyDelivery).Generate(context.Background(), order, &strings.Builder{}); err != nil {
+		t.Errorf("Generate() with repeatable DP error = %v", err)
+	}
+}
+
+func TestGenerateStreamTwoInterchanges(t *testing.T) {
+	first := testInterchange("10")
+	second := testInterchange("11")
+	extra := testOrder()
+	extra.MessageRefNumber = "2"
+	extra.OrderNumber = "PO2"
+	first.Orders = append(first.Orders, extra)
+	
+	var out strings.Builder
+	if err := newTestGenerator(t).GenerateStream(context.Background(), []Interchange{first, second}, &out); err != nil {
+		t.Fatalf("GenerateStream() error = %v", err)
+	}
+	var unz []string
+	for _, line := range segmentLines(out.String()) {
+		if strings.HasPrefix(line, "UNZ+") {
+			unz = append(unz, line)
+		}
+	}
+	if want := []string{"UNZ+2+10'", "UNZ+1+11'"}; !slices.Equal(unz, want) {
+		t.Errorf("UNZ segments = %q, want %q", unz, want)
+	}
+	
+	err := newTestGenerator(t).GenerateStream(context.Background(), []Interchange{first, testInterchange("10")}, &strings.Builder{})
+	if !errors.Is(err, ErrDuplicateControlRef) {
+		t.Errorf("GenerateStream() with a repeated control reference error = %v, want ErrDuplicateControlRef", err)
+	}
+}
+
+func TestPriceBreaks(t *testing.T) {
+	order := testOrder()
+	order.Items[0].PriceBreaks = []PriceBreak{
+		{MinQuantity: 1, MaxQuantity: 99, Price: 3},
+		{MinQuantity: 100, Price: 2.5},
+	}
+	
+	var got []string
+	for _, line := range segmentLines(generate(t, newTestGenerator(t), order)) {
+		switch line[:3] {
+		case SegmentTagPRI, SegmentTagAPR, SegmentTagRNG:
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		"PRI+AAA:3.00'",
+		"PRI+AAA:3.00'", "APR+WS'", "RNG+4+PCE:1.00:99.00'",
+		"PRI+AAA:2.50'", "APR+WS'", "RNG+4+PCE:100.00'",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("price segments = %q, want %q", got, want)
+	}
+	
+	order.Items[0].PriceBreaks[1].MinQuantity = 50
+	var verr *ValidationError
+	if err := order.Validate(); !errors.As(err, &verr) || verr.Field != "EDIOrderItem.PriceBreaks[1].MinQuantity" {
+		t.Errorf("Validate() with overlapping breaks error = %v, want EDIOrderItem.PriceBreaks[1].MinQuantity", err)
+	}
+}
+
+func TestDeliveryBeforeOrderDate(t *testing.T) {
+	order := testOrder()
+	order.DeliveryDate = testOrderDate.AddDate(0, 0, -1)
+	order.Items[0].DeliveryDate = testOrderDate.AddDate(0, 0, -2)
+	
+	err := newTestGenerator(t).Generate(context.Background(), order, &strings.Builder{})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Field != "EDIOrder.DeliveryDate" {
+		t.Errorf("Generate() error = %v, want EDIOrder.DeliveryDate", err)
+	}
+	
+	g := newTestGenerator(t).WithLenientDeliveryDates(true)
+	if err := g.Generate(context.Background(), order, &strings.Builder{}); err != nil {
+		t.Fatalf("Generate() with lenient delivery dates error = %v", err)
+	}
+	fields := make(map[string]bool)
+	for _, finding := range g.Lint(order) {
+		if finding.Severity == SeverityWarning {
+			fields[finding.Field] = true
+		}
+	}
+	for _, field := range []string{"EDIOrder.DeliveryDate", "EDIOrder.Items[0].DeliveryDate"} {
+		if !fields[field] {
+			t.Errorf("Lint() has no warning for %s", field)
+		}
+	}
+}
+
+func TestControlTotals(t *testing.T) {
+	order := testOrder()
+	order.ControlTotals = []ControlTotal{
+		{Qualifier: ControlTotalLines, Selector: ControlSelectLines},
+		{Qualifier: ControlTotalQuantity, Selector: ControlSelectQuantity},
+	}
+	
+	var cnt []string
+	for _, line := range segmentLines(generate(t, newTestGenerator(t), order)) {
+		if strings.HasPrefix(line, "CNT+") {
+			cnt = append(cnt, line)
+		}
+	}
+	if want := []string{"CNT+2:1'", "CNT+1:2.00'"}; !slices.Equal(cnt, want) {
+		t.Errorf("CNT segments = %q, want %q", cnt, want)
+	}
+	
+	order.ControlTotals = []ControlTotal{{Qualifier: "99", Selector: ControlSelectLines}}
+	var verr *ValidationError
+	if err := order.Validate(); !errors.As(err, &verr) || verr.Field != "EDIOrder.ControlTotals[0].Qualifier" {
+		t.Errorf("Validate() with an unknown qualifier error = %v, want EDIOrder.ControlTotals[0].Qualifier", err)
+	}
+}
+
+func TestMinimalOrderValidatesAndGenerates(t *testing.T) {
+	order := MinimalOrder("SENDER", "RECEIVER", "HB1")
+	if err := order.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if len(order.Items) != 1 {
+		t.Errorf("len(Items) = %d, want 1 placeholder item", len(order.Items))
+	}
+	
+	lines := segmentLines(generate(t, newTestGenerator(t), order))
+	if !strings.HasPrefix(lines[0], "UNB+") || !strings.HasPrefix(lines[len(lines)-1], "UNZ+1+") {
+		t.Errorf("segments = %q, want a complete interchange", lines)
+	}
+}
+
+func TestUNTCountIncludesUNHAndUNT(t *testing.T) {
+	order := testOrder()
+	order.Items = append(order.Items, EDIOrderItem{LineNumber: 2, BuyerItemCode: "I2", Quantity: 1, UnitPrice: 4, Amount: 4})
+	order.TotalAmount = 10
+	order.TotalLines = 2
+	
+	for _, legacy := range []bool{false, true} {
+		lines := segmentLines(generate(t, newTestGenerator(t).WithLegacyUNTCount(legacy), order))
+		written, unt := 0, ""
+		for _, line := range lines {
+			if strings.HasPrefix(line, "UNH+") {
+				written = 0
+			}
+			written++
+			if strings.HasPrefix(line, "UNT+") {
+				unt = line
+				break
+			}
+		}
+		want := written
+		if legacy {
+			want--
+		}
+		if prefix := fmt.Sprintf("UNT+%d+", want); !strings.HasPrefix(unt, prefix) {
+			t.Errorf("legacy=%v: UNT = %q, want %s... for %d segments from UNH to UNT", legacy, unt, prefix, written)
+		}
+	}
+}
+
+func TestExtraSegmentsAtAnchors(t *testing.T) {
+	order := testOrder()
+	order.Items = append(order.Items, EDIOrderItem{LineNumber: 2, BuyerItemCode: "I2", Quantity: 1, UnitPrice: 4, Amount: 4, Description: "Gadget"})
+	order.TotalAmount = 10
+	order.TotalLines = 2
+	order.ExtraSegments = map[Anchor][]EDISegment{
+		AnchorAfterBGM:        {{Tag: "FTX", Elements: []string{"AAI", "", "", "Header note"}}},
+		AnchorPerLineAfterMOA: {{Tag: "FTX", Elements: []string{"LIN", "", "", "Line note"}}},
+	}
+	
+	lines := segmentLines(generate(t, newTestGenerator(t), order))
+	var tags []string
+	for _, line := range lines {
+		tags = append(tags, line[:3])
+	}
+	want := []string{
+		"UNB", "UNH", "BGM", "FTX", "DTM", "CUX", "NAD", "NAD",
+		"LIN", "IMD", "QTY", "PRI", "MOA", "FTX",
+		"LIN", "IMD", "QTY", "PRI", "MOA", "FTX",
+		"UNS", "CNT", "MOA", "UNT", "UNZ",
+	}
+	if !slices.Equal(tags, want) {
+		t.Fatalf("segment order = %v, want %v", tags, want)
+	}
+	if lines[3] != "FTX+AAI+++Header note'" || lines[13] != "FTX+LIN+++Line note'" {
+		t.Errorf("extra segments rendered as %q and %q", lines[3], lines[13])
+	}
+	if unt := lines[len(lines)-2]; unt != "UNT+23+1'" {
+		t.Errorf("UNT = %q, want UNT+23+1' counting the three extra segments", unt)
+	}
+}
+
+func TestTestIndicator(t *testing.T) {
+	order := testOrder()
+	order.TestIndicator = IndicatorTest
+	lines := segmentLines(generate(t, newTestGenerator(t), order))
+	if !strings.HasSuffix(lines[0], "+1'") {
+		t.Errorf("UNB = %q, want test indicator 1", lines[0])
+	}
+	
+	for _, indicator := range []int{2, -1} {
+		order.TestIndicator = indicator
+		var verr *ValidationError
+		if err := order.Validate(); !errors.As(err, &verr) || verr.Field != "EDIOrder.TestIndicator" {
+			t.Errorf("Validate() with TestIndicator=%d error = %v, want EDIOrder.TestIndicator", indicator, err)
+		}
+	}
+}
+
+func TestLineReferenceDate(t *testing.T) {
+	order := testOrder()
+	order.Items[0].References = []Reference{{Qualifier: ReferenceOrder, Number: "PO0", Date: testOrderDate.AddDate(0, 0, -10)}}
+	
+	lines := segmentLines(generate(t, newTestGenerator(t), order))
+	lin := slices.IndexFunc(lines, func(line string) bool { return strings.HasPrefix(line, "LIN+") })
+	rff := slices.Index(lines, "RFF+ON:PO0'")
+	if lin < 0 || rff < lin || rff+1 >= len(lines) || lines[rff+1] != "DTM+171:20240220:102'" {
+		t.Errorf("segments = %q, want RFF+ON:PO0 followed by DTM+171 inside the LIN group", lines)
+	}
+	
+	order.Items[0].Dates = []LineDate{{Qualifier: "XYZ", Date: testOrderDate}}
+	var verr *ValidationError
+	if err := order.Validate(); !errors.As(err, &verr) || verr.Field != "EDIOrderItem.Dates[0].Qualifier" {
+		t.Errorf("Validate() with an unknown date qualifier error = %v, want EDIOrderItem.Dates[0].Qualifier", err)
+	}
+}
+
+func TestComputedQuantityControlTotal(t *testing.T) {
+	order := testOrder()
+	order.Items = append(order.Items, EDIOrderItem{LineNumber: 2, BuyerItemCode: "I2", Quantity: 0.5, UnitPrice: 4, Amount: 2})
+	order.TotalAmount = 8
+	order.TotalLines = 2
+	
+	g := newTestGenerator(t).WithQuantityControlTotal(true).WithQuantityPrecision(3)
+	if out := generate(t, g, order); !strings.Contains(out, "CNT+1:2.500'") {
+		t.Errorf("output lacks the computed CNT+1:2.500:\n%s", out)
+	}
+	
+	order.TotalQuantity = 3
+	err := g.Generate(context.Background(), order, &strings.Builder{})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Field != "EDIOrder.TotalQuantity" {
+		t.Errorf("Generate() with a mismatched TotalQuantity error = %v, want EDIOrder.TotalQuantity", err)
+	}
+}
+
+func TestStructuredNADLayout(t *testing.T) {
+	order := testOrder()
+	order.Seller = Address{Name: "Seller", ID: "S1", StreetLines: []string{"2 Side St", "Unit 4"}, City: "Chicago", Region: "IL", PostalCode: "60601", CountryCode: "US"}
+	
+	lines := segmentLines(generate(t, newTestGenerator(t), order))
+	for _, want := range []string{
+		"NAD+BY+B1::9+1 Main St++Buyer'",
+		"NAD+SE+S1::9++Seller+2 Side St:Unit 4+Chicago+IL+60601+US'",
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("segments lack %s:\n%q", want, lines)
+		}
+	}
+	
+	order.Seller.PostalCode = strings.Repeat("9", 18)
+	var verr *ValidationError
+	if err := order.Validate(); !errors.As(err, &verr) || verr.Field != "Address.PostalCode" {
+		t.Errorf("Validate() with an 18-character postcode error = %v, want Address.PostalCode", err)
+	}
+}
+
+func TestTwoInstalmentSplit(t *testing.T) {
+	order := testOrder()
+	order.PaymentInstalments = []Instalment{
+		{Percentage: 50, DueDate: testOrderDate},
+		{Percentage: 50, DueDate: testOrderDate.AddDate(0, 0, 30)},
+	}
+	
+	var got []string
+	for _, line := range segmentLines(generate(t, newTestGenerator(t), order)) {
+		switch line[:3] {
+		case SegmentTagPAT, SegmentTagPCD:
+			got = append(got, line)
+		case SegmentTagDTM:
+			if strings.HasPrefix(line, "DTM+13:") {
+				got = append(got, line)
+			}
+		}
+	}
+	want := []string{
+		"PAT+1'", "DTM+13:20240301:102'", "PCD+12:50'",
+		"PAT+1'", "DTM+13:20240331:102'", "PCD+12:50'",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("instalment segments = %q, want %q", got, want)
+	}
+	
+	order.PaymentInstalments[1].Percentage = 40
+	var verr *ValidationError
+	if err := order.Validate(); !errors.As(err, &verr) || verr.Field != "EDIOrder.PaymentInstalments" {
+		t.Errorf("Validate() with percentages summing to 90 error = %v, want EDIOrder.PaymentInstalments", err)
+	}
+}
+
+func TestSupplierItemCodeValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		wantErr bool
+	}{
+		{"absent", "", false},
+		{"35 characters", strings.Repeat("S", 35), false},
+		{"36 characters", strings.Repeat("S", 36), true},
+		{"non-ASCII", "SUP-é", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := testOrder().Items[0]
+			item.SupplierItemCode = tt.code
+			err := item.Validate()
+			var verr *ValidationError
+			if tt.wantErr && (!errors.As(err, &verr) || verr.Field != "EDIOrderItem.SupplierItemCode") {
+				t.Errorf("Validate() error = %v, want EDIOrderItem.SupplierItemCode", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestDescriptionWithCodedCharacteristics(t *testing.T) {
+	order := testOrder()
+	order.Items[0].IMDs = []ItemDescription{
+		{Characteristic: "35", Code: "RED", Agency: "91"},
+		{Characteristic: "98", Code: "XL", Agency: "91"},
+	}
+	
+	lines := segmentLines(generate(t, newTestGenerator(t), order))
+	var imds []string
+	untIndex, unhIndex := -1, -1
+	for i, line := range lines {
+		switch line[:3] {
+		case SegmentTagIMD:
+			imds = append(imds, line)
+		case SegmentTagUNH:
+			unhIndex = i
+		case SegmentTagUNT:
+			untIndex = i
+		}
+	}
+	want := []string{"IMD+F+++:::Widget'", "IMD+C+35++RED::91'", "IMD+C+98++XL::91'"}
+	if !slices.Equal(imds, want) {
+		t.Errorf("IMD segments = %q, want %q", imds, want)
+	}
+	if prefix := fmt.Sprintf("UNT+%d+", untIndex-unhIndex+1); !strings.HasPrefix(lines[untIndex], prefix) {
+		t.Errorf("UNT = %q, want %s... counting every IMD", lines[untIndex], prefix)
+	}
+}
+
+func TestLintCodeTextMismatch(t *testing.T) {
+	order := testOrder()
+	order.DeliveryTermsCode = "CIF"
+	order.DeliveryTermsLocation = "Hamburg"
+	order.DeliveryTerms = "FOB Hamburg"
+	order.PaymentTermsCode = "1"
+	order.PaymentTerms = "Basic 1"
+	
+	var fields []string
+	for _, finding := range newTestGenerator(t).Lint(order) {
+		if strings.Contains(finding.Message, "appear inconsistent") {
+			fields = append(fields, finding.Field)
+		}
+	}
+	if want := []string{"EDIOrder.DeliveryTerms"}; !slices.Equal(fields, want) {
+		t.Errorf("inconsistency warnings on %q, want %q", fields, want)
+	}
+}
+
+func TestSegmentPlanOmitsCUXWithoutCurrency(t *testing.T) {
+	g := newTestGenerator(t)
+	order := testOrder()
+	
+	plan, err := g.SegmentPlan(order)
+	if err != nil {
+		t.Fatalf("SegmentPlan() error = %v", err)
+	}
+	if !slices.Contains(plan, SegmentTagCUX) {
+		t.Errorf("plan %v lacks CUX for an order with a currency", plan)
+	}
+	
+	order.Currency = ""
+	plan, err = g.SegmentPlan(order)
+	if err != nil {
+		t.Fatalf("SegmentPlan() without currency error = %v", err)
+	}
+	if slices.Contains(plan, SegmentTagCUX) {
+		t.Errorf("plan %v contains CUX for an order without a currency", plan)
+	}
+	if want := []string{SegmentTagUNB, SegmentTagUNH, SegmentTagBGM, SegmentTagDTM, SegmentTagNAD, SegmentTagNAD}; !slices.Equal(plan[:len(want)], want) {
+		t.Errorf("plan starts with %v, want %v", plan[:len(want)], want)
+	}
+}
+
+func TestCodedIMDFormat(t *testing.T) {
+	order := testOrder()
+	order.Items[0].IMDFormatCode = ItemFormatCoded
+	order.Items[0].ItemDescriptionCode = "RED"
+	order.Items[0].ItemDescriptionAgency = "91"
+	
+	lines := segmentLines(generate(t, newTestGenerator(t), order))
+	if !slices.Contains(lines, "IMD+C+++RED::91'") {
+		t.Errorf("segments lack the coded IMD+C+++RED::91:\n%q", lines)
+	}
+	
+	order.Items[0].IMDFormatCode = "Z"
+	var verr *ValidationError
+	if err := order.Validate(); !errors.As(err, &verr) || verr.Field != "EDIOrderItem.IMDFormatCode" {
+		t.Errorf("Validate() with format Z error = %v, want EDIOrderItem.IMDFormatCode", err)
+	}
+}
+
+func TestArchiveWriterTwoOrders(t *testing.T) {
+	var buf bytes.Buffer
+	naming := NewEDIWriter("").WithClockFunc(func() time.Time { return testOrderDate })
+	archive := NewArchiveWriter(&buf, naming)
+	
+	first, second := testOrder(), testOrder()
+	second.OrderNumber = "../PO2"
+	for _, order := range []EDIOrder{first, second} {
+		if _, err := archive.WriteOrder(context.Background(), order, "content "+order.OrderNumber); err != nil {
+			t.Fatalf("WriteOrder(%s) error = %v", order.OrderNumber, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+	want := map[string]string{
+		"ORDER_PO1_20240301_103000.edi":    "content PO1",
+		"ORDER____PO2_20240301_103000.edi": "content ../PO2",
+	}
+	if len(reader.File) != len(want) {
+		t.Fatalf("archive has %d entries, want %d", len(reader.File), len(want))
+	}
+	for _, file := range reader.File {
+		content, ok := want[file.Name]
+		if !ok {
+			t.Errorf("unexpected archive entry %q", file.Name)
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", file.Name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(data) != content {
+			t.Errorf("entry %s = %q, %v; want %q", file.Name, data, err, content)
+		}
+	}
+}
+
+func TestORDCHGMessageHeader(t *testing.T) {
+	g := newTestGenerator(t)
+	order := testOrder()
+	order.MessageType = "ORDCHG"
+	
+	lines := segmentLines(generate(t, g, order))
+	if !slices.Contains(lines, "UNH+1+ORDCHG:D:96A:UN:EAN008'") {
+		t.Errorf("segments lack UNH+1+ORDCHG:D:96A:UN:EAN008:\n%q", lines)
+	}
+	if parsed := parseGenerated(t, g, order); parsed.MessageType != "ORDCHG" {
+		t.Errorf("parsed MessageType = %q, want ORDCHG", parsed.MessageType)
+	}
+}
+
+func TestCorrelationIDSurfacesInStatsAndObserver(t *testing.T) {
+	var events []SegmentEvent
+	g := newTestGenerator(t).WithSegmentObserver(func(event SegmentEvent) {
+		events = append(events, event)
+	})
+	
+	ctx := ContextWithCorrelationID(context.Background(), "trace-42")
+	stats, err := g.GenerateWithStats(ctx, testOrder(), &strings.Builder{})
+	if err != nil {
+		t.Fatalf("GenerateWithStats() error = %v", err)
+	}
+	if stats.CorrelationID != "trace-42" {
+		t.Errorf("GenStats.CorrelationID = %q, want trace-42", stats.CorrelationID)
+	}
+	if len(events) != stats.Segments {
+		t.Errorf("observer saw %d events, want %d", len(events), stats.Segments)
+	}
+	for _, event := range events {
+		if event.CorrelationID != "trace-42" {
+			t.Fatalf("event %+v lacks the correlation ID", event)
+		}
+	}
+	
+	stats, err = g.GenerateWithStats(context.Background(), testOrder(), &strings.Builder{})
+	if err != nil || stats.CorrelationID != "" {
+		t.Errorf("GenerateWithStats() without an ID = %q, %v; want empty", stats.CorrelationID, err)
+	}
+}
+
+func TestCorrelationIDReachesEveryEmitter(t *testing.T) {
+	var events []SegmentEvent
+	g := newTestGenerator(t).WithSegmentObserver(func(event SegmentEvent) {
+		events = append(events, event)
+	})
+	ctx := ContextWithCorrelationID(context.Background(), "trace-7")
+	
+	interchange := testInterchange("10")
+	extra := testOrder()
+	extra.MessageRefNumber = "2"
+	extra.OrderNumber = "PO2"
+	interchange.Orders = append(interchange.Orders, extra)
+	cache := NewPreGenerationCache(g)
+	cache.Prepare(context.Background(), "k", testOrder())
+	
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{name: "GenerateInterchange", run: func() error {
+			_, err := g.GenerateInterchange(ctx, interchange, &strings.Builder{})
+			return err
+		}},
+		{name: "GenerateStream", run: func() error {
+			return g.GenerateStream(ctx, []Interchange{interchange, testInterchange("11")}, &strings.Builder{})
+		}},
+		{name: "GenerateCONTRL", run: func() error {
+			ack := Acknowledgement{
+				Original: InterchangeHeader{SenderID: "SENDER", ReceiverID: "RECEIVER", ControlRef: "7"},
+				Messages: []MessageAcknowledgement{{MessageRefNumber: "1", Accepted: true}},
+			}
+			return g.GenerateCONTRL(ctx, ack, &strings.Builder{})
+		}},
+		{name: "PreGenerationCache", run: func() error {
+			return cache.Generate(ctx, "k", "PO3", "3", testOrderDate, &strings.Builder{})
+		}},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events = nil
+			if err := tt.run(); err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if len(events) == 0 {
+				t.Fatal("observer saw no events")
+			}
+			for _, event := range events {
+				if event.CorrelationID != "trace-7" {
+					t.Fatalf("event %+v lacks the correlation ID", event)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageIdentifierValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*EDIOrder)
+		field  string
+	}{
+		{"typo'd association code", func(o *EDIOrder) { o.AssociationCode = "EAN08" }, "EDIOrder.AssociationCode"},
+		{"unknown agency", func(o *EDIOrder) { o.ResponsibleAgency = "XX" }, "EDIOrder.ResponsibleAgency"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := testOrder()
+			tt.modify(&order)
+			
+			err := newTestGenerator(t).Generate(context.Background(), order, &strings.Builder{})
+			var verr *ValidationError
+			if !errors.As(err, &verr) || verr.Field != tt.field {
+				t.Errorf("Generate() error = %v, want %s", err, tt.field)
+			}
+			
+			if err := newTestGenerator(t).WithPermissiveMessageIdentifiers(true).Generate(context.Background(), order, &strings.Builder{}); err != nil {
+				t.Errorf("Generate() in permissive mode error = %v", err)
+			}
+		})
+	}
+}
+
+func TestParseInterchangeStreamsThreeMessages(t *testing.T) {
+	interchange := testInterchange("20")
+	for i := 2; i <= 3; i++ {
+		order := testOrder()
+		order.MessageRefNumber = fmt.Sprint(i)
+		order.OrderNumber = fmt.Sprintf("PO%d", i)
+		interchange.Orders = append(interchange.Orders, order)
+	}
+	var out strings.Builder
+	if _, err := newTestGenerator(t).GenerateInterchange(context.Background(), interchange, &out); err != nil {
+		t.Fatalf("GenerateInterchange() error = %v", err)
+	}
+	
+	header, orders := ParseInterchange(context.Background(), strings.NewReader(out.String()))
+	var numbers []string
+	for order, err := range orders {
+		if err != nil {
+			t.Fatalf("ParseInterchange() error = %v", err)
+		}
+		numbers = append(numbers, order.OrderNumber)
+	}
+	if want := []string{"PO1", "PO2", "PO3"}; !slices.Equal(numbers, want) {
+		t.Errorf("streamed orders = %v, want %v", numbers, want)
+	}
+	if header.ControlRef != "20" {
+		t.Errorf("header ControlRef = %q, want 20", header.ControlRef)
+	}
+	
+	tampered := strings.Replace(out.String(), "UNZ+3+20'", "UNZ+4+20'", 1)
+	_, orders = ParseInterchange(context.Background(), strings.NewReader(tampered))
+	var lastErr error
+	for _, err := range orders {
+		if err != nil {
+			lastErr = err
+		}
+	}
+	if !errors.Is(lastErr, ErrControlCountMismatch) {
+		t.Errorf("ParseInterchange() with UNZ+4 error = %v, want ErrControlCountMismatch", lastErr)
+	}
+}
+
+func TestReversedEnvelope(t *testing.T) {
+	order := testOrder()
+	order.InterchangeSenderID = "4006381333931"
+	order.InterchangeSenderQualifier = InterchangeQualifierGLN
+	order.InterchangeReceiverQualifier = "ZZZ"
+	
+	reversed := order.ReversedEnvelope()
+	if reversed.InterchangeSenderID != "RECEIVER" || reversed.InterchangeReceiverID != "4006381333931" {
+		t.Errorf("IDs = %q -> %q, want RECEIVER -> 4006381333931", reversed.InterchangeSenderID, reversed.InterchangeReceiverID)
+	}
+	if reversed.InterchangeSenderQualifier != "ZZZ" || reversed.InterchangeReceiverQualifier != InterchangeQualifierGLN {
+		t.Errorf("qualifiers = %q -> %q, want ZZZ -> 14", reversed.InterchangeSenderQualifier, reversed.InterchangeReceiverQualifier)
+	}
+	if reversed.InterchangeControlRef == "" || reversed.InterchangeControlRef == order.InterchangeControlRef {
+		t.Errorf("InterchangeControlRef = %q, want a new reference", reversed.InterchangeControlRef)
+	}
+	
+	order.InterchangeControlRef = "5"
+	if ref := order.reversedEnvelope(time.Unix(0, 5)).InterchangeControlRef; ref == "5" {
+		t.Errorf("control reference %q was not bumped past the previous one", ref)
+	}
+	
+	g := newTestGenerator(t)
+	first, second := g.ReversedEnvelope(order), g.ReversedEnvelope(order)
+	if !first.OrderDate.Equal(testOrderDate) || first.InterchangeControlRef != second.InterchangeControlRef {
+		t.Errorf("generator envelopes = %s/%s and %s, want the fixed clock %s", first.OrderDate, first.InterchangeControlRef, second.InterchangeControlRef, testOrderDate)
+	}
+}
+
+func TestAmountDigitLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  float64
+		wantErr bool
+	}{
+		{"18 digits", 1234567890123456, false},
+		{"20 digits", 123456789012345678, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := testOrder()
+			order.Items[0].Amount = tt.amount
+			order.TotalAmount = tt.amount
+			
+			err := newTestGenerator(t).Generate(context.Background(), order, &strings.Builder{})
+			var verr *ValidationError
+			if tt.wantErr && (!errors.As(err, &verr) || verr.Field != "EDIOrderItem.Amount") {
+				t.Errorf("Generate() error = %v, want EDIOrderItem.Amount digit limit", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Generate() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestTreatWarningsAsErrors(t *testing.T) {
+	order := testOrder()
+	order.InterchangeReceiverID = order.InterchangeSenderID
+	
+	if err := newTestGenerator(t).Generate(context.Background(), order, &strings.Builder{}); err != nil {
+		t.Fatalf("Generate() of a warning-only order error = %v", err)
+	}
+	
+	err := newTestGenerator(t).WithTreatWarningsAsErrors(true).Generate(context.Background(), order, &strings.Builder{})
+	var lintErr *LintErrors
+	if !errors.As(err, &lintErr) {
+		t.Fatalf("Generate() with warnings as errors error = %v, want *LintErrors", err)
+	}
+	if len(lintErr.Findings) != 1 || lintErr.Findings[0].Field != "EDIOrder.InterchangeReceiverID" {
+		t.Errorf("findings = %+v, want the self-addressed warning", lintErr.Findings)
+	}
+}
+
+func TestVersionedBGM(t *testing.T) {
+	order := testOrder()
+	if lines := segmentLines(generate(t, newTestGenerator(t), order)); !slices.Contains(lines, "BGM+220+PO1+9'") {
+		t.Errorf("segments lack the unversioned BGM+220+PO1+9:\n%q", lines)
+	}
+	
+	order.OrderVersion = "2"
+	order.OrderRevision = "1"
+	if lines := segmentLines(generate(t, newTestGenerator(t), order)); !slices.Contains(lines, "BGM+220+PO1:2:1+9'") {
+		t.Errorf("segments lack BGM+220+PO1:2:1+9:\n%q", lines)
+	}
+	
+	g, err := newTestGenerator(t).WithCustomSeparators("'", "+", ">", ".", "?")
+	if err != nil {
+		t.Fatalf("WithCustomSeparators() error = %v", err)
+	}
+	if out := generate(t, g, order); !strings.Contains(out, "BGM+220+PO1>2>1+9'") {
+		t.Errorf("output lacks BGM+220+PO1>2>1+9:\n%s", out)
+	}
+}
+
+func TestCustomValidatorMinimumOrderTotal(t *testing.T) {
+	minimumTotal := ValidatorFunc(func(order EDIOrder) []error {
+		if order.TotalAmount < 10 {
+			return []error{&ValidationError{Field: "EDIOrder.TotalAmount", Message: "orders must total at least 10"}}
+		}
+		return nil
+	})
+	g := newTestGenerator(t).WithValidators(minimumTotal)
+	
+	order := testOrder()
+	order.TestIndicator = 2
+	err := g.Generate(context.Background(), order, &strings.Builder{})
+	var errs *ValidationErrors
+	if !errors.As(err, &errs) || len(errs.Errors) != 2 {
+		t.Fatalf("Generate() error = %v, want the built-in and the custom error aggregated", err)
+	}
+	var verr *ValidationError
+	if !errors.As(errs.Errors[1], &verr) || verr.Field != "EDIOrder.TotalAmount" {
+		t.Errorf("second error = %v, want the EDIOrder.TotalAmount rule", errs.Errors[1])
+	}
+	
+	order = testOrder()
+	order.Items[0].Quantity = 4
+	order.Items[0].Amount = 12
+	order.TotalAmount = 12
+	if err := g.Generate(context.Background(), order, &strings.Builder{}); err != nil {
+		t.Errorf("Generate() of an order above the minimum error = %v", err)
+	}
+}
+
+func TestParseSkipsLeadingBOM(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		orderNumber string
+	}{
+		{"bom_order.edi", "PO-GOLD-001"},
+		{"bom_una_order.edi", "PO-GOLD-003"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "parse", tt.fixture))
+			if err != nil {
+				t.Fatalf("failed to read fixture: %v", err)
+			}
+			if !bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}) {
+				t.Fatalf("fixture %s does not start with a UTF-8 BOM", tt.fixture)
+			}
+			
+			order, err := Parse(context.Background(), bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if order.OrderNumber != tt.orderNumber {
+				t.Errorf("OrderNumber = %q, want %q", order.OrderNumber, tt.orderNumber)
+			}
+			if order.InterchangeSenderID == "" || len(order.Items) == 0 {
+				t.Errorf("parsed order is incomplete: %+v", order)
+			}
+		})
+	}
+}
+
+func TestFromX12_850(t *testing.T) {
+	x12 := X12Order{
+		SenderID:           " ACME ",
+		ReceiverID:         "SUPPLIER",
+		ControlNumber:      "000000042",
+		Usage:              "T",
+		TransactionControl: "0001",
+		BEG:                X12BEG{Purpose: "00", OrderType: "SA", PONumber: "PO-850", Date: "20240301"},
+		Currency:           "USD",
+		Dates:              []X12DTM{{Qualifier: "002", Date: "20240315"}},
+		Parties: []X12Party{
+			{EntityCode: "BY", Name: "Acme", IDQualifier: "UL", ID: "4012345000009", AddressLines: []string{"1 Main St"}},
+			{EntityCode: "ST", Name: "Warehouse", IDQualifier: "ZZ", ID: "WH1", City: "Springfield", Country: "US"},
+			{EntityCode: "CA", Name: "Carrier"},
+		},
+		Lines: []X12Line{
+			{Quantity: 3, UnitOfMeasure: "EA", UnitPrice: 1.5, Description: "Bolt", ProductIDs: []X12ProductID{
+				{Qualifier: "BP", ID: "B-1"}, {Qualifier: "VP", ID: "V-1"}, {Qualifier: "EN", ID: "4006381333931"},
+			}},
+			{AssignedID: "7", Quantity: 2, UnitOfMeasure: "CA", UnitPrice: 10, ProductIDs: []X12ProductID{{Qualifier: "IN", ID: "B-2"}}},
+		},
+	}
+	
+	order := FromX12_850(x12)
+	if order.InterchangeSenderID != "ACME" || order.InterchangeControlRef != "42" || order.MessageRefNumber != "0001" {
+		t.Errorf("envelope = %q/%q/%q, want ACME/42/0001", order.InterchangeSenderID, order.InterchangeControlRef, order.MessageRefNumber)
+	}
+	if order.OrderNumber != "PO-850" || !order.OrderDate.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("order = %q %v, want PO-850 on 2024-03-01", order.OrderNumber, order.OrderDate)
+	}
+	if !order.DeliveryDate.Equal(time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("DeliveryDate = %v, want 2024-03-15", order.DeliveryDate)
+	}
+	if order.TestIndicator != IndicatorTest {
+		t.Errorf("TestIndicator = %d, want %d", order.TestIndicator, IndicatorTest)
+	}
+	if order.Buyer.Name != "Acme" || order.Buyer.IDType != IDTypeBuyer || !slices.Equal(order.Buyer.Lines, []string{"1 Main St"}) {
+		t.Errorf("Buyer = %+v", order.Buyer)
+	}
+	if order.Delivery.IDType != "ZZZ" || order.Delivery.City != "Springfield" || order.Delivery.CountryCode != "US" {
+		t.Errorf("Delivery = %+v", order.Delivery)
+	}
+	if len(order.AdditionalParties) != 1 || order.AdditionalParties[0].Qualifier != "CA" {
+		t.Errorf("AdditionalParties = %+v, want one CA party", order.AdditionalParties)
+	}
+	
+	if len(order.Items) != 2 {
+		t.Fatalf("len(Items) = %d, want 2", len(order.Items))
+	}
+	first, second := order.Items[0], order.Items[1]
+	if first.LineNumber != 1 || first.UnitOfMeasure != "PCE" || first.BuyerItemCode != "B-1" || first.SupplierItemCode != "V-1" || first.EANCode != "4006381333931" || first.Amount != 4.5 {
+		t.Errorf("first item = %+v", first)
+	}
+	if second.LineNumber != 7 || second.BuyerItemCode != "B-2" || second.Amount != 20 {
+		t.Errorf("second item = %+v", second)
+	}
+	if order.TotalAmount != 24.5 || order.TotalQuantity != 5 || order.TotalLines != 2 {
+		t.Errorf("totals = %v/%v/%d, want 24.5/5/2", order.TotalAmount, order.TotalQuantity, order.TotalLines)
+	}
+}
+
+func TestCanonicalRoundTrip(t *testing.T) {
+	order := testOrder()
+	order.Delivery = Address{Name: "Dock", Lines: []string{"3 Quay"}, ID: "D1", IDType: "9"}
+	order.AdditionalParties = []Party{{Qualifier: "CA", Address: Address{Name: "Carrier"}}}
+	order.DeliveryDate = testOrderDate.AddDate(0, 0, 7)
+	order.TestIndicator = IndicatorTest
+	order.Items[0].EANCode = "4006381333931"
+	
+	canonical := ToCanonical(order)
+	if !canonical.Test || len(canonical.Parties) != 4 || len(canonical.Lines) != 1 {
+		t.Fatalf("ToCanonical() = %+v", canonical)
+	}
+	
+	back := FromCanonical(canonical)
+	if back.OrderNumber != order.OrderNumber || !back.DeliveryDate.Equal(order.DeliveryDate) || back.TestIndicator != IndicatorTest {
+		t.Errorf("FromCanonical() header = %+v", back)
+	}
+	if !reflect.DeepEqual(back.Delivery, order.Delivery) || !reflect.DeepEqual(back.AdditionalParties, order.AdditionalParties) {
+		t.Errorf("FromCanonical() parties = %+v / %+v", back.Delivery, back.AdditionalParties)
+	}
+	if !reflect.DeepEqual(back.Items, order.Items) {
+		t.Errorf("FromCanonical() items = %+v, want %+v", back.Items, order.Items)
+	}
+	if back.TotalLines != 1 || back.TotalQuantity != 2 {
+		t.Errorf("FromCanonical() totals = %d/%v, want 1/2", back.TotalLines, back.TotalQuantity)
+	}
+	if again := ToCanonical(back); !reflect.DeepEqual(again, canonical) {
+		t.Errorf("second round trip = %+v, want %+v", again, canonical)
+	}
+}
+
+func TestDirWatcherProcessPending(t *testing.T) {
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	
+	valid, err := json.Marshal(testOrder())
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	invalid := testOrder()
+	invalid.Items = nil
+	rejected, err := json.Marshal(invalid)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	for name, content := range map[string][]byte{
+		"good.json":     valid,
+		"broken.json":   []byte("{"),
+		"rejected.json": rejected,
+		"notes.txt":     []byte("ignored"),
+	} {
+		if err := os.WriteFile(filepath.Join(inputDir, name), content, 0o644); err != nil {
+			t.Fatalf("WriteFile(%s) error = %v", name, err)
+		}
+	}
+	
+	watcher := NewDirWatcher(inputDir, outputDir, newTestGenerator(t)).WithPollInterval(0)
+	if err := watcher.ProcessPending(context.Background()); err != nil {
+		t.Fatalf("ProcessPending() error = %v", err)
+	}
+	
+	for _, want := range []string{
+		filepath.Join("processed", "good.json"),
+		filepath.Join("failed", "broken.json"),
+		filepath.Join("failed", "rejected.json"),
+		"notes.txt",
+	} {
+		if _, err := os.Stat(filepath.Join(inputDir, want)); err != nil {
+			t.Errorf("%s: %v", want, err)
+		}
+	}
+	for _, gone := range []string{"good.json", "broken.json", "rejected.json"} {
+		if _, err := os.Stat(filepath.Join(inputDir, gone)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s still pending in input directory", gone)
+		}
+	}
+	
+	written, err := filepath.Glob(filepath.Join(outputDir, "*.edi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 {
+		t.Fatalf("output files = %v, want exactly one", written)
+	}
+	data, err := os.ReadFile(written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := generate(t, newTestGenerator(t), testOrder()); string(data) != want {
+		t.Errorf("output = %q, want %q", data, want)
+	}
+	
+	if err := watcher.ProcessPending(context.Background()); err != nil {
+		t.Fatalf("second ProcessPending() error = %v", err)
+	}
+	if again, _ := filepath.Glob(filepath.Join(outputDir, "*.edi")); len(again) != 1 {
+		t.Errorf("second pass wrote %v, want no new files", again)
+	}
+}
+
+func TestWriteOrderWithSummary(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	writer := NewEDIWriter(dir).WithClockFunc(func() time.Time { return testOrderDate })
+	order := testOrder()
+	content := generate(t, newTestGenerator(t), order)
+	
+	ediPath, summaryPath, err := writer.WriteOrderWithSummary(context.Background(), order, content)
+	if err != nil {
+		t.Fatalf("WriteOrderWithSummary() error = %v", err)
+	}
+	if want := filepath.Join(dir, "ORDER_PO1_20240301_103000.edi"); ediPath != want {
+		t.Errorf("ediPath = %q, want %q", ediPath, want)
+	}
+	if strings.TrimSuffix(summaryPath, ".txt") != strings.TrimSuffix(ediPath, ".edi") {
+		t.Errorf("summaryPath = %q does not share the EDI base name %q", summaryPath, ediPath)
+	}
+	
+	data, err := os.ReadFile(ediPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("EDI file = %q, want %q", data, content)
+	}
+	summary, err := os.ReadFile(summaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(summary) != FormatOrderSummary(order) {
+		t.Errorf("summary file = %q, want %q", summary, FormatOrderSummary(order))
+	}
+	
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := writer.WriteOrderWithSummary(ctx, order, content); !errors.Is(err, context.Canceled) {
+		t.Errorf("WriteOrderWithSummary() with cancelled context error = %v, want context.Canceled", err)
+	}
+}
+
+func TestWithFilenameTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewEDIWriter(dir).WithClockFunc(func() time.Time { return testOrderDate }).WithFilenameTemplate("{{.SenderID}}-{{.ReceiverID}}-{{.OrderNumber}}")
+	if err != nil {
+		t.Fatalf("WithFilenameTemplate() error = %v", err)
+	}
+	order := testOrder()
+	order.OrderNumber = "PO/1"
+	path, err := writer.WriteOrder(context.Background(), order, "x")
+	if err != nil {
+		t.Fatalf("WriteOrder() error = %v", err)
+	}
+	if want := filepath.Join(dir, "SENDER-RECEIVER-PO_1.edi"); path != want {
+		t.Errorf("path = %q, want %q", path, want)
+	}
+	
+	for _, tmpl := range []string{"{{.OrderNumber", "{{.Missing}}", ""} {
+		if _, err := NewEDIWriter(dir).WithFilenameTemplate(tmpl); err == nil {
+			t.Errorf("WithFilenameTemplate(%q): want error", tmpl)
+		}
+	}
+}
+
+func TestMessageRefNumberPool(t *testing.T) {
+	pool := NewMessageRefNumberPool()
+	if !pool.Reserve("2") {
+		t.Fatal("Reserve(2) on empty pool = false")
+	}
+	if pool.Reserve("2") {
+		t.Error("Reserve(2) twice = true, want false")
+	}
+	if got := pool.Next(); got != "1" {
+		t.Errorf("Next() = %q, want 1", got)
+	}
+	if got := pool.Next(); got != "3" {
+		t.Errorf("Next() = %q, want 3 after reserved 2", got)
+	}
+	if pool.Reserve("3") {
+		t.Error("Reserve(3) after Next() handed it out = true, want false")
+	}
+	
+	const workers = 50
+	refs := make(chan string, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refs <- pool.Next()
+		}()
+	}
+	wg.Wait()
+	close(refs)
+	seen := make(map[string]bool)
+	for ref := range refs {
+		if seen[ref] || ref == "1" || ref == "2" || ref == "3" {
+			t.Errorf("Next() returned %q twice", ref)
+		}
+		seen[ref] = true
+	}
+}
+
+func TestNormalizeOrder(t *testing.T) {
+	berlin := time.FixedZone("CET", 3600)
+	order := testOrder()
+	order.OrderNumber = "  PO1 "
+	order.Currency = "EUR\t"
+	order.OrderDate = testOrderDate.In(berlin)
+	order.Buyer.Name = " Buyer "
+	order.Buyer.Lines = []string{" 1 Main St "}
+	order.AdditionalParties = []Party{{Qualifier: " ca ", Address: Address{Name: " Carrier ", Lines: []string{"Quay "}}}}
+	order.Items[0].BuyerItemCode = " I1 "
+	order.Items[0].Description = "Widget "
+	original := order.Items[0]
+	
+	got := NormalizeOrder(order)
+	if got.OrderNumber != "PO1" || got.Currency != "EUR" {
+		t.Errorf("header = %q/%q, want PO1/EUR", got.OrderNumber, got.Currency)
+	}
+	if got.OrderDate.Location() != time.UTC || !got.OrderDate.Equal(testOrderDate) {
+		t.Errorf("OrderDate = %v, want %v", got.OrderDate, testOrderDate)
+	}
+	if got.Buyer.Name != "Buyer" || !slices.Equal(got.Buyer.Lines, []string{"1 Main St"}) {
+		t.Errorf("Buyer = %+v", got.Buyer)
+	}
+	if len(got.AdditionalParties) != 1 || got.AdditionalParties[0].Qualifier != "CA" || got.AdditionalParties[0].Address.Name != "Carrier" {
+		t.Errorf("AdditionalParties = %+v", got.AdditionalParties)
+	}
+	if got.Items[0].BuyerItemCode != "I1" || got.Items[0].Description != "Widget" {
+		t.Errorf("item = %+v", got.Items[0])
+	}
+	if !reflect.DeepEqual(order.Items[0], original) || order.Buyer.Lines[0] != " 1 Main St " {
+		t.Error("NormalizeOrder() modified its argument")
+	}
+	if again := NormalizeOrder(got); !reflect.DeepEqual(again, got) {
+		t.Errorf("NormalizeOrder() is not idempotent:\n%+v\n%+v", again, got)
+	}
+	clean := testOrder()
+	clean.AdditionalParties = []Party{{Qualifier: "CA", Address: Address{Name: "Carrier", Lines: []string{"Quay"}}}}
+	if want := generate(t, newTestGenerator(t), clean); generate(t, newTestGenerator(t), got) != want {
+		t.Error("normalized order generates different output from the clean fixture")
+	}
+}
+
+func TestBuildTruncating(t *testing.T) {
+	g := newTestGenerator(t)
+	segment := EDISegment{Tag: SegmentTagIMD, Elements: []string{"F", "", ":::it's a long note that will not fit"}}
+	full := g.segmentText(segment)
+	
+	if got, truncated := g.BuildTruncating(segment, len(full)); got != full || truncated {
+		t.Errorf("BuildTruncating(fits) = %q, %v, want %q, false", got, truncated, full)
+	}
+	
+	for _, maxLen := range []int{30, 20, 14, 12, 5} {
+		got, truncated := g.BuildTruncating(segment, maxLen)
+		if !truncated {
+			t.Errorf("BuildTruncating(%d) truncated = false", maxLen)
+		}
+		if len(got) > maxLen && got != g.segmentText(EDISegment{Tag: segment.Tag}) {
+			t.Errorf("BuildTruncating(%d) = %q, longer than the limit", maxLen, got)
+		}
+		if !strings.HasPrefix(full, strings.TrimSuffix(got, "'")) {
+			t.Errorf("BuildTruncating(%d) = %q, not a prefix of %q", maxLen, got, full)
+		}
+		if strings.HasSuffix(got, "?'") {
+			t.Errorf("BuildTruncating(%d) = %q splits an escape sequence", maxLen, got)
+		}
+	}
+}